@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// walletControl is shared by the wallets that sign for one node, the
+// generations of a ReloadableWallet and both keys of a MigrationWallet, so a
+// pause outlives a reload or a switch.
+type walletControl struct {
+	mu        sync.Mutex
+	paused    bool
+	lastSign  time.Time // of the last successful Sign call
+	lastError string    // of the last Sign call, if it failed
+}
+
+// check returns an ErrSigningPaused error while signing is paused.
+func (c *walletControl) check() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused {
+		return walleterr.New(walleterr.ErrSigningPaused, "signing paused by the admin socket")
+	}
+	return nil
+}
+
+// signed records a Sign call that started at start.
+func (c *walletControl) signed(start time.Time, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.lastError = err.Error()
+		return
+	}
+	c.lastSign, c.lastError = start, ""
+}
+
+func (c *walletControl) setPaused(paused bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = paused
+}
+
+// adminWallet is a wallet the admin socket reports on, a ReloadableWallet
+// or a MigrationWallet. signingWallet returns the wallet that signs right
+// now.
+type adminWallet interface {
+	SelfTest() (Attestation, error)
+	signingWallet() Wallet
+}
+
+func (r *ReloadableWallet) signingWallet() Wallet {
+	return r.generation().Wallet
+}
+
+func (m *MigrationWallet) signingWallet() Wallet {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.active()
+}
+
+// AdminStatus is the reply of the status call of the admin socket.
+type AdminStatus struct {
+	Backend   string          `json:"backend"`
+	Address   string          `json:"address"`
+	PublicKey string          `json:"public_key"`
+	Health    Health          `json:"health"`
+	Paused    bool            `json:"paused"`
+	LastSign  *time.Time      `json:"last_sign,omitempty"`
+	LastError string          `json:"last_error,omitempty"`
+	Migration *migrationState `json:"migration,omitempty"`
+}
+
+func adminStatus(aw adminWallet) AdminStatus {
+	w := aw.signingWallet()
+	s := AdminStatus{
+		Backend:   w.backendName(),
+		Address:   w.addr.String(),
+		PublicKey: "0x" + hex.EncodeToString(w.pkey.SerializeCompressed()),
+		Health:    w.Health(),
+	}
+	w.control.mu.Lock()
+	s.Paused, s.LastError = w.control.paused, w.control.lastError
+	if !w.control.lastSign.IsZero() {
+		t := w.control.lastSign.UTC()
+		s.LastSign = &t
+	}
+	w.control.mu.Unlock()
+	if m, ok := aw.(*MigrationWallet); ok {
+		state := m.MigrationStatus()
+		s.Migration = &state
+	}
+	return s
+}
+
+// adminServer serves the admin API on a Unix socket. It is HTTP, so besides
+// the wallet-admin command curl --unix-socket can call it:
+//
+//	GET  /status     AdminStatus
+//	POST /self-test  the Attestation of a self-test, 500 if it failed
+//	POST /pause      fail Sign calls with ErrSigningPaused
+//	POST /resume
+//	POST /refresh    rebuild the backend clients with fresh credentials
+//	GET  /metrics    the metrics in the Prometheus text format
+//
+// With admin_token every call needs an Authorization: Bearer TOKEN header.
+type adminServer struct {
+	path string
+	l    net.Listener
+
+	mu     sync.Mutex
+	token  string
+	wallet adminWallet // nil until the wallet is loaded
+}
+
+var (
+	adminMu      sync.Mutex
+	adminServers = make(map[string]*adminServer)
+)
+
+// listenAdmin listens on the socket named by the admin_socket param, which
+// is created with the file mode admin_socket_mode (default 0600). A socket
+// left behind by a process that exited is replaced. Listening on a path
+// twice, e.g. when goloop loads the wallet again, reuses the listener; fresh
+// is false then.
+func listenAdmin(params map[string]string) (s *adminServer, fresh bool, err error) {
+	path := params["admin_socket"]
+	mode := os.FileMode(0600)
+	if v := params["admin_socket_mode"]; v != "" {
+		m, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || m&^0777 != 0 {
+			return nil, false, invalidParam("admin_socket_mode", fmt.Errorf("%q is not an octal file mode", v))
+		}
+		mode = os.FileMode(m)
+	}
+
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	if s, ok := adminServers[path]; ok {
+		s.mu.Lock()
+		s.token = params["admin_token"]
+		s.mu.Unlock()
+		return s, false, nil
+	}
+
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, false, invalidParam("admin_socket", fmt.Errorf("%s exists and is not a socket", path))
+		}
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, false, invalidParam("admin_socket", fmt.Errorf("%s is in use", path))
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, false, invalidParam("admin_socket", err)
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, false, invalidParam("admin_socket", err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, false, invalidParam("admin_socket", err)
+	}
+
+	s = &adminServer{path: path, token: params["admin_token"], l: l}
+	srv := &http.Server{Handler: s, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Error("admin socket stopped", "path", path, "err", err)
+		}
+	}()
+	adminServers[path] = s
+	logger.Info("serving admin socket", "path", path, "mode", fmt.Sprintf("%04o", mode), "token", s.token != "")
+	return s, true, nil
+}
+
+func (s *adminServer) setWallet(w adminWallet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.wallet = w
+}
+
+// close stops serving and removes the socket.
+func (s *adminServer) close() {
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	if adminServers[s.path] == s {
+		delete(adminServers, s.path)
+	}
+	s.l.Close()
+}
+
+func (s *adminServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	token, w := s.token, s.wallet
+	s.mu.Unlock()
+	if token != "" {
+		want := []byte("Bearer " + token)
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			adminError(rw, http.StatusUnauthorized, walleterr.New(walleterr.ErrPermissionDenied, "admin token required"))
+			return
+		}
+	}
+	if w == nil {
+		adminError(rw, http.StatusServiceUnavailable, walleterr.New(walleterr.ErrBackendUnavailable, "wallet not loaded"))
+		return
+	}
+
+	method := http.MethodPost
+	switch r.URL.Path {
+	case "/status", "/metrics":
+		method = http.MethodGet
+	}
+	if r.Method != method {
+		rw.Header().Set("Allow", method)
+		adminError(rw, http.StatusMethodNotAllowed, fmt.Errorf("%s needs %s", r.URL.Path, method))
+		return
+	}
+
+	switch r.URL.Path {
+	case "/status":
+		adminReply(rw, http.StatusOK, adminStatus(w))
+	case "/self-test":
+		a, err := w.SelfTest()
+		status := http.StatusOK
+		if err != nil {
+			status = http.StatusInternalServerError
+		}
+		logger.Info("admin self-test", "passed", a.Passed, "err", err)
+		adminReply(rw, status, a)
+	case "/pause", "/resume":
+		paused := r.URL.Path == "/pause"
+		w.signingWallet().control.setPaused(paused)
+		logger.Warn("admin "+r.URL.Path[1:]+" signing", "address", w.signingWallet().addr)
+		adminReply(rw, http.StatusOK, adminStatus(w))
+	case "/refresh":
+		reloadable, ok := w.(*ReloadableWallet)
+		if !ok {
+			adminError(rw, http.StatusConflict, walleterr.New(walleterr.ErrBackendNotSupported, "credential refresh is not available during a key migration"))
+			return
+		}
+		logger.Info("admin credential refresh")
+		if err := reloadable.Reload(); err != nil {
+			adminError(rw, http.StatusInternalServerError, err)
+			return
+		}
+		adminReply(rw, http.StatusOK, adminStatus(w))
+	case "/metrics":
+		var b bytes.Buffer
+		if err := metricsRegistry.WriteText(&b); err != nil {
+			adminError(rw, http.StatusInternalServerError, err)
+			return
+		}
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		rw.Write(b.Bytes())
+	default:
+		adminError(rw, http.StatusNotFound, fmt.Errorf("no admin call %s", r.URL.Path))
+	}
+}
+
+func adminReply(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func adminError(rw http.ResponseWriter, status int, err error) {
+	adminReply(rw, status, map[string]string{"error": err.Error(), "kind": string(walleterr.KindOf(err))})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	crypto "github.com/remote-signing/wallet_plugin/key"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+)
+
+// adminCall calls the admin socket at path and decodes a JSON reply into v.
+func adminCall(t *testing.T, path, token, method, call string, v interface{}) int {
+	t.Helper()
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+	req, _ := http.NewRequest(method, "http://wallet"+call, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if s, ok := v.(*string); ok {
+		*s = string(b)
+	} else if v != nil {
+		if err := json.Unmarshal(b, v); err != nil {
+			t.Fatalf("%s %s: %v: %s", method, call, err, b)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdminSocket(t *testing.T) {
+	priv, pub := crypto.GenerateKeyPair()
+	t.Setenv("WALLET_TEST_KEY_PASSWORD", "gochain@123")
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	iWallet, err := NewWallet(map[string]string{
+		"kms_type":      "keystore",
+		"keystore_path": writeKeyStore(t, priv, "gochain@123", "scrypt"),
+		"password_env":  "WALLET_TEST_KEY_PASSWORD",
+		"admin_socket":  path,
+		"admin_token":   "s3cret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { adminServers[path].close() })
+	w := iWallet.(*ReloadableWallet)
+
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("socket mode %v, %v", fi.Mode(), err)
+	}
+	var e map[string]string
+	if code := adminCall(t, path, "wrong", http.MethodGet, "/status", &e); code != http.StatusUnauthorized || e["kind"] != "ErrPermissionDenied" {
+		t.Fatalf("wrong token: %d %v", code, e)
+	}
+
+	digest := crypto.SHA3Sum256([]byte("admin"))
+	if _, err := w.Sign(digest); err != nil {
+		t.Fatal(err)
+	}
+	var status AdminStatus
+	if code := adminCall(t, path, "s3cret", http.MethodGet, "/status", &status); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if status.Backend != "keystore" || status.Address != NewAccountAddressFromPublicKey(pub).String() ||
+		!status.Health.Healthy || status.Paused || status.LastSign == nil {
+		t.Errorf("status %+v", status)
+	}
+
+	// A paused wallet refuses to sign until it is resumed.
+	if code := adminCall(t, path, "s3cret", http.MethodPost, "/pause", &status); code != http.StatusOK || !status.Paused {
+		t.Fatalf("pause %d %+v", code, status)
+	}
+	if _, err := w.Sign(digest); !errors.Is(err, walleterr.ErrSigningPaused) {
+		t.Fatalf("paused Sign returned %v", err)
+	}
+	// A refresh keeps the pause.
+	first := w.generation()
+	if code := adminCall(t, path, "s3cret", http.MethodPost, "/refresh", &status); code != http.StatusOK {
+		t.Fatalf("refresh %d", code)
+	}
+	if w.generation() == first {
+		t.Error("refresh did not reload the wallet")
+	}
+	if _, err := w.Sign(digest); !errors.Is(err, walleterr.ErrSigningPaused) {
+		t.Fatalf("Sign after a refresh returned %v", err)
+	}
+	adminCall(t, path, "s3cret", http.MethodPost, "/resume", &status)
+	if _, err := w.Sign(digest); err != nil {
+		t.Fatal(err)
+	}
+
+	var a Attestation
+	if code := adminCall(t, path, "s3cret", http.MethodPost, "/self-test", &a); code != http.StatusOK || !a.Passed {
+		t.Errorf("self-test %d %+v", code, a)
+	}
+	var metrics string
+	adminCall(t, path, "s3cret", http.MethodGet, "/metrics", &metrics)
+	if !strings.Contains(metrics, `wallet_sign_total{result="ErrSigningPaused"}`) {
+		t.Errorf("metrics lack the paused Sign calls:\n%s", metrics)
+	}
+	if code := adminCall(t, path, "s3cret", http.MethodGet, "/pause", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /pause returned %d", code)
+	}
+}
+
+func TestAdminSocketInUse(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "admin.sock")
+	s, fresh, err := listenAdmin(map[string]string{"admin_socket": path, "admin_socket_mode": "0660"})
+	if err != nil || !fresh {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0660 {
+		t.Errorf("socket mode %v, %v", fi.Mode(), err)
+	}
+	if again, fresh, err := listenAdmin(map[string]string{"admin_socket": path}); err != nil || fresh || again != s {
+		t.Errorf("listening again returned %v, %v", fresh, err)
+	}
+
+	// A socket of another process is not taken over, a stale one is.
+	other := filepath.Join(dir, "other.sock")
+	l, err := net.Listen("unix", other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := listenAdmin(map[string]string{"admin_socket": other}); !errors.Is(err, walleterr.ErrConfigInvalidParam) {
+		t.Errorf("socket in use: %v", err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	stale, _, err := listenAdmin(map[string]string{"admin_socket": other})
+	if err != nil {
+		t.Fatalf("stale socket: %v", err)
+	}
+	stale.close()
+
+	// Until the wallet is loaded the socket only reports that.
+	var e map[string]string
+	if code := adminCall(t, path, "", http.MethodGet, "/status", &e); code != http.StatusServiceUnavailable {
+		t.Errorf("status without a wallet %d %v", code, e)
+	}
+	s.close()
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("socket left after close: %v", err)
+	}
+}
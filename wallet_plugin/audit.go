@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"github.com/remote-signing/wallet_plugin/audit"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// auditor records every Sign call of a wallet in its audit log.
+type auditor struct {
+	log        *audit.Log
+	keyID      string
+	keyVersion string
+}
+
+var (
+	auditMu   sync.Mutex
+	auditLogs = make(map[string]*audit.Log)
+)
+
+// newAuditor opens the log named by the audit_log param, rotated once it
+// reaches audit_max_size bytes. It returns nil if audit_log is not set.
+// Wallets loaded with the same path share the log so its chain stays
+// linear.
+func newAuditor(params map[string]string) (*auditor, error) {
+	path := params["audit_log"]
+	if path == "" {
+		return nil, nil
+	}
+	var maxSize int64
+	if v := params["audit_max_size"]; v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, invalidParam("audit_max_size", fmt.Errorf("%q is not a positive number of bytes", v))
+		}
+		maxSize = n
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	l, ok := auditLogs[path]
+	if !ok {
+		var err error
+		l, err = audit.Open(path, maxSize)
+		if err != nil {
+			return nil, walleterr.Wrap(walleterr.ErrAuditLog, err, "open audit log "+path)
+		}
+		auditLogs[path] = l
+		seq, head := l.Head()
+		logger.Info("audit log opened", "path", path, "seq", seq, "head", head)
+	}
+
+	keyID, keyVersion := keyRef(params)
+	return &auditor{log: l, keyID: keyID, keyVersion: keyVersion}, nil
+}
+
+// keyRef returns how the backend named by kms_type identifies its key.
+func keyRef(params map[string]string) (id, version string) {
+	switch signerName(params["kms_type"]) {
+	case "aws":
+		return params["key_id"], ""
+	case "gcp":
+		return fmt.Sprintf("projects/%s/locations/%s/keyRings/%s/cryptoKeys/%s",
+			params["project_id"], params["location_id"], params["key_ring"], params["key"]), params["key_version"]
+	case "azure":
+		return params["vault_url"] + "/keys/" + params["key_name"], params["key_version"]
+	case "vault":
+		return params["vault_addr"] + "/" + params["key_name"], params["key_version"]
+	case "pkcs11":
+		if params["key_label"] != "" {
+			return params["key_label"], ""
+		}
+		return params["key_id"], ""
+	case "keystore":
+		return params["keystore_path"], ""
+	case "remote":
+		return params["remote_endpoint"] + "/" + params["expected_address"], ""
+	}
+	return "", ""
+}
+
+// record appends a Sign call that started at start to the audit log.
+func (a *auditor) record(backend string, digest, signature []byte, start time.Time, err error) error {
+	r := audit.Record{
+		Time:       start,
+		Digest:     digest,
+		Backend:    backend,
+		KeyID:      a.keyID,
+		KeyVersion: a.keyVersion,
+		Signature:  signature,
+		Latency:    time.Since(start),
+		Outcome:    resultLabel(err),
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if _, err := a.log.Append(r); err != nil {
+		return walleterr.Wrap(walleterr.ErrAuditLog, err, "write audit log")
+	}
+	return nil
+}
@@ -0,0 +1,394 @@
+// Package audit implements the tamper-evident audit log of the wallet plugin.
+//
+// Every signing request is appended to the log as one JSON line. The entries
+// form a hash chain: each holds the SHA3-256 hash of the previous one and its
+// own hash covers all of its fields, so editing, reordering or deleting an
+// entry breaks the chain at that point. When the log file grows beyond its
+// size limit it is renamed to PATH.SEQ, SEQ being the zero-padded sequence
+// number of its first entry, and the chain continues in a new file.
+//
+// The chain can not reveal entries removed from its end. Verify reports the
+// sequence number and hash of the head so they can be compared with a copy
+// kept elsewhere.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/remote-signing/wallet_plugin/sha3"
+)
+
+// GenesisHash is the previous hash of the first entry of a log.
+const GenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// DefaultMaxSize is the size at which a log file is rotated by default.
+const DefaultMaxSize = 64 << 20
+
+// maxLineSize bounds the length of an entry when reading a log.
+const maxLineSize = 1 << 20
+
+// Entry is one signing request. Byte values are hex encoded.
+type Entry struct {
+	Seq        uint64 `json:"seq"`
+	Time       string `json:"time"` // RFC 3339 with nanoseconds, UTC
+	Digest     string `json:"digest"`
+	Backend    string `json:"backend"`
+	KeyID      string `json:"key_id,omitempty"`
+	KeyVersion string `json:"key_version,omitempty"`
+	Signature  string `json:"signature,omitempty"`
+	LatencyUs  int64  `json:"latency_us"`
+	Outcome    string `json:"outcome"` // "success" or the kind of the error
+	Error      string `json:"error,omitempty"`
+	Prev       string `json:"prev"`
+	Hash       string `json:"hash"`
+}
+
+// Record is what the caller knows about a signing request.
+type Record struct {
+	Time       time.Time
+	Digest     []byte
+	Backend    string
+	KeyID      string
+	KeyVersion string
+	Signature  []byte
+	Latency    time.Duration
+	Outcome    string
+	Error      string
+}
+
+// hash returns the SHA3-256 hash of the entry with an empty Hash field.
+func (e Entry) hash() string {
+	e.Hash = ""
+	b, _ := json.Marshal(e)
+	sum := sha3.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Log appends entries to an audit log file. It is safe for concurrent use.
+// Only one Log may write a file at a time.
+type Log struct {
+	path    string
+	maxSize int64
+
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	firstSeq uint64 // of the current file, 0 while it is empty
+	seq      uint64
+	head     string
+}
+
+// Open opens the audit log at path, creating it if needed, and continues the
+// chain from its last entry, which may be in the last rotated file. It fails
+// if that entry can not be read, since appending to a damaged log would hide
+// the damage. maxSize of 0 means DefaultMaxSize.
+func Open(path string, maxSize int64) (*Log, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	l := &Log{path: path, maxSize: maxSize, head: GenesisHash}
+
+	files, err := Files(path)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		first, last, err := readEnds(files[i])
+		if err != nil {
+			return nil, err
+		}
+		if files[i] == path && first != nil {
+			l.firstSeq = first.Seq
+		}
+		if last != nil {
+			l.seq, l.head = last.Seq, last.Hash
+			break
+		}
+	}
+
+	l.f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	st, err := l.f.Stat()
+	if err != nil {
+		l.f.Close()
+		return nil, err
+	}
+	l.size = st.Size()
+	return l, nil
+}
+
+// readEnds returns the first and last entries of a log file, or nil if it
+// has none.
+func readEnds(file string) (first, last *Entry, err error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var lastLine []byte
+	n := 0
+	err = scanLines(f, func(line []byte) error {
+		n++
+		if first == nil {
+			e, err := parseEntry(line)
+			if err != nil {
+				return fmt.Errorf("audit log %s line %d: %v", file, n, err)
+			}
+			first = &e
+		}
+		lastLine = append(lastLine[:0], line...)
+		return nil
+	})
+	if err != nil || lastLine == nil {
+		return first, nil, err
+	}
+	e, err := parseEntry(lastLine)
+	if err != nil {
+		return nil, nil, fmt.Errorf("audit log %s line %d: %v", file, n, err)
+	}
+	return first, &e, nil
+}
+
+// Append adds an entry for r to the log and syncs it to disk.
+func (l *Log) Append(r Record) (Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e := Entry{
+		Seq:        l.seq + 1,
+		Time:       r.Time.UTC().Format(time.RFC3339Nano),
+		Digest:     hex.EncodeToString(r.Digest),
+		Backend:    r.Backend,
+		KeyID:      r.KeyID,
+		KeyVersion: r.KeyVersion,
+		Signature:  hex.EncodeToString(r.Signature),
+		LatencyUs:  r.Latency.Microseconds(),
+		Outcome:    r.Outcome,
+		Error:      r.Error,
+		Prev:       l.head,
+	}
+	e.Hash = e.hash()
+	line, err := json.Marshal(e)
+	if err != nil {
+		return Entry{}, err
+	}
+	line = append(line, '\n')
+
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return Entry{}, err
+		}
+	}
+	if _, err := l.f.Write(line); err != nil {
+		return Entry{}, err
+	}
+	if err := l.f.Sync(); err != nil {
+		return Entry{}, err
+	}
+	l.size += int64(len(line))
+	if l.firstSeq == 0 {
+		l.firstSeq = e.Seq
+	}
+	l.seq, l.head = e.Seq, e.Hash
+	return e, nil
+}
+
+// rotate renames the current file after its first entry and starts a new one.
+func (l *Log) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(l.path, rotatedName(l.path, l.firstSeq)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	l.f, l.size, l.firstSeq = f, 0, 0
+	return nil
+}
+
+// Head returns the sequence number and hash of the last entry.
+func (l *Log) Head() (uint64, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq, l.head
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+func rotatedName(path string, firstSeq uint64) string {
+	return fmt.Sprintf("%s.%020d", path, firstSeq)
+}
+
+// Files returns the files of the audit log at path in chain order: the
+// rotated files, then path itself if it exists.
+func Files(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, m := range matches {
+		suffix := strings.TrimPrefix(m, path+".")
+		if _, err := strconv.ParseUint(suffix, 10, 64); err == nil && len(suffix) == 20 {
+			files = append(files, m)
+		}
+	}
+	sort.Strings(files)
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Break is a place where the chain does not hold.
+type Break struct {
+	File   string
+	Line   int
+	Seq    uint64 // 0 if the entry could not be parsed
+	Reason string
+}
+
+func (b Break) String() string {
+	if b.Seq == 0 {
+		return fmt.Sprintf("%s:%d: %s", b.File, b.Line, b.Reason)
+	}
+	return fmt.Sprintf("%s:%d: seq %d: %s", b.File, b.Line, b.Seq, b.Reason)
+}
+
+// Report is the result of verifying an audit log.
+type Report struct {
+	Files   []string
+	Entries int
+	First   uint64 // sequence number of the first entry
+	Last    uint64 // sequence number of the head
+	Head    string // hash of the head
+	Breaks  []Break
+}
+
+// OK reports whether the whole chain holds.
+func (r Report) OK() bool {
+	return len(r.Breaks) == 0
+}
+
+// Verify walks the audit log at path, including its rotated files, and
+// reports every break of the chain.
+func Verify(path string) (Report, error) {
+	files, err := Files(path)
+	if err != nil {
+		return Report{}, err
+	}
+	if len(files) == 0 {
+		return Report{}, fmt.Errorf("no audit log at %s", path)
+	}
+	return VerifyFiles(files...)
+}
+
+// VerifyFiles verifies log files given in chain order.
+func VerifyFiles(files ...string) (Report, error) {
+	r := Report{Files: files, Head: GenesisHash}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return r, err
+		}
+		n := 0
+		err = scanLines(f, func(line []byte) error {
+			n++
+			r.check(file, n, line)
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// check verifies one line against the chain so far.
+func (r *Report) check(file string, n int, line []byte) {
+	e, err := parseEntry(line)
+	if err != nil {
+		r.Breaks = append(r.Breaks, Break{File: file, Line: n, Reason: err.Error()})
+		return
+	}
+
+	broken := func(reason string, args ...interface{}) {
+		r.Breaks = append(r.Breaks, Break{File: file, Line: n, Seq: e.Seq, Reason: fmt.Sprintf(reason, args...)})
+	}
+	if h := e.hash(); h != e.Hash {
+		broken("entry was modified, its hash is %s", h)
+	}
+	switch {
+	case r.Entries == 0 && e.Seq != 1:
+		broken("chain starts at seq %d, earlier entries are missing", e.Seq)
+	case r.Entries == 0 && e.Prev != GenesisHash:
+		broken("first entry does not link to the genesis hash")
+	case r.Entries > 0 && e.Seq != r.Last+1:
+		broken("expected seq %d, entries are missing or reordered", r.Last+1)
+	case r.Entries > 0 && e.Prev != r.Head:
+		broken("previous hash does not match entry %d", r.Last)
+	}
+
+	if r.Entries == 0 {
+		r.First = e.Seq
+	}
+	r.Entries++
+	r.Last, r.Head = e.Seq, e.Hash
+}
+
+// parseEntry parses a log line and checks that it is exactly how Append
+// writes the entry, so no field can be added, removed or reformatted.
+func parseEntry(line []byte) (Entry, error) {
+	var e Entry
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&e); err != nil {
+		return Entry{}, fmt.Errorf("malformed entry: %v", err)
+	}
+	canonical, _ := json.Marshal(e)
+	if !bytes.Equal(canonical, line) {
+		return Entry{}, fmt.Errorf("entry is not in canonical form")
+	}
+	return e, nil
+}
+
+// scanLines calls fn for every line of r. A last line without a newline,
+// left by an interrupted write, is passed to fn as well.
+func scanLines(r io.Reader, fn func(line []byte) error) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), maxLineSize)
+	for s.Scan() {
+		if err := fn(s.Bytes()); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
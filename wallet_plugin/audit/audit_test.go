@@ -0,0 +1,190 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func appendN(t *testing.T, l *Log, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, err := l.Append(Record{
+			Time:      time.Now(),
+			Digest:    bytes.Repeat([]byte{byte(i)}, 32),
+			Backend:   "aws",
+			KeyID:     "mrk-1234",
+			Signature: bytes.Repeat([]byte{0xab}, 65),
+			Latency:   12 * time.Millisecond,
+			Outcome:   "success",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAppendVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, l, 3)
+	l.Close()
+
+	// A reopened log continues the chain.
+	l, err = Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, l, 2)
+	seq, head := l.Head()
+	l.Close()
+
+	r, err := Verify(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.OK() || r.Entries != 5 || r.First != 1 || r.Last != 5 || seq != 5 || r.Head != head {
+		t.Errorf("report %+v, head %d %s", r, seq, head)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(path, 1000) // about three entries per file
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, l, 10)
+	l.Close()
+
+	files, err := Files(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 3 || files[0] != path+".00000000000000000001" || files[len(files)-1] != path {
+		t.Fatalf("files %v", files)
+	}
+	r, err := Verify(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.OK() || r.Entries != 10 {
+		t.Errorf("report %+v", r)
+	}
+
+	// The chain continues after a restart right after a rotation.
+	if err := os.Rename(path, path+".00000000000000000099"); err != nil {
+		t.Fatal(err)
+	}
+	l, err = Open(path, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := l.Append(Record{Time: time.Now(), Outcome: "success"})
+	l.Close()
+	if err != nil || e.Seq != 11 || e.Prev != r.Head {
+		t.Errorf("entry %+v after a rotation, %v", e, err)
+	}
+
+	// A missing rotated file is a break.
+	if err := os.Remove(files[1]); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := Verify(path); r.OK() {
+		t.Error("no break after removing a rotated file")
+	}
+}
+
+func TestTamper(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(lines []string) []string
+		reason string
+	}{{
+		name: "edited digest",
+		tamper: func(lines []string) []string {
+			lines[2] = strings.Replace(lines[2], `"digest":"02`, `"digest":"03`, 1)
+			return lines
+		},
+		reason: "entry was modified",
+	}, {
+		name: "deleted entry",
+		tamper: func(lines []string) []string {
+			return append(lines[:2], lines[3:]...)
+		},
+		reason: "expected seq 3",
+	}, {
+		name: "swapped entries",
+		tamper: func(lines []string) []string {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		},
+		reason: "expected seq 2",
+	}, {
+		name: "rehashed edit",
+		tamper: func(lines []string) []string {
+			e, _ := parseEntry([]byte(lines[2]))
+			e.Outcome = "ErrPermissionDenied"
+			e.Hash = e.hash()
+			b, _ := json.Marshal(e)
+			lines[2] = string(b)
+			return lines
+		},
+		reason: "previous hash does not match entry 3",
+	}, {
+		name: "added field",
+		tamper: func(lines []string) []string {
+			lines[0] = strings.Replace(lines[0], `{"seq"`, `{"note":"x","seq"`, 1)
+			return lines
+		},
+		reason: "malformed entry",
+	}, {
+		name: "dropped first entry",
+		tamper: func(lines []string) []string {
+			return lines[1:]
+		},
+		reason: "chain starts at seq 2",
+	}}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "audit.log")
+		l, err := Open(path, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		appendN(t, l, 5)
+		l.Close()
+
+		b, _ := os.ReadFile(path)
+		lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+		lines = test.tamper(lines)
+		if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := Verify(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.OK() || !strings.Contains(r.Breaks[0].String(), test.reason) {
+			t.Errorf("%s: breaks %v, want %q", test.name, r.Breaks, test.reason)
+		}
+	}
+}
+
+func TestOpenDamaged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(path, []byte(`{"seq":1,"time":`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, 0); err == nil {
+		t.Error("Open appends to a damaged log")
+	}
+}
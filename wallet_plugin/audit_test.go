@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/remote-signing/wallet_plugin/audit"
+	crypto "github.com/remote-signing/wallet_plugin/key"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readAuditLog(t *testing.T, path string) []audit.Entry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []audit.Entry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e audit.Entry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestWalletAudit(t *testing.T) {
+	priv, _ := crypto.GenerateKeyPair()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	t.Setenv("WALLET_TEST_KEY_PASSWORD", "gochain@123")
+	keystorePath := writeKeyStore(t, priv, "gochain@123", "pbkdf2")
+	iWallet, err := NewWallet(map[string]string{
+		"kms_type":      "keystore",
+		"keystore_path": keystorePath,
+		"password_env":  "WALLET_TEST_KEY_PASSWORD",
+		"audit_log":     path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := iWallet.(Wallet)
+
+	signData, _ := hex.DecodeString("356355dae4212533ce182cbb31492a6c2665fcf8f17e089d929e7a3efd1d1ba1")
+	signature, err := w.Sign(signData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Sign(signData[:31]); !errors.Is(err, walleterr.ErrDigestLength) {
+		t.Fatalf("got %v for a short digest", err)
+	}
+
+	entries := readAuditLog(t, path)
+	if len(entries) != 2 {
+		t.Fatalf("%d audit entries", len(entries))
+	}
+	e := entries[0]
+	if e.Digest != hex.EncodeToString(signData) || e.Signature != hex.EncodeToString(signature) ||
+		e.Backend != "keystore" || e.KeyID != keystorePath || e.Outcome != "success" || e.Time == "" {
+		t.Errorf("entry %+v", e)
+	}
+	if e := entries[1]; e.Outcome != string(walleterr.ErrDigestLength) || e.Signature != "" || e.Error == "" {
+		t.Errorf("entry %+v", e)
+	}
+	if r, err := audit.Verify(path); err != nil || !r.OK() || r.Entries != 2 {
+		t.Errorf("Verify = %+v, %v", r, err)
+	}
+
+	// No signature leaves the wallet unrecorded.
+	w.audit.log.Close()
+	if signature, err := w.Sign(signData); !errors.Is(err, walleterr.ErrAuditLog) || signature != nil {
+		t.Errorf("Sign with a closed audit log returned %x, %v", signature, err)
+	}
+
+	if _, err := newAuditor(map[string]string{"audit_log": path, "audit_max_size": "-1"}); !errors.Is(err, walleterr.ErrConfigInvalidParam) {
+		t.Errorf("newAuditor with a negative size returned %v", err)
+	}
+}
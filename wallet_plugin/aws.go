@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+	crypto "github.com/remote-signing/wallet_plugin/key"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+)
+
+const awsKmsSignOperationMessageType = "DIGEST"
+const awsKmsSignOperationSigningAlgorithm = "ECDSA_SHA_256"
+
+func init() {
+	RegisterSigner("aws", newAwsSigner, AWS)
+}
+
+type asn1EcPublicKeyInfo struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.ObjectIdentifier
+}
+
+type asn1EcPublicKey struct {
+	EcPublicKeyInfo asn1EcPublicKeyInfo
+	PublicKey       asn1.BitString
+}
+
+type asn1EcSig struct {
+	R asn1.RawValue
+	S asn1.RawValue
+}
+
+// awsSigner signs with an ECC_SECG_P256K1 key held in AWS KMS.
+type awsSigner struct {
+	pkey  *crypto.PublicKey
+	svc   *kms.Client
+	keyId string
+}
+
+func newAwsSigner(params map[string]string) (Signer, error) {
+	if err := requireParams(params, "key_id"); err != nil {
+		return nil, err
+	}
+	keyId := params["key_id"]
+
+	awsCfg, err := awsConfig(context.Background(), params)
+	if err != nil {
+		return nil, err
+	}
+
+	kmsSvc := kms.NewFromConfig(awsCfg, func(o *kms.Options) {
+		if endpoint := params["endpoint_url"]; endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+	pubkeyFromAws, err := GetPubKeyCtx(context.Background(), kmsSvc, keyId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &awsSigner{
+		svc:   kmsSvc,
+		pkey:  pubkeyFromAws,
+		keyId: keyId,
+	}, nil
+}
+
+// awsConfig builds the AWS configuration from the plugin parameters. Unless
+// static keys are given, credentials come from the default chain: environment,
+// shared config profile, EKS web identity (IRSA), ECS task role and EC2
+// instance profile. With role_arn those credentials are only used to assume
+// the given role.
+func awsConfig(ctx context.Context, params map[string]string) (aws.Config, error) {
+	var opts []func(*config.LoadOptions) error
+	if region := params["region"]; region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	if profile := params["profile"]; profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(profile))
+	}
+
+	accessKeyId := params["access_key_id"]
+	secretAccessKey := params["secret_access_key"]
+	if len(accessKeyId)*len(secretAccessKey) != 0 {
+		opts = append(opts, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(accessKeyId, secretAccessKey, params["session_token"])))
+	} else if len(accessKeyId)+len(secretAccessKey) != 0 {
+		str := "invalid inputs: access_key_id and secret_access_key must be given together"
+		return aws.Config{}, walleterr.New(walleterr.ErrConfigMissingParam, str)
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, invalidParam("AWS shared config", err)
+	}
+	if awsCfg.Region == "" {
+		str := "invalid inputs: missing region"
+		return aws.Config{}, walleterr.New(walleterr.ErrConfigMissingParam, str)
+	}
+
+	if roleArn := params["role_arn"]; roleArn != "" {
+		stsSvc := sts.NewFromConfig(awsCfg, func(o *sts.Options) {
+			if endpoint := params["sts_endpoint_url"]; endpoint != "" {
+				o.BaseEndpoint = aws.String(endpoint)
+			}
+		})
+		provider := stscreds.NewAssumeRoleProvider(stsSvc, roleArn, func(o *stscreds.AssumeRoleOptions) {
+			if externalId := params["external_id"]; externalId != "" {
+				o.ExternalID = aws.String(externalId)
+			}
+			o.RoleSessionName = "remote-signing"
+			if sessionName := params["session_name"]; sessionName != "" {
+				o.RoleSessionName = sessionName
+			}
+		})
+		awsCfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+
+	return awsCfg, nil
+}
+
+func (s *awsSigner) PublicKey() *crypto.PublicKey {
+	return s.pkey
+}
+
+func (s *awsSigner) SignDigest(ctx context.Context, digest []byte) ([]byte, []byte, error) {
+	return getSignatureFromKms(ctx, s.svc, s.keyId, digest)
+}
+
+// DescribeKey reports the metadata AWS KMS keeps on the key. Keys of the
+// AWS_KMS and AWS_CLOUDHSM origins never leave FIPS validated HSMs, keys of an
+// external key store are held outside of AWS.
+func (s *awsSigner) DescribeKey(ctx context.Context) (KeyDescription, error) {
+	out, err := s.svc.DescribeKey(ctx, &kms.DescribeKeyInput{KeyId: aws.String(s.keyId)})
+	if err != nil {
+		return KeyDescription{}, awsError(err, "AWS KMS DescribeKey")
+	}
+	md := out.KeyMetadata
+	desc := KeyDescription{
+		KeyID:           aws.ToString(md.Arn),
+		KeySpec:         string(md.KeySpec),
+		KeyUsage:        string(md.KeyUsage),
+		KeyState:        string(md.KeyState),
+		ProtectionLevel: "HSM",
+		Origin:          string(md.Origin),
+	}
+	if md.Origin == types.OriginTypeExternalKeyStore {
+		desc.ProtectionLevel = "EXTERNAL"
+	}
+
+	if md.KeySpec != types.KeySpecEccSecgP256k1 || md.KeyUsage != types.KeyUsageTypeSignVerify {
+		str := fmt.Sprintf("AWS KMS key %s is %s/%s instead of %s/%s", s.keyId,
+			md.KeySpec, md.KeyUsage, types.KeySpecEccSecgP256k1, types.KeyUsageTypeSignVerify)
+		return desc, walleterr.New(walleterr.ErrKeyAlgorithmMismatch, str)
+	}
+	if md.KeyState != types.KeyStateEnabled {
+		str := fmt.Sprintf("AWS KMS key %s is %s", s.keyId, md.KeyState)
+		return desc, walleterr.New(walleterr.ErrKeyStateInvalid, str)
+	}
+	return desc, nil
+}
+
+func getSignatureFromKms(
+	ctx context.Context, svc *kms.Client, keyId string, txHashBytes []byte,
+) ([]byte, []byte, error) {
+	signInput := &kms.SignInput{
+		KeyId:            aws.String(keyId),
+		SigningAlgorithm: awsKmsSignOperationSigningAlgorithm,
+		MessageType:      awsKmsSignOperationMessageType,
+		Message:          txHashBytes,
+	}
+
+	// Retries are left to the wallet so they stay within its signing deadline.
+	signOutput, err := svc.Sign(ctx, signInput, func(o *kms.Options) {
+		o.RetryMaxAttempts = 1
+	})
+	if err != nil {
+		return nil, nil, awsError(err, "AWS KMS Sign")
+	}
+
+	return parseDerSignature(signOutput.Signature)
+}
+
+// parseDerSignature splits an ASN.1 DER encoded ECDSA signature into its r
+// and s values.
+func parseDerSignature(der []byte) ([]byte, []byte, error) {
+	var sigAsn1 asn1EcSig
+	_, err := asn1.Unmarshal(der, &sigAsn1)
+	if err != nil {
+		return nil, nil, walleterr.Wrap(walleterr.ErrSignatureMalformed, err, "DER signature")
+	}
+
+	return sigAsn1.R.Bytes, sigAsn1.S.Bytes, nil
+}
+
+func GetPubKeyCtx(ctx context.Context, svc *kms.Client, keyId string) (*crypto.PublicKey, error) {
+	pubKeyBytes, err := getPublicKeyDerBytesFromKMS(ctx, svc, keyId)
+	if err != nil {
+		return nil, err
+	}
+
+	pubkey, err := crypto.ParsePublicKey(pubKeyBytes)
+	if err != nil {
+		return nil, walleterr.Wrap(walleterr.ErrKeyAlgorithmMismatch, err, "AWS KMS public key")
+	}
+	return pubkey, nil
+}
+
+func getPublicKeyDerBytesFromKMS(ctx context.Context, svc *kms.Client, keyId string) ([]byte, error) {
+	getPubKeyOutput, err := svc.GetPublicKey(ctx, &kms.GetPublicKeyInput{
+		KeyId: aws.String(keyId),
+	})
+	if err != nil {
+		return nil, awsError(err, "AWS KMS GetPublicKey")
+	}
+	if getPubKeyOutput.KeySpec != types.KeySpecEccSecgP256k1 || getPubKeyOutput.KeyUsage != types.KeyUsageTypeSignVerify {
+		str := fmt.Sprintf("AWS KMS key %s is %s/%s instead of %s/%s", keyId,
+			getPubKeyOutput.KeySpec, getPubKeyOutput.KeyUsage, types.KeySpecEccSecgP256k1, types.KeyUsageTypeSignVerify)
+		return nil, walleterr.New(walleterr.ErrKeyAlgorithmMismatch, str)
+	}
+
+	var asn1pubk asn1EcPublicKey
+	_, err = asn1.Unmarshal(getPubKeyOutput.PublicKey, &asn1pubk)
+	if err != nil {
+		return nil, walleterr.Wrap(walleterr.ErrKeyAlgorithmMismatch, err, "AWS KMS public key")
+	}
+
+	return asn1pubk.PublicKey.Bytes, nil
+}
+
+// awsError wraps an error of the AWS SDK into the matching kind.
+func awsError(err error, desc string) error {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		// Network errors, timeouts and credential lookups.
+		return walleterr.Wrap(walleterr.ErrBackendUnavailable, err, desc)
+	}
+
+	switch apiErr.ErrorCode() {
+	case "ThrottlingException", "LimitExceededException":
+		return walleterr.Wrap(walleterr.ErrBackendThrottled, err, desc)
+	case "AccessDeniedException", "UnrecognizedClientException", "InvalidSignatureException",
+		"ExpiredTokenException", "IncompleteSignature", "MissingAuthenticationToken":
+		return walleterr.Wrap(walleterr.ErrPermissionDenied, err, desc)
+	case "NotFoundException":
+		return walleterr.Wrap(walleterr.ErrKeyNotFound, err, desc)
+	case "DisabledException", "KMSInvalidStateException":
+		return walleterr.Wrap(walleterr.ErrKeyStateInvalid, err, desc)
+	case "InvalidKeyUsageException", "UnsupportedOperationException":
+		return walleterr.Wrap(walleterr.ErrKeyAlgorithmMismatch, err, desc)
+	case "ValidationException", "InvalidArnException", "InvalidGrantTokenException":
+		return walleterr.Wrap(walleterr.ErrConfigInvalidParam, err, desc)
+	}
+	// KMSInternalException, DependencyTimeoutException, KeyUnavailableException
+	// and any other server side fault.
+	return walleterr.Wrap(walleterr.ErrBackendUnavailable, err, desc)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/smithy-go"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func fakeDerPublicKey(t *testing.T, signer *fakeSigner) []byte {
+	t.Helper()
+	spki, err := asn1.Marshal(struct {
+		AlgID pkix.AlgorithmIdentifier
+		Key   asn1.BitString
+	}{
+		AlgID: pkix.AlgorithmIdentifier{
+			Algorithm:  asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1},
+			Parameters: asn1.RawValue{FullBytes: secp256k1Oid},
+		},
+		Key: asn1.BitString{Bytes: signer.PublicKey().SerializeUncompressed(), BitLength: 65 * 8},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spki
+}
+
+// fakeAwsKms serves the GetPublicKey, DescribeKey and Sign actions of the
+// AWS KMS JSON API backed by a fakeSigner.
+type fakeAwsKms struct {
+	signer      *fakeSigner
+	spki        []byte
+	accessKeyId string            // expected signing key, empty accepts any
+	keySpec     string            // KeySpec reported by GetPublicKey, empty for ECC_SECG_P256K1
+	keyState    string            // KeyState reported by DescribeKey, empty for Enabled
+	failures    map[string]string // error type returned per action
+
+	mu     sync.Mutex
+	calls  map[string]int
+	faults []kmsFault // injected into the next Sign calls, one each
+}
+
+func newFakeAwsKms(t *testing.T, signer *fakeSigner) (*fakeAwsKms, *httptest.Server) {
+	t.Helper()
+	f := &fakeAwsKms{signer: signer, spki: fakeDerPublicKey(t, signer), calls: make(map[string]int)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeAwsKms) count(action string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[action]
+}
+
+func (f *fakeAwsKms) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	action := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "TrentService.")
+	f.mu.Lock()
+	f.calls[action]++
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	if f.accessKeyId != "" && !strings.Contains(r.Header.Get("Authorization"), "Credential="+f.accessKeyId+"/") {
+		writeAwsError(w, http.StatusBadRequest, "AccessDeniedException", "wrong credentials")
+		return
+	}
+
+	if errType, ok := f.failures[action]; ok {
+		writeAwsError(w, http.StatusBadRequest, errType, "injected failure")
+		return
+	}
+
+	var req struct {
+		KeyId   string
+		Message []byte
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAwsError(w, http.StatusBadRequest, "ValidationException", err.Error())
+		return
+	}
+
+	switch action {
+	case "GetPublicKey":
+		keySpec := f.keySpec
+		if keySpec == "" {
+			keySpec = "ECC_SECG_P256K1"
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"KeyId":             req.KeyId,
+			"PublicKey":         f.spki,
+			"KeySpec":           keySpec,
+			"KeyUsage":          "SIGN_VERIFY",
+			"SigningAlgorithms": []string{awsKmsSignOperationSigningAlgorithm},
+		})
+	case "DescribeKey":
+		keyState := f.keyState
+		if keyState == "" {
+			keyState = "Enabled"
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"KeyMetadata": map[string]interface{}{
+			"KeyId":    req.KeyId,
+			"Arn":      "arn:aws:kms:ap-southeast-1:111122223333:key/" + req.KeyId,
+			"KeySpec":  "ECC_SECG_P256K1",
+			"KeyUsage": "SIGN_VERIFY",
+			"KeyState": keyState,
+			"Enabled":  keyState == "Enabled",
+			"Origin":   "AWS_KMS",
+		}})
+	case "Sign":
+		f.mu.Lock()
+		var fault kmsFault
+		if len(f.faults) > 0 {
+			fault, f.faults = f.faults[0], f.faults[1:]
+		}
+		f.mu.Unlock()
+		if fault.inject(r.Context()) != nil {
+			return
+		}
+		if fault.code != "" {
+			writeAwsError(w, http.StatusBadRequest, fault.code, "injected fault")
+			return
+		}
+		rb, sb, _ := f.signer.SignDigest(r.Context(), req.Message)
+		der, _ := asn1.Marshal(struct{ R, S *big.Int }{new(big.Int).SetBytes(rb), new(big.Int).SetBytes(sb)})
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"KeyId":            req.KeyId,
+			"Signature":        der,
+			"SigningAlgorithm": awsKmsSignOperationSigningAlgorithm,
+		})
+	default:
+		writeAwsError(w, http.StatusBadRequest, "UnknownOperationException", action)
+	}
+}
+
+func writeAwsError(w http.ResponseWriter, status int, errType, message string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"__type": errType, "message": message})
+}
+
+// newFakeSts answers AssumeRole with fixed temporary credentials.
+func newFakeSts(t *testing.T, accessKeyId string) (*httptest.Server, *http.Request) {
+	t.Helper()
+	var last http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		last = *r
+		if r.Form.Get("Action") != "AssumeRole" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprintf(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>%s</AccessKeyId>
+      <SecretAccessKey>assumed-secret</SecretAccessKey>
+      <SessionToken>assumed-token</SessionToken>
+      <Expiration>2099-01-01T00:00:00Z</Expiration>
+    </Credentials>
+    <AssumedRoleUser>
+      <Arn>arn:aws:sts::123456789012:assumed-role/validator/remote-signing</Arn>
+      <AssumedRoleId>AROAFAKE:remote-signing</AssumedRoleId>
+    </AssumedRoleUser>
+  </AssumeRoleResult>
+  <ResponseMetadata><RequestId>fake</RequestId></ResponseMetadata>
+</AssumeRoleResponse>`, accessKeyId)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &last
+}
+
+// isolateAwsEnv keeps the default credential chain from picking up anything
+// from the machine running the tests.
+func isolateAwsEnv(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN",
+		"AWS_PROFILE", "AWS_REGION", "AWS_DEFAULT_REGION", "AWS_ROLE_ARN", "AWS_WEB_IDENTITY_TOKEN_FILE",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI"} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+}
+
+func TestAwsKms(t *testing.T) {
+	isolateAwsEnv(t)
+	signer := newFakeSigner(t)
+	signer.highS = true
+	fake, srv := newFakeAwsKms(t, signer)
+	fake.accessKeyId = "AKIASTATIC"
+
+	iWallet, err := NewWallet(map[string]string{
+		"kms_type":          AWS,
+		"region":            "ap-southeast-1",
+		"access_key_id":     "AKIASTATIC",
+		"secret_access_key": "secret",
+		"key_id":            "f8464e92-7e46-84f2-29af-ea47dff78ef7",
+		"endpoint_url":      srv.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	walletInst := iWallet.(walletImpl)
+
+	signData, _ := hex.DecodeString("356355dae4212533ce182cbb31492a6c2665fcf8f17e089d929e7a3efd1d1ba1")
+	signature, err := walletInst.Sign(signData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyRecoverable(t, signData, signature, signer.PublicKey().SerializeCompressed())
+}
+
+func TestAwsCredentialChain(t *testing.T) {
+	isolateAwsEnv(t)
+	signer := newFakeSigner(t)
+	fake, srv := newFakeAwsKms(t, signer)
+
+	t.Run("environment", func(t *testing.T) {
+		t.Setenv("AWS_ACCESS_KEY_ID", "AKIAENV")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+		t.Setenv("AWS_REGION", "ap-southeast-1")
+		fake.accessKeyId = "AKIAENV"
+
+		_, err := NewWallet(map[string]string{
+			"kms_type":     "aws",
+			"key_id":       "key",
+			"endpoint_url": srv.URL,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("assume_role", func(t *testing.T) {
+		stsSrv, stsReq := newFakeSts(t, "ASIAASSUMED")
+		fake.accessKeyId = "ASIAASSUMED"
+
+		_, err := NewWallet(map[string]string{
+			"kms_type":          "aws",
+			"region":            "ap-southeast-1",
+			"access_key_id":     "AKIASOURCE",
+			"secret_access_key": "secret",
+			"key_id":            "key",
+			"endpoint_url":      srv.URL,
+			"role_arn":          "arn:aws:iam::123456789012:role/validator",
+			"external_id":       "ext-1234",
+			"session_name":      "node-1",
+			"sts_endpoint_url":  stsSrv.URL,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := stsReq.Form.Get("ExternalId"); got != "ext-1234" {
+			t.Errorf("ExternalId %q", got)
+		}
+		if got := stsReq.Form.Get("RoleSessionName"); got != "node-1" {
+			t.Errorf("RoleSessionName %q", got)
+		}
+		if got := stsReq.Form.Get("RoleArn"); got != "arn:aws:iam::123456789012:role/validator" {
+			t.Errorf("RoleArn %q", got)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for name, params := range map[string]map[string]string{
+			"half static keys": {"region": "ap-southeast-1", "access_key_id": "AKIA"},
+			"no region":        {},
+			"no key id":        {"region": "ap-southeast-1", "key_id": ""},
+		} {
+			params["kms_type"] = "aws"
+			if _, ok := params["key_id"]; !ok {
+				params["key_id"] = "key"
+			}
+			params["endpoint_url"] = srv.URL
+			if _, err := NewWallet(params); err == nil {
+				t.Errorf("%s: NewWallet succeeded", name)
+			}
+		}
+	})
+}
+
+func TestAwsKmsErrors(t *testing.T) {
+	isolateAwsEnv(t)
+	signer := newFakeSigner(t)
+	fake, srv := newFakeAwsKms(t, signer)
+	params := map[string]string{
+		"kms_type":          AWS,
+		"region":            "ap-southeast-1",
+		"access_key_id":     "AKIASTATIC",
+		"secret_access_key": "secret",
+		"key_id":            "key",
+		"endpoint_url":      srv.URL,
+	}
+
+	for name, tc := range map[string]struct {
+		failures map[string]string
+		keySpec  string
+		kind     walleterr.ErrorKind
+	}{
+		"access denied": {failures: map[string]string{"GetPublicKey": "AccessDeniedException"}, kind: walleterr.ErrPermissionDenied},
+		"not found":     {failures: map[string]string{"GetPublicKey": "NotFoundException"}, kind: walleterr.ErrKeyNotFound},
+		"disabled":      {failures: map[string]string{"GetPublicKey": "DisabledException"}, kind: walleterr.ErrKeyStateInvalid},
+		"wrong spec":    {keySpec: "ECC_NIST_P256", kind: walleterr.ErrKeyAlgorithmMismatch},
+	} {
+		fake.failures, fake.keySpec = tc.failures, tc.keySpec
+		_, err := NewWallet(params)
+		if !errors.Is(err, tc.kind) {
+			t.Errorf("%s: NewWallet returned %v, want %v", name, err, tc.kind)
+		}
+		var apiErr smithy.APIError
+		if tc.failures != nil && !errors.As(err, &apiErr) {
+			t.Errorf("%s: SDK error not reachable from %v", name, err)
+		}
+	}
+
+	fake.failures, fake.keySpec = nil, ""
+	iWallet, err := NewWallet(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.failures = map[string]string{"Sign": "KMSInvalidStateException"}
+	signData, _ := hex.DecodeString("356355dae4212533ce182cbb31492a6c2665fcf8f17e089d929e7a3efd1d1ba1")
+	if _, err := iWallet.(walletImpl).Sign(signData); !errors.Is(err, walleterr.ErrKeyStateInvalid) {
+		t.Errorf("Sign returned %v", err)
+	}
+}
+
+func TestAwsErrorKinds(t *testing.T) {
+	for code, kind := range map[string]walleterr.ErrorKind{
+		"ThrottlingException":        walleterr.ErrBackendThrottled,
+		"LimitExceededException":     walleterr.ErrBackendThrottled,
+		"ExpiredTokenException":      walleterr.ErrPermissionDenied,
+		"InvalidKeyUsageException":   walleterr.ErrKeyAlgorithmMismatch,
+		"KMSInternalException":       walleterr.ErrBackendUnavailable,
+		"DependencyTimeoutException": walleterr.ErrBackendUnavailable,
+	} {
+		err := awsError(&smithy.GenericAPIError{Code: code}, "AWS KMS Sign")
+		if !errors.Is(err, kind) {
+			t.Errorf("%s: got %v, want %v", code, walleterr.KindOf(err), kind)
+		}
+	}
+	if err := awsError(io.ErrUnexpectedEOF, "AWS KMS Sign"); !errors.Is(err, walleterr.ErrBackendUnavailable) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("transport error: got %v", err)
+	}
+}
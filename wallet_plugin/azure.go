@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	crypto "github.com/remote-signing/wallet_plugin/key"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	azureKeyVaultApiVersion   = "7.4"
+	azureSignAlgorithm        = "ES256K"
+	azureDefaultAuthorityHost = "https://login.microsoftonline.com"
+	azureDefaultMsiEndpoint   = "http://169.254.169.254/metadata/identity/oauth2/token"
+)
+
+func init() {
+	RegisterSigner("azure", newAzureSigner)
+}
+
+// azureSigner signs with a P-256K key held in Azure Key Vault or Managed HSM
+// through the Key Vault REST API.
+type azureSigner struct {
+	keyURL string
+	pkey   *crypto.PublicKey
+	client *http.Client
+	cred   *azureCredential
+}
+
+// azureCredential fetches and caches an OAuth2 access token, either with the
+// client credentials flow or from the managed identity endpoint.
+type azureCredential struct {
+	client        *http.Client
+	resource      string
+	tenantId      string
+	clientId      string
+	clientSecret  string
+	authorityHost string
+	msiEndpoint   string
+	useMsi        bool
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+type azureJsonWebKey struct {
+	Kid    string   `json:"kid"`
+	Kty    string   `json:"kty"`
+	Crv    string   `json:"crv"`
+	X      string   `json:"x"`
+	Y      string   `json:"y"`
+	KeyOps []string `json:"key_ops,omitempty"`
+}
+
+type azureKeyAttributes struct {
+	Enabled *bool `json:"enabled,omitempty"`
+}
+
+type azureKeyBundle struct {
+	Key        azureJsonWebKey     `json:"key"`
+	Attributes *azureKeyAttributes `json:"attributes,omitempty"`
+}
+
+type azureSignRequest struct {
+	Alg   string `json:"alg"`
+	Value string `json:"value"`
+}
+
+type azureSignResult struct {
+	Kid   string `json:"kid"`
+	Value string `json:"value"`
+}
+
+type azureErrorResponse struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type azureTokenResponse struct {
+	AccessToken string          `json:"access_token"`
+	ExpiresIn   json.RawMessage `json:"expires_in"`
+}
+
+func newAzureSigner(params map[string]string) (Signer, error) {
+	if err := requireParams(params, "vault_url", "key_name"); err != nil {
+		return nil, err
+	}
+	vaultURL := strings.TrimRight(params["vault_url"], "/")
+	keyName := params["key_name"]
+	keyVersion := params["key_version"]
+
+	vault, err := url.Parse(vaultURL)
+	if err != nil {
+		return nil, invalidParam("vault_url", err)
+	}
+
+	cred := &azureCredential{
+		client:        http.DefaultClient,
+		resource:      "https://vault.azure.net",
+		tenantId:      params["tenant_id"],
+		clientId:      params["client_id"],
+		clientSecret:  params["client_secret"],
+		authorityHost: strings.TrimRight(params["authority_host"], "/"),
+		msiEndpoint:   params["msi_endpoint"],
+		useMsi:        params["use_managed_identity"] == "true",
+	}
+	if strings.HasSuffix(vault.Host, ".managedhsm.azure.net") {
+		cred.resource = "https://managedhsm.azure.net"
+	}
+	if cred.authorityHost == "" {
+		cred.authorityHost = azureDefaultAuthorityHost
+	}
+	if cred.msiEndpoint == "" {
+		cred.msiEndpoint = azureDefaultMsiEndpoint
+	}
+	if !cred.useMsi {
+		if err := requireParams(params, "tenant_id", "client_id", "client_secret"); err != nil {
+			return nil, err
+		}
+	}
+
+	keyURL := vaultURL + "/keys/" + url.PathEscape(keyName)
+	if keyVersion != "" {
+		keyURL += "/" + url.PathEscape(keyVersion)
+	}
+
+	s := &azureSigner{
+		keyURL: keyURL,
+		client: http.DefaultClient,
+		cred:   cred,
+	}
+
+	var bundle azureKeyBundle
+	if err := s.do(context.Background(), http.MethodGet, s.keyURL, nil, &bundle); err != nil {
+		return nil, err
+	}
+	s.pkey, err = parseAzureJsonWebKey(&bundle.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without key_version the current version is pinned, so a rotation of
+	// the key does not change the key the wallet signs with.
+	if keyVersion == "" {
+		var version string
+		prefix := "/keys/" + keyName + "/"
+		if i := strings.LastIndex(bundle.Key.Kid, prefix); i >= 0 {
+			version = bundle.Key.Kid[i+len(prefix):]
+		}
+		if version == "" || strings.Contains(version, "/") {
+			str := fmt.Sprintf("azure key id %q has no version", bundle.Key.Kid)
+			return nil, walleterr.New(walleterr.ErrKeyNotFound, str)
+		}
+		s.keyURL += "/" + url.PathEscape(version)
+	}
+
+	return s, nil
+}
+
+func parseAzureJsonWebKey(jwk *azureJsonWebKey) (*crypto.PublicKey, error) {
+	if jwk.Kty != "EC" && jwk.Kty != "EC-HSM" {
+		str := fmt.Sprintf("azure key %s has key type %q instead of EC", jwk.Kid, jwk.Kty)
+		return nil, walleterr.New(walleterr.ErrKeyAlgorithmMismatch, str)
+	}
+	if jwk.Crv != "P-256K" {
+		str := fmt.Sprintf("azure key %s has curve %q instead of P-256K", jwk.Kid, jwk.Crv)
+		return nil, walleterr.New(walleterr.ErrKeyAlgorithmMismatch, str)
+	}
+
+	x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+	y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+	if errX != nil || errY != nil || len(x) > 32 || len(y) > 32 {
+		return nil, walleterr.New(walleterr.ErrKeyAlgorithmMismatch, "azure key has invalid coordinates")
+	}
+
+	uncompressed := make([]byte, crypto.PublicKeyLenUncompressed)
+	uncompressed[0] = 0x04
+	copy(uncompressed[33-len(x):33], x)
+	copy(uncompressed[65-len(y):], y)
+	pkey, err := crypto.ParsePublicKey(uncompressed)
+	if err != nil {
+		return nil, walleterr.Wrap(walleterr.ErrKeyAlgorithmMismatch, err, "azure key "+jwk.Kid)
+	}
+	return pkey, nil
+}
+
+func (s *azureSigner) PublicKey() *crypto.PublicKey {
+	return s.pkey
+}
+
+// DescribeKey reports the key as Key Vault returns it. Key Vault does not
+// tell generated and imported keys apart.
+func (s *azureSigner) DescribeKey(ctx context.Context) (KeyDescription, error) {
+	var bundle azureKeyBundle
+	if err := s.do(ctx, http.MethodGet, s.keyURL, nil, &bundle); err != nil {
+		return KeyDescription{}, err
+	}
+	desc := KeyDescription{
+		KeyID:           bundle.Key.Kid,
+		KeySpec:         bundle.Key.Kty + "/" + bundle.Key.Crv,
+		KeyUsage:        strings.Join(bundle.Key.KeyOps, ","),
+		ProtectionLevel: "SOFTWARE",
+	}
+	if bundle.Key.Kty == "EC-HSM" || strings.Contains(s.keyURL, ".managedhsm.azure.net/") {
+		desc.ProtectionLevel = "HSM"
+	}
+	if bundle.Attributes != nil && bundle.Attributes.Enabled != nil {
+		desc.KeyState = "DISABLED"
+		if *bundle.Attributes.Enabled {
+			desc.KeyState = "ENABLED"
+		}
+	}
+
+	if _, err := parseAzureJsonWebKey(&bundle.Key); err != nil {
+		return desc, err
+	}
+	if bundle.Key.KeyOps != nil && !containsString(bundle.Key.KeyOps, "sign") {
+		str := fmt.Sprintf("azure key %s does not allow sign, only %s", bundle.Key.Kid, desc.KeyUsage)
+		return desc, walleterr.New(walleterr.ErrKeyAlgorithmMismatch, str)
+	}
+	if desc.KeyState == "DISABLED" {
+		return desc, walleterr.New(walleterr.ErrKeyStateInvalid, "azure key "+bundle.Key.Kid+" is disabled")
+	}
+	return desc, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *azureSigner) SignDigest(ctx context.Context, digest []byte) ([]byte, []byte, error) {
+	req := azureSignRequest{
+		Alg:   azureSignAlgorithm,
+		Value: base64.RawURLEncoding.EncodeToString(digest),
+	}
+
+	var result azureSignResult
+	if err := s.do(ctx, http.MethodPost, s.keyURL+"/sign", &req, &result); err != nil {
+		return nil, nil, err
+	}
+
+	// Key Vault returns the raw R|S concatenation rather than DER.
+	sig, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(result.Value, "="))
+	if err != nil {
+		return nil, nil, walleterr.Wrap(walleterr.ErrSignatureMalformed, err, "azure signature")
+	}
+	if len(sig) != crypto.SignatureLenRaw {
+		str := fmt.Sprintf("azure signature has %d bytes instead of %d", len(sig), crypto.SignatureLenRaw)
+		return nil, nil, walleterr.New(walleterr.ErrSignatureMalformed, str)
+	}
+
+	return sig[:32], sig[32:], nil
+}
+
+func (s *azureSigner) do(ctx context.Context, method, endpoint string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = b
+	}
+
+	status, respBody, err := s.request(ctx, method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusUnauthorized {
+		// The access token may have been revoked before it expired.
+		s.cred.invalidate()
+		if status, respBody, err = s.request(ctx, method, endpoint, body); err != nil {
+			return err
+		}
+	}
+	if status != http.StatusOK {
+		var azErr azureErrorResponse
+		if json.Unmarshal(respBody, &azErr) == nil && azErr.Error.Code != "" {
+			return httpStatusError(status, fmt.Sprintf("azure key vault %s: %s", azErr.Error.Code, azErr.Error.Message))
+		}
+		return httpStatusError(status, "azure key vault")
+	}
+
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return walleterr.Wrap(walleterr.ErrBackendUnavailable, err, "azure key vault response")
+	}
+	return nil
+}
+
+func (s *azureSigner) request(ctx context.Context, method, endpoint string, body []byte) (int, []byte, error) {
+	token, err := s.cred.getToken(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint+"?api-version="+azureKeyVaultApiVersion, r)
+	if err != nil {
+		return 0, nil, invalidParam("vault_url", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, nil, walleterr.Wrap(walleterr.ErrBackendUnavailable, err, "azure key vault")
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, walleterr.Wrap(walleterr.ErrBackendUnavailable, err, "azure key vault")
+	}
+	return resp.StatusCode, respBody, nil
+}
+
+func (c *azureCredential) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = ""
+}
+
+func (c *azureCredential) getToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Refresh a little early so an in-flight request doesn't carry an
+	// expired token.
+	if c.token != "" && time.Now().Add(time.Minute).Before(c.expires) {
+		return c.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	if c.useMsi {
+		q := url.Values{}
+		q.Set("api-version", "2018-02-01")
+		q.Set("resource", c.resource)
+		if c.clientId != "" {
+			q.Set("client_id", c.clientId)
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, c.msiEndpoint+"?"+q.Encode(), nil)
+		if err != nil {
+			return "", invalidParam("msi_endpoint", err)
+		}
+		req.Header.Set("Metadata", "true")
+	} else {
+		form := url.Values{}
+		form.Set("grant_type", "client_credentials")
+		form.Set("client_id", c.clientId)
+		form.Set("client_secret", c.clientSecret)
+		form.Set("scope", c.resource+"/.default")
+		tokenURL := fmt.Sprintf("%s/%s/oauth2/v2.0/token", c.authorityHost, url.PathEscape(c.tenantId))
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", invalidParam("authority_host", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", walleterr.Wrap(walleterr.ErrBackendUnavailable, err, "azure token request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+		// The identity platform answers invalid client credentials with 400.
+		str := fmt.Sprintf("azure token request rejected (status %d)", resp.StatusCode)
+		return "", walleterr.New(walleterr.ErrPermissionDenied, str)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", httpStatusError(resp.StatusCode, "azure token request")
+	}
+
+	var tr azureTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return "", walleterr.Wrap(walleterr.ErrBackendUnavailable, err, "azure token response")
+	}
+	if tr.AccessToken == "" {
+		return "", walleterr.New(walleterr.ErrPermissionDenied, "azure token response has no access token")
+	}
+
+	// The managed identity endpoint returns expires_in as a string, the
+	// identity platform as a number.
+	var expiresIn int64
+	if err := json.Unmarshal(tr.ExpiresIn, &expiresIn); err != nil {
+		var str string
+		if json.Unmarshal(tr.ExpiresIn, &str) == nil {
+			expiresIn, _ = strconv.ParseInt(str, 10, 64)
+		}
+	}
+	if expiresIn <= 0 {
+		str := fmt.Sprintf("azure token response has expires_in %s", tr.ExpiresIn)
+		return "", walleterr.New(walleterr.ErrBackendUnavailable, str)
+	}
+
+	c.token = tr.AccessToken
+	c.expires = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	return c.token, nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeAzureKeyVault is the state of a fake Key Vault. Its key has the
+// version v1, which the key URL without a version stops signing with once
+// the key is rotated.
+type fakeAzureKeyVault struct {
+	mu        sync.Mutex
+	token     string // the valid access token
+	issued    int
+	expiresIn interface{} // of the tokens of the identity platform
+	rotated   *fakeSigner // the current version once rotated
+}
+
+// revoke invalidates the access token issued last.
+func (f *fakeAzureKeyVault) revoke() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.token = ""
+}
+
+func (f *fakeAzureKeyVault) authorized(r *http.Request) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.token != "" && r.Header.Get("Authorization") == "Bearer "+f.token
+}
+
+// newFakeAzureKeyVault serves the token, get-key and sign endpoints of the
+// Key Vault REST API backed by a fakeSigner.
+func newFakeAzureKeyVault(t *testing.T, signer *fakeSigner) (*fakeAzureKeyVault, *httptest.Server) {
+	t.Helper()
+	fake := &fakeAzureKeyVault{expiresIn: 3600}
+	issue := func(w http.ResponseWriter, expiresIn interface{}) {
+		fake.mu.Lock()
+		fake.issued++
+		fake.token = fmt.Sprintf("fake-access-token-%d", fake.issued)
+		token := fake.token
+		fake.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"access_token": token, "expires_in": expiresIn})
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tenant/oauth2/v2.0/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Form.Get("client_secret") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fake.mu.Lock()
+		expiresIn := fake.expiresIn
+		fake.mu.Unlock()
+		issue(w, expiresIn)
+	})
+	mux.HandleFunc("/msi/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		issue(w, "3600")
+	})
+	getKey := func(w http.ResponseWriter, r *http.Request) {
+		if !fake.authorized(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":{"code":"Unauthorized","message":"no token"}}`))
+			return
+		}
+		pk := signer.PublicKey().SerializeUncompressed()
+		_ = json.NewEncoder(w).Encode(azureKeyBundle{Key: azureJsonWebKey{
+			Kid: "https://vault/keys/validator/v1",
+			Kty: "EC-HSM",
+			Crv: "P-256K",
+			X:   base64.RawURLEncoding.EncodeToString(pk[1:33]),
+			Y:   base64.RawURLEncoding.EncodeToString(pk[33:]),
+		}})
+	}
+	mux.HandleFunc("/keys/validator", getKey)
+	mux.HandleFunc("/keys/validator/v1", getKey)
+	sign := func(signer *fakeSigner) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			var req azureSignRequest
+			if !fake.authorized(r) || json.NewDecoder(r.Body).Decode(&req) != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if req.Alg != azureSignAlgorithm {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error":{"code":"BadParameter","message":"wrong alg"}}`))
+				return
+			}
+			key := signer
+			if key == nil {
+				fake.mu.Lock()
+				key = fake.rotated
+				fake.mu.Unlock()
+			}
+			digest, _ := base64.RawURLEncoding.DecodeString(req.Value)
+			rb, sb, _ := key.SignDigest(r.Context(), digest)
+			sig := append(adjustSignatureLength(rb), adjustSignatureLength(sb)...)
+			_ = json.NewEncoder(w).Encode(azureSignResult{Kid: "validator", Value: base64.RawURLEncoding.EncodeToString(sig)})
+		}
+	}
+	mux.HandleFunc("/keys/validator/v1/sign", sign(signer))
+	mux.HandleFunc("/keys/validator/sign", sign(nil))
+	fake.rotated = signer
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return fake, srv
+}
+
+func TestAzureKeyVault(t *testing.T) {
+	signer := newFakeSigner(t)
+	signer.highS = true
+	_, srv := newFakeAzureKeyVault(t, signer)
+
+	for name, params := range map[string]map[string]string{
+		"client_secret": {
+			"tenant_id":     "tenant",
+			"client_id":     "client",
+			"client_secret": "secret",
+		},
+		"managed_identity": {
+			"use_managed_identity": "true",
+			"msi_endpoint":         srv.URL + "/msi/token",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			params["kms_type"] = "azure"
+			params["vault_url"] = srv.URL
+			params["key_name"] = "validator"
+			params["key_version"] = "v1"
+			params["authority_host"] = srv.URL
+
+			iWallet, err := NewWallet(params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			walletInst := iWallet.(walletImpl)
+			if hex.EncodeToString(walletInst.PublicKey()) != hex.EncodeToString(signer.PublicKey().SerializeCompressed()) {
+				t.Fatalf("unexpected pubkey %x", walletInst.PublicKey())
+			}
+
+			signData, _ := hex.DecodeString("356355dae4212533ce182cbb31492a6c2665fcf8f17e089d929e7a3efd1d1ba1")
+			signature, err := walletInst.Sign(signData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifyRecoverable(t, signData, signature, walletInst.PublicKey())
+		})
+	}
+}
+
+func TestAzureKeyVaultErrors(t *testing.T) {
+	signer := newFakeSigner(t)
+	fake, srv := newFakeAzureKeyVault(t, signer)
+
+	params := map[string]string{
+		"kms_type":       "azure",
+		"vault_url":      srv.URL,
+		"key_name":       "validator",
+		"key_version":    "v1",
+		"authority_host": srv.URL,
+		"tenant_id":      "tenant",
+		"client_id":      "client",
+		"client_secret":  "wrong",
+	}
+	if _, err := NewWallet(params); !errors.Is(err, walleterr.ErrPermissionDenied) {
+		t.Fatalf("NewWallet with a bad client secret returned %v", err)
+	}
+
+	params["client_secret"] = "secret"
+	fake.mu.Lock()
+	fake.expiresIn = "soon"
+	fake.mu.Unlock()
+	if _, err := NewWallet(params); !errors.Is(err, walleterr.ErrBackendUnavailable) {
+		t.Fatalf("NewWallet with a token without lifetime returned %v", err)
+	}
+
+	delete(params, "client_secret")
+	if _, err := NewWallet(params); !errors.Is(err, walleterr.ErrConfigMissingParam) || !strings.Contains(err.Error(), "invalid inputs") {
+		t.Fatalf("NewWallet without credentials returned %v", err)
+	}
+}
+
+func TestAzureKeyVaultRotation(t *testing.T) {
+	signer := newFakeSigner(t)
+	fake, srv := newFakeAzureKeyVault(t, signer)
+	iWallet, err := NewWallet(map[string]string{
+		"kms_type":       "azure",
+		"vault_url":      srv.URL,
+		"key_name":       "validator",
+		"authority_host": srv.URL,
+		"tenant_id":      "tenant",
+		"client_id":      "client",
+		"client_secret":  "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	walletInst := iWallet.(walletImpl)
+
+	// The wallet keeps signing with the version it loaded, and a revoked
+	// token is replaced.
+	fake.mu.Lock()
+	fake.rotated = newFakeSigner(t)
+	fake.mu.Unlock()
+	fake.revoke()
+	signData, _ := hex.DecodeString("356355dae4212533ce182cbb31492a6c2665fcf8f17e089d929e7a3efd1d1ba1")
+	signature, err := walletInst.Sign(signData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyRecoverable(t, signData, signature, signer.PublicKey().SerializeCompressed())
+	if fake.issued != 2 {
+		t.Errorf("%d tokens issued, want 2", fake.issued)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerThreshold   = 3
+	defaultBreakerOpenTimeout = 30 * time.Second
+)
+
+// Circuit breaker states.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// BackendHealth is the circuit breaker state of one signing backend.
+type BackendHealth struct {
+	Name        string    `json:"name"`
+	State       string    `json:"state"`
+	Failures    int       `json:"consecutive_failures"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastFailure time.Time `json:"last_failure"`
+	LastSuccess time.Time `json:"last_success"`
+	OpenedAt    time.Time `json:"opened_at"`
+}
+
+// Health is returned by Wallet.Health. The wallet is healthy while at least
+// one of its backends may be called.
+type Health struct {
+	Address  string          `json:"address"`
+	Healthy  bool            `json:"healthy"`
+	Backends []BackendHealth `json:"backends"`
+}
+
+// breakerConfig holds the breaker_threshold and breaker_open_timeout params.
+type breakerConfig struct {
+	threshold   int
+	openTimeout time.Duration
+}
+
+var defaultBreakerConfig = breakerConfig{
+	threshold:   defaultBreakerThreshold,
+	openTimeout: defaultBreakerOpenTimeout,
+}
+
+func newBreakerConfig(params map[string]string) (breakerConfig, error) {
+	c := defaultBreakerConfig
+	if v := params["breaker_threshold"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return breakerConfig{}, invalidParam("breaker_threshold", fmt.Errorf("%q is not a positive integer", v))
+		}
+		c.threshold = n
+	}
+	if v := params["breaker_open_timeout"]; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return breakerConfig{}, invalidParam("breaker_open_timeout", fmt.Errorf("%q is not a positive duration", v))
+		}
+		c.openTimeout = d
+	}
+	return c, nil
+}
+
+// circuitBreaker opens after threshold consecutive failures so that later
+// calls fail fast instead of each waiting for a timeout. Once openTimeout has
+// passed it lets a single call through as a probe, which closes it again on
+// success.
+type circuitBreaker struct {
+	name string
+	breakerConfig
+
+	mu          sync.Mutex
+	state       string
+	failures    int
+	probing     bool
+	lastErr     error
+	lastFailure time.Time
+	lastSuccess time.Time
+	openedAt    time.Time
+}
+
+func newCircuitBreaker(name string, c breakerConfig) *circuitBreaker {
+	return &circuitBreaker{name: name, breakerConfig: c, state: BreakerClosed}
+}
+
+// allow returns an ErrCircuitOpen error if the backend must not be called
+// now.
+func (b *circuitBreaker) allow(now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if now.Before(b.openedAt.Add(b.openTimeout)) {
+			break
+		}
+		b.state = BreakerHalfOpen
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probing {
+			break
+		}
+		b.probing = true
+		return nil
+	default:
+		return nil
+	}
+
+	str := fmt.Sprintf("backend %s is unavailable since %s after %d failures", b.name,
+		b.openedAt.Format(time.RFC3339), b.failures)
+	return walleterr.Error{Err: walleterr.ErrCircuitOpen, Description: str, Cause: b.lastErr}
+}
+
+// record updates the breaker with the outcome of a call it allowed.
+func (b *circuitBreaker) record(err error, now time.Time) {
+	if errors.Is(err, walleterr.ErrDigestLength) {
+		// The caller's fault, says nothing about the backend.
+		err = nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if err == nil {
+		b.state = BreakerClosed
+		b.failures = 0
+		b.lastSuccess = now
+		return
+	}
+
+	b.failures++
+	b.lastErr = err
+	b.lastFailure = now
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state = BreakerOpen
+		b.openedAt = now
+	}
+}
+
+// trip opens the breaker right away, for a backend that could not even be
+// set up.
+func (b *circuitBreaker) trip(err error, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.lastErr = err
+	b.lastFailure = now
+	b.state = BreakerOpen
+	b.openedAt = now
+}
+
+func (b *circuitBreaker) health(now time.Time) BackendHealth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	h := BackendHealth{
+		Name:        b.name,
+		State:       b.state,
+		Failures:    b.failures,
+		LastFailure: b.lastFailure,
+		LastSuccess: b.lastSuccess,
+		OpenedAt:    b.openedAt,
+	}
+	if b.state == BreakerOpen && !now.Before(b.openedAt.Add(b.openTimeout)) {
+		// The next call probes.
+		h.State = BreakerHalfOpen
+	}
+	if b.lastErr != nil {
+		h.LastError = b.lastErr.Error()
+	}
+	return h
+}
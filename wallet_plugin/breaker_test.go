@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker("test", breakerConfig{threshold: 2, openTimeout: time.Minute})
+	now := time.Now()
+	failure := walleterr.Wrap(walleterr.ErrBackendUnavailable, io.EOF, "test")
+
+	steps := []struct {
+		name    string
+		at      time.Duration
+		outcome error // recorded when the call is allowed
+		allowed bool
+		state   string
+	}{
+		{"first failure", 0, failure, true, BreakerClosed},
+		{"success resets", time.Second, nil, true, BreakerClosed},
+		{"failure", 2 * time.Second, failure, true, BreakerClosed},
+		{"threshold reached", 3 * time.Second, failure, true, BreakerOpen},
+		{"fails fast", 4 * time.Second, nil, false, BreakerOpen},
+		{"probe fails", 64 * time.Second, failure, true, BreakerOpen},
+		{"open again", 65 * time.Second, nil, false, BreakerOpen},
+		{"probe succeeds", 125 * time.Second, nil, true, BreakerClosed},
+	}
+	for _, step := range steps {
+		at := now.Add(step.at)
+		err := b.allow(at)
+		if allowed := err == nil; allowed != step.allowed {
+			t.Fatalf("%s: allowed %v, want %v (%v)", step.name, allowed, step.allowed, err)
+		}
+		if err != nil && !errors.Is(err, walleterr.ErrCircuitOpen) {
+			t.Fatalf("%s: got error %v", step.name, err)
+		}
+		if err == nil {
+			b.record(step.outcome, at)
+		}
+		if h := b.health(at); h.State != step.state {
+			t.Fatalf("%s: state %s, want %s", step.name, h.State, step.state)
+		}
+	}
+
+	// Only one probe at a time.
+	b.trip(failure, now)
+	later := now.Add(2 * time.Minute)
+	if h := b.health(later); h.State != BreakerHalfOpen || h.LastError == "" {
+		t.Errorf("health %+v", h)
+	}
+	if err := b.allow(later); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.allow(later); !errors.Is(err, walleterr.ErrCircuitOpen) {
+		t.Errorf("second probe allowed: %v", err)
+	}
+}
+
+func TestWalletHealth(t *testing.T) {
+	signData, _ := hex.DecodeString("356355dae4212533ce182cbb31492a6c2665fcf8f17e089d929e7a3efd1d1ba1")
+	faults := make([]kmsFault, 20)
+	for i := range faults {
+		faults[i] = kmsFault{code: "KMSInternalException"}
+	}
+	w, signer := newFaultyWallet(t, faults...)
+	w.policy.maxRetries = 0
+	w.breaker = newCircuitBreaker("aws", breakerConfig{threshold: 3, openTimeout: time.Minute})
+
+	if h := w.Health(); !h.Healthy || h.Address != w.addr.String() || len(h.Backends) != 1 {
+		t.Fatalf("health %+v", h)
+	}
+	for i := 0; i < 5; i++ {
+		_, err := w.Sign(signData)
+		if i >= 3 && !errors.Is(err, walleterr.ErrCircuitOpen) {
+			t.Errorf("Sign #%d returned %v", i, err)
+		}
+	}
+	if got := signer.count(); got != 3 {
+		t.Errorf("%d backend calls, want 3", got)
+	}
+
+	h := w.Health()
+	if h.Healthy {
+		t.Error("wallet healthy with its breaker open")
+	}
+	b := h.Backends[0]
+	if b.Name != "aws" || b.State != BreakerOpen || b.Failures != 3 || b.LastError == "" || b.OpenedAt.IsZero() {
+		t.Errorf("backend health %+v", b)
+	}
+
+	// A failover wallet stays healthy while one endpoint is usable.
+	key := newFakeSigner(t)
+	fw, _ := newFailoverWallet(t, breakerConfig{threshold: 1, openTimeout: time.Minute},
+		&faultySigner{fakeSigner: key, faults: []kmsFault{{code: "KMSInternalException"}}},
+		&faultySigner{fakeSigner: key})
+	if _, err := fw.Sign(signData); err != nil {
+		t.Fatal(err)
+	}
+	h = fw.Health()
+	if !h.Healthy || len(h.Backends) != 2 || h.Backends[0].State != BreakerOpen || h.Backends[1].State != BreakerClosed {
+		t.Errorf("failover health %+v", h)
+	}
+}
@@ -0,0 +1,55 @@
+// Command audit-verify checks the hash chain of a wallet plugin audit log.
+//
+// Usage:
+//
+//	audit-verify PATH
+//	audit-verify -files FILE...
+//
+// PATH is the audit_log param of the wallet; its rotated files PATH.SEQ are
+// verified along with it. With -files the given files are verified in the
+// given order. Every break of the chain is printed and the exit status is 1
+// if there is any.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/remote-signing/wallet_plugin/audit"
+)
+
+func main() {
+	files := flag.Bool("files", false, "verify the given files in order instead of a log and its rotated files")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s PATH | -files FILE...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 || (!*files && flag.NArg() != 1) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var r audit.Report
+	var err error
+	if *files {
+		r, err = audit.VerifyFiles(flag.Args()...)
+	} else {
+		r, err = audit.Verify(flag.Arg(0))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	for _, b := range r.Breaks {
+		fmt.Println(b)
+	}
+	fmt.Printf("%d entries in %d files, seq %d to %d, head %s\n", r.Entries, len(r.Files), r.First, r.Last, r.Head)
+	if !r.OK() {
+		fmt.Printf("chain broken in %d places\n", len(r.Breaks))
+		os.Exit(1)
+	}
+	fmt.Println("chain intact")
+}
@@ -0,0 +1,169 @@
+// Command remote-signer serves a wallet of the wallet plugin over JSON-HTTP
+// and gRPC, so bots, relayers and scripts sign through the same backends,
+// policies and audit log as goloop without loading the plugin themselves.
+//
+// Usage:
+//
+//	remote-signer -tls-cert FILE -tls-key FILE -client-ca FILE -api-keys FILE
+//	    [-plugin wallet.so] [-options JSON] [-http-listen ADDR] [-grpc-listen ADDR]
+//
+// The plugin and its options default to the GOLOOP_KEY_PLUGIN and
+// GOLOOP_KEY_PLUGIN_OPTIONS environment variables of a node. Clients need a
+// certificate issued by a CA of the -client-ca file and a key of the -api-keys
+// file, see remotesigner.LoadAPIKeys. The APIs are documented in the
+// remotesigner package.
+//
+// The command must be built from the same source tree as the plugin, or
+// loading the plugin fails.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"plugin"
+	"syscall"
+	"time"
+
+	"github.com/remote-signing/wallet_plugin/log"
+	"github.com/remote-signing/wallet_plugin/remotesigner"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+func main() {
+	pluginPath := flag.String("plugin", envOr("GOLOOP_KEY_PLUGIN", "wallet.so"), "wallet plugin to load")
+	options := flag.String("options", os.Getenv("GOLOOP_KEY_PLUGIN_OPTIONS"), "JSON params of the wallet")
+	httpListen := flag.String("http-listen", "", "address of the JSON-HTTP API, e.g. 127.0.0.1:7443")
+	grpcListen := flag.String("grpc-listen", "", "address of the gRPC API, e.g. 127.0.0.1:7444")
+	certFile := flag.String("tls-cert", "", "certificate of the server (PEM)")
+	keyFile := flag.String("tls-key", "", "key of the server certificate (PEM)")
+	clientCA := flag.String("client-ca", "", "CA certificates that issue the client certificates (PEM)")
+	apiKeys := flag.String("api-keys", "", "file of client names and API keys")
+	maxBytes := flag.Int64("max-request-bytes", remotesigner.DefaultMaxRequestBytes, "size limit of a request")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s -tls-cert FILE -tls-key FILE -client-ca FILE -api-keys FILE [-http-listen ADDR] [-grpc-listen ADDR]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 0 || (*httpListen == "" && *grpcListen == "") ||
+		*certFile == "" || *keyFile == "" || *clientCA == "" || *apiKeys == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	logger := log.New(os.Stdout)
+	fail := func(msg string, err error) {
+		logger.Error(msg, "err", err)
+		os.Exit(1)
+	}
+
+	keys, err := remotesigner.LoadAPIKeys(*apiKeys)
+	if err != nil {
+		fail("can not load API keys", err)
+	}
+	tlsConfig, err := remotesigner.ServerTLSConfig(*certFile, *keyFile, *clientCA)
+	if err != nil {
+		fail("can not load TLS config", err)
+	}
+	wallet, err := loadWallet(*pluginPath, *options)
+	if err != nil {
+		fail("can not load wallet", err)
+	}
+	s, err := remotesigner.NewServer(wallet, remotesigner.Config{APIKeys: keys, MaxRequestBytes: *maxBytes, Logger: logger})
+	if err != nil {
+		fail("can not start server", err)
+	}
+
+	errc := make(chan error, 2)
+	var httpServer *http.Server
+	if *httpListen != "" {
+		httpServer = &http.Server{
+			Addr:              *httpListen,
+			Handler:           s.Handler(),
+			TLSConfig:         tlsConfig,
+			ReadHeaderTimeout: 5 * time.Second,
+			MaxHeaderBytes:    16 << 10,
+		}
+		go func() {
+			if err := httpServer.ListenAndServeTLS("", ""); !errors.Is(err, http.ErrServerClosed) {
+				errc <- fmt.Errorf("JSON-HTTP: %w", err)
+			}
+		}()
+	}
+	var grpcServer *grpc.Server
+	if *grpcListen != "" {
+		l, err := net.Listen("tcp", *grpcListen)
+		if err != nil {
+			fail("can not listen for gRPC", err)
+		}
+		grpcServer = grpc.NewServer(s.GRPCOptions(credentials.NewTLS(tlsConfig))...)
+		s.RegisterGRPC(grpcServer)
+		go func() {
+			if err := grpcServer.Serve(l); err != nil {
+				errc <- fmt.Errorf("gRPC: %w", err)
+			}
+		}()
+	}
+	logger.Info("remote signer started", "address", wallet.Address(), "http", *httpListen, "grpc", *grpcListen, "clients", len(keys))
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		fail("remote signer stopped", err)
+	case <-sig:
+	}
+	logger.Info("remote signer stopping")
+	if grpcServer != nil {
+		grpcServer.GracefulStop()
+	}
+	if httpServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = httpServer.Shutdown(ctx)
+	}
+}
+
+// loadWallet loads the plugin at path and calls its NewWallet with the JSON
+// params options.
+func loadWallet(path, options string) (remotesigner.Wallet, error) {
+	var params map[string]string
+	if err := json.Unmarshal([]byte(options), &params); err != nil {
+		return nil, fmt.Errorf("options are not a JSON object of strings: %w", err)
+	}
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := p.Lookup("NewWallet")
+	if err != nil {
+		return nil, err
+	}
+	newWallet, ok := sym.(func(map[string]string) (interface{}, error))
+	if !ok {
+		return nil, fmt.Errorf("%s: NewWallet is a %T", path, sym)
+	}
+	w, err := newWallet(params)
+	if err != nil {
+		return nil, err
+	}
+	wallet, ok := w.(remotesigner.Wallet)
+	if !ok {
+		return nil, fmt.Errorf("%s: wallet %T has no Address, PublicKey and Sign methods", path, w)
+	}
+	return wallet, nil
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
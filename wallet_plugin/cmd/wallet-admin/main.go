@@ -0,0 +1,88 @@
+// Command wallet-admin calls the admin socket of a running wallet plugin.
+//
+// Usage:
+//
+//	wallet-admin [-socket PATH] [-token TOKEN] COMMAND
+//
+// COMMAND is one of
+//
+//	status     backend, address, public key, health and last Sign call
+//	self-test  sign and verify the self-test digest with every backend
+//	pause      fail Sign calls until resume, e.g. before a failover
+//	resume     sign again
+//	refresh    rebuild the backend clients with fresh credentials
+//	metrics    print the metrics in the Prometheus text format
+//
+// PATH is the admin_socket param of the wallet, by default the
+// WALLET_ADMIN_SOCKET environment variable. TOKEN is its admin_token, by
+// default WALLET_ADMIN_TOKEN. The reply is printed and the exit status is 1
+// if the call failed.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+var commands = map[string]string{
+	"status":    http.MethodGet,
+	"self-test": http.MethodPost,
+	"pause":     http.MethodPost,
+	"resume":    http.MethodPost,
+	"refresh":   http.MethodPost,
+	"metrics":   http.MethodGet,
+}
+
+func main() {
+	socket := flag.String("socket", os.Getenv("WALLET_ADMIN_SOCKET"), "admin socket of the wallet")
+	token := flag.String("token", os.Getenv("WALLET_ADMIN_TOKEN"), "admin token of the wallet")
+	timeout := flag.Duration("timeout", 30*time.Second, "timeout of the call")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-socket PATH] [-token TOKEN] status|self-test|pause|resume|refresh|metrics\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	method, ok := commands[flag.Arg(0)]
+	if flag.NArg() != 1 || !ok || *socket == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	client := &http.Client{
+		Timeout: *timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", *socket)
+			},
+		},
+	}
+	req, err := http.NewRequest(method, "http://wallet/"+flag.Arg(0), nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stderr, resp.Status)
+		os.Exit(1)
+	}
+}
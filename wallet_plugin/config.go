@@ -0,0 +1,517 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configKind is the type of the value of a config_file field.
+type configKind int
+
+const (
+	stringKind configKind = iota
+	durationKind
+	intKind
+	boolKind
+)
+
+// configField describes a field of a config_file and the flat param it sets.
+type configField struct {
+	param    string // defaults to the field name
+	kind     configKind
+	enum     []string
+	min      int64 // for intKind
+	zero     bool  // for durationKind, 0 disables the feature
+	required bool  // for backend fields
+}
+
+// configSections lists the fields of every section of a config_file other
+// than backend and backends. The migration section also has an incoming
+// backend section.
+var configSections = map[string]map[string]configField{
+	"timeouts": {
+		"call":             {param: "call_timeout", kind: durationKind},
+		"sign_deadline":    {kind: durationKind},
+		"max_retries":      {kind: intKind},
+		"retry_base_delay": {kind: durationKind},
+		"retry_max_delay":  {kind: durationKind},
+	},
+	"breaker": {
+		"threshold":    {param: "breaker_threshold", kind: intKind, min: 1},
+		"open_timeout": {param: "breaker_open_timeout", kind: durationKind},
+	},
+	"metrics": {
+		"listen": {param: "metrics_listen"},
+	},
+	"logging": {
+		"level":  {param: "log_level", enum: []string{"trace", "debug", "info", "warn", "warning", "error"}},
+		"format": {param: "log_format", enum: []string{"text", "json"}},
+	},
+	"admin": {
+		"socket":      {param: "admin_socket"},
+		"socket_mode": {param: "admin_socket_mode"},
+		"token":       {param: "admin_token"},
+	},
+	"audit": {
+		"log":      {param: "audit_log"},
+		"max_size": {param: "audit_max_size", kind: intKind, min: 1},
+	},
+	"policy": {
+		"state_dir":         {},
+		"duplicate_digest":  {enum: []string{"warn", "reject"}},
+		"sign_history_size": {kind: intKind, min: 1},
+		"self_test":         {kind: boolKind},
+	},
+	"reload": {
+		"watch_interval":       {param: "config_watch_interval", kind: durationKind, zero: true},
+		"allow_address_change": {kind: boolKind},
+	},
+	"migration": {
+		"state":         {param: "migration_state"},
+		"height":        {param: "migration_height", kind: intKind, min: 1},
+		"time":          {param: "migration_time"},
+		"rpc_url":       {param: "migration_rpc_url"},
+		"poll_interval": {param: "migration_poll_interval", kind: durationKind},
+	},
+	"lease": {
+		"type":         {param: "lease_type", enum: []string{"file", "dynamodb", "gcs"}},
+		"ttl":          {param: "lease_ttl", kind: durationKind},
+		"holder":       {param: "lease_holder"},
+		"key":          {param: "lease_key"},
+		"dir":          {param: "lease_dir"},
+		"table":        {param: "lease_table"},
+		"region":       {param: "lease_region"},
+		"endpoint_url": {param: "lease_endpoint_url"},
+		"bucket":       {param: "lease_bucket"},
+		"object":       {param: "lease_object"},
+	},
+}
+
+// backendFields lists the fields of a backend section by backend type.
+var backendFields = map[string]map[string]configField{
+	"aws": {
+		"key_id":            {required: true},
+		"region":            {},
+		"profile":           {},
+		"endpoint_url":      {},
+		"access_key_id":     {},
+		"secret_access_key": {},
+		"session_token":     {},
+		"role_arn":          {},
+		"external_id":       {},
+		"session_name":      {},
+		"sts_endpoint_url":  {},
+	},
+	"gcp": {
+		"project_id":                  {required: true},
+		"location_id":                 {required: true},
+		"key_ring":                    {required: true},
+		"key":                         {required: true},
+		"key_version":                 {required: true},
+		"credential_json":             {},
+		"credential_path":             {},
+		"impersonate_service_account": {},
+		"impersonate_delegates":       {},
+	},
+	"azure": {
+		"vault_url":            {required: true},
+		"key_name":             {required: true},
+		"key_version":          {},
+		"tenant_id":            {},
+		"client_id":            {},
+		"client_secret":        {},
+		"use_managed_identity": {kind: boolKind},
+		"authority_host":       {},
+		"msi_endpoint":         {},
+	},
+	"vault": {
+		"vault_addr":        {required: true},
+		"key_name":          {required: true},
+		"key_version":       {kind: intKind, min: 1},
+		"transit_mount":     {},
+		"vault_namespace":   {},
+		"vault_token":       {},
+		"approle_mount":     {},
+		"approle_role_id":   {},
+		"approle_secret_id": {},
+		"k8s_role":          {},
+		"k8s_mount":         {},
+		"k8s_jwt_path":      {},
+	},
+	"pkcs11": {
+		"pkcs11_module": {required: true},
+		"token_label":   {},
+		"slot_id":       {},
+		"key_label":     {},
+		"key_id":        {},
+		"pin":           {},
+		"pin_file":      {},
+	},
+	"keystore": {
+		"keystore_path": {required: true},
+		"password_file": {},
+		"password_env":  {},
+	},
+	"remote": {
+		"remote_endpoint":  {required: true},
+		"expected_address": {required: true},
+		"tls_cert":         {required: true},
+		"tls_key":          {required: true},
+		"tls_ca":           {required: true},
+		"tls_server_name":  {},
+		"api_key":          {required: true},
+	},
+}
+
+var configEnvRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// configError collects the problems found in a config_file, each with the
+// line and column of the value and the path of the field.
+type configError struct {
+	file     string
+	problems []string
+	missing  bool // only required fields are missing
+}
+
+func (e *configError) add(n *yaml.Node, path, format string, args ...interface{}) {
+	e.problems = append(e.problems, fmt.Sprintf("%d:%d: %s: %s", n.Line, n.Column, path, fmt.Sprintf(format, args...)))
+	e.missing = false
+}
+
+func (e *configError) err() error {
+	if len(e.problems) == 0 {
+		return nil
+	}
+	kind := walleterr.ErrConfigInvalidParam
+	if e.missing {
+		kind = walleterr.ErrConfigMissingParam
+	}
+	str := "invalid inputs: config_file " + e.file + ": " + strings.Join(e.problems, "; ")
+	return walleterr.New(kind, str)
+}
+
+// loadConfigFile reads the JSON or YAML file named by the config_file param
+// and returns the flat params it stands for. params other than config_file
+// override the values of the file, so a file can be shared by nodes that only
+// differ in a few params. Without config_file it returns params unchanged.
+//
+// A string value may refer to an environment variable with ${NAME}, and a
+// value of file://PATH is replaced by the content of the file, without a
+// trailing newline, so secrets need not be written into the config.
+func loadConfigFile(params map[string]string) (map[string]string, error) {
+	path := params["config_file"]
+	if path == "" {
+		return params, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, invalidParam("config_file", err)
+	}
+
+	// YAML 1.2 is a superset of JSON, so one parser reads both and gives
+	// the position of every value.
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, invalidParam("config_file "+path, err)
+	}
+	e := &configError{file: path}
+	flat := parseConfig(&doc, e, filepath.Dir(path))
+	if err := e.err(); err != nil {
+		return nil, err
+	}
+
+	for k, v := range params {
+		if k != "config_file" {
+			flat[k] = v
+		}
+	}
+	return flat, nil
+}
+
+// parseConfig walks the document, checking it against the schema, and
+// returns the flat params it sets.
+func parseConfig(doc *yaml.Node, e *configError, dir string) map[string]string {
+	flat := make(map[string]string)
+	if doc.Kind == 0 || len(doc.Content) == 0 {
+		e.problems = append(e.problems, "empty document")
+		return flat
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		e.add(root, "(root)", "not a mapping")
+		return flat
+	}
+
+	var backend, backends, incoming *yaml.Node
+	for i := 0; i < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		switch key.Value {
+		case "backend":
+			backend = value
+		case "backends":
+			backends = value
+		case "migration":
+			incoming = parseMigration(value, flat, e, dir)
+		default:
+			fields, ok := configSections[key.Value]
+			if !ok {
+				e.add(key, key.Value, "unknown section, expected one of %s", sectionNames())
+				continue
+			}
+			parseSection(value, key.Value, fields, flat, e, dir)
+		}
+	}
+	if backend == nil {
+		e.add(root, "backend", "section is required")
+		return flat
+	}
+
+	base := parseBackend(backend, "backend", "", e, dir)
+	kmsType := base["kms_type"]
+	for k, v := range base {
+		flat[k] = v
+	}
+	if incoming != nil {
+		entry := parseBackend(incoming, "migration.incoming", kmsType, e, dir)
+		b, _ := json.Marshal(entry)
+		flat["migration_incoming"] = string(b)
+		if merged, err := migrationIncomingParams(flat); err == nil {
+			checkRequired(incoming, "migration.incoming", merged, e)
+		}
+	}
+	if backends == nil {
+		checkRequired(backend, "backend", base, e)
+		return flat
+	}
+
+	if backends.Kind != yaml.SequenceNode || len(backends.Content) == 0 {
+		e.add(backends, "backends", "not a non-empty list")
+		return flat
+	}
+	entries := make([]map[string]string, 0, len(backends.Content))
+	for i, n := range backends.Content {
+		path := fmt.Sprintf("backends[%d]", i)
+		entry := parseBackend(n, path, kmsType, e, dir)
+		merged := make(map[string]string, len(base)+len(entry))
+		for k, v := range base {
+			merged[k] = v
+		}
+		for k, v := range entry {
+			merged[k] = v
+		}
+		checkRequired(n, path, merged, e)
+		entries = append(entries, entry)
+	}
+	b, _ := json.Marshal(entries)
+	flat["backends"] = string(b)
+	return flat
+}
+
+func sectionNames() string {
+	names := []string{"backend", "backends"}
+	for name := range configSections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func parseSection(n *yaml.Node, path string, fields map[string]configField, flat map[string]string, e *configError, dir string) {
+	if n.Kind != yaml.MappingNode {
+		e.add(n, path, "not a mapping")
+		return
+	}
+	for i := 0; i < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		f, ok := fields[key.Value]
+		if !ok {
+			e.add(key, path+"."+key.Value, "unknown field")
+			continue
+		}
+		param := f.param
+		if param == "" {
+			param = key.Value
+		}
+		if v, ok := parseValue(value, path+"."+key.Value, f, e, dir); ok {
+			flat[param] = v
+		}
+	}
+}
+
+// parseMigration parses the migration section but for its incoming backend,
+// which it returns.
+func parseMigration(n *yaml.Node, flat map[string]string, e *configError, dir string) *yaml.Node {
+	if n.Kind != yaml.MappingNode {
+		e.add(n, "migration", "not a mapping")
+		return nil
+	}
+	var incoming *yaml.Node
+	rest := &yaml.Node{Kind: yaml.MappingNode, Line: n.Line, Column: n.Column}
+	for i := 0; i < len(n.Content); i += 2 {
+		if n.Content[i].Value == "incoming" {
+			incoming = n.Content[i+1]
+			continue
+		}
+		rest.Content = append(rest.Content, n.Content[i], n.Content[i+1])
+	}
+	parseSection(rest, "migration", configSections["migration"], flat, e, dir)
+	if incoming == nil {
+		e.add(n, "migration.incoming", "section is required")
+	}
+	return incoming
+}
+
+// parseBackend parses a backend section. An entry of backends inherits the
+// type of the backend section unless it has its own.
+func parseBackend(n *yaml.Node, path, inherited string, e *configError, dir string) map[string]string {
+	out := make(map[string]string)
+	if n.Kind != yaml.MappingNode {
+		e.add(n, path, "not a mapping")
+		return out
+	}
+
+	kmsType := inherited
+	for i := 0; i < len(n.Content); i += 2 {
+		if key, value := n.Content[i], n.Content[i+1]; key.Value == "type" {
+			v, ok := parseValue(value, path+".type", configField{}, e, dir)
+			if !ok {
+				return out
+			}
+			kmsType = signerName(v)
+			if _, ok := backendFields[kmsType]; !ok {
+				e.add(value, path+".type", "%q is not one of %s", v, strings.Join(RegisteredSigners(), ", "))
+				return out
+			}
+			out["kms_type"] = kmsType
+		}
+	}
+	if kmsType == "" {
+		e.add(n, path+".type", "is required")
+		return out
+	}
+
+	fields := backendFields[kmsType]
+	for i := 0; i < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		if key.Value == "type" {
+			continue
+		}
+		f, ok := fields[key.Value]
+		if key.Value == "name" {
+			f, ok = configField{}, true
+		}
+		if !ok {
+			e.add(key, path+"."+key.Value, "unknown field of %s backends", kmsType)
+			continue
+		}
+		if v, ok := parseValue(value, path+"."+key.Value, f, e, dir); ok {
+			out[key.Value] = v
+		}
+	}
+	return out
+}
+
+// checkRequired reports the required fields of the backend type that params
+// lacks. They are only reported if nothing else is wrong, to keep the
+// message short.
+func checkRequired(n *yaml.Node, path string, params map[string]string, e *configError) {
+	fields, ok := backendFields[params["kms_type"]]
+	if !ok || len(e.problems) > 0 {
+		return
+	}
+	var missing []string
+	for name, f := range fields {
+		if f.required && params[name] == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+	sort.Strings(missing)
+	e.add(n, path, "missing %s for %s backends", strings.Join(missing, ", "), params["kms_type"])
+	e.missing = true
+}
+
+// parseValue resolves the references in a scalar and checks it against f.
+func parseValue(n *yaml.Node, path string, f configField, e *configError, dir string) (string, bool) {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	if n.Kind != yaml.ScalarNode || n.Tag == "!!null" {
+		e.add(n, path, "not a scalar value")
+		return "", false
+	}
+
+	v := n.Value
+	if n.Tag == "!!str" {
+		var err error
+		if v, err = expandConfigRefs(v, dir); err != nil {
+			e.add(n, path, "%v", err)
+			return "", false
+		}
+	}
+
+	switch f.kind {
+	case durationKind:
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || d == 0 && !f.zero {
+			e.add(n, path, "%q is not a positive duration such as 500ms or 2s", v)
+			return "", false
+		}
+	case intKind:
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || i < f.min {
+			e.add(n, path, "%q is not an integer of at least %d", v, f.min)
+			return "", false
+		}
+	case boolKind:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			e.add(n, path, "%q is not true or false", v)
+			return "", false
+		}
+		v = strconv.FormatBool(b)
+	}
+	if len(f.enum) > 0 && !containsString(f.enum, v) {
+		e.add(n, path, "%q is not one of %s", v, strings.Join(f.enum, ", "))
+		return "", false
+	}
+	return v, true
+}
+
+// expandConfigRefs replaces ${NAME} with the environment variable NAME and
+// a file://PATH value with the content of PATH, relative to dir.
+func expandConfigRefs(v, dir string) (string, error) {
+	if strings.HasPrefix(v, "file://") {
+		path := strings.TrimPrefix(v, "file://")
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+
+	var err error
+	v = configEnvRef.ReplaceAllStringFunc(v, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		value, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value
+	})
+	return v, err
+}
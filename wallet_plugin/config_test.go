@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	crypto "github.com/remote-signing/wallet_plugin/key"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "secret"), []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_KEY_ID", "mrk-1234")
+
+	want := map[string]string{
+		"kms_type":          "aws",
+		"key_id":            "mrk-1234",
+		"access_key_id":     "AKIASTATIC",
+		"secret_access_key": "s3cret",
+		"backends":          `[{"name":"primary","region":"us-east-1"},{"region":"eu-west-1"}]`,
+		"call_timeout":      "500ms",
+		"max_retries":       "2",
+		"breaker_threshold": "5",
+		"metrics_listen":    "127.0.0.1:9464",
+		"log_level":         "debug",
+		"audit_log":         "/goloop/data/audit.log",
+		"duplicate_digest":  "reject",
+		"self_test":         "false",
+		"lease_type":        "file",
+		"lease_ttl":         "10s",
+		"lease_dir":         "/shared/leases",
+	}
+	for name, content := range map[string]string{
+		"config.yaml": `
+backend:
+  type: 1
+  key_id: ${TEST_KEY_ID}
+  access_key_id: AKIASTATIC
+  secret_access_key: file://secret
+backends:
+  - name: primary
+    region: us-east-1
+  - region: eu-west-1
+timeouts:
+  call: 500ms
+  max_retries: 2
+breaker:
+  threshold: 5
+metrics:
+  listen: 127.0.0.1:9464
+logging:
+  level: debug
+audit:
+  log: /goloop/data/audit.log
+policy:
+  duplicate_digest: reject
+  self_test: false
+lease:
+  type: file
+  ttl: 10s
+  dir: /shared/leases
+`,
+		"config.json": `{
+	"backend": {"type": "aws", "key_id": "${TEST_KEY_ID}", "access_key_id": "AKIASTATIC", "secret_access_key": "file://secret"},
+	"backends": [{"name": "primary", "region": "us-east-1"}, {"region": "eu-west-1"}],
+	"timeouts": {"call": "500ms", "max_retries": 2},
+	"breaker": {"threshold": 5},
+	"metrics": {"listen": "127.0.0.1:9464"},
+	"logging": {"level": "debug"},
+	"audit": {"log": "/goloop/data/audit.log"},
+	"policy": {"duplicate_digest": "reject", "self_test": false},
+	"lease": {"type": "file", "ttl": "10s", "dir": "/shared/leases"}
+}`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		params, err := loadConfigFile(map[string]string{"config_file": path})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(params, want) {
+			t.Errorf("%s: params\n%v\nwant\n%v", name, params, want)
+		}
+
+		// Params given along with the file override it.
+		params, err = loadConfigFile(map[string]string{"config_file": path, "log_level": "info"})
+		if err != nil || params["log_level"] != "info" {
+			t.Errorf("%s: log_level %q, %v", name, params["log_level"], err)
+		}
+	}
+}
+
+func TestConfigFileWallet(t *testing.T) {
+	priv, pub := crypto.GenerateKeyPair()
+	t.Setenv("TEST_KEY_PASSWORD", "gochain@123")
+	path := writeConfig(t, "wallet.yaml", `
+backend:
+  type: keystore
+  keystore_path: `+writeKeyStore(t, priv, "gochain@123", "scrypt")+`
+  password_env: TEST_KEY_PASSWORD
+`)
+	iWallet, err := NewWallet(map[string]string{"config_file": path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := iWallet.(*ReloadableWallet)
+	t.Cleanup(r.Close)
+	if !r.generation().pkey.Equal(pub) {
+		t.Error("wallet loaded another key")
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	for name, tc := range map[string]struct {
+		content string
+		kind    walleterr.ErrorKind
+		msg     string
+	}{
+		"no backend": {
+			"timeouts:\n  call: 1s\n", walleterr.ErrConfigInvalidParam, "backend: section is required",
+		},
+		"unknown section": {
+			"backend:\n  type: aws\n  key_id: k\ntimeout:\n  call: 1s\n", walleterr.ErrConfigInvalidParam, "4:1: timeout: unknown section",
+		},
+		"unknown field": {
+			"backend:\n  type: aws\n  key_id: k\ntimeouts:\n  cal: 1s\n", walleterr.ErrConfigInvalidParam, "5:3: timeouts.cal: unknown field",
+		},
+		"field of another backend": {
+			"backend:\n  type: aws\n  key_id: k\n  project_id: p\n", walleterr.ErrConfigInvalidParam, "4:3: backend.project_id: unknown field of aws backends",
+		},
+		"bad type": {
+			"backend:\n  type: hsm\n", walleterr.ErrConfigInvalidParam, `2:9: backend.type: "hsm" is not one of`,
+		},
+		"bad duration": {
+			"backend:\n  type: aws\n  key_id: k\ntimeouts:\n  call: 1x\n", walleterr.ErrConfigInvalidParam, `5:9: timeouts.call: "1x" is not a positive duration`,
+		},
+		"bad integer": {
+			"backend:\n  type: aws\n  key_id: k\nbreaker:\n  threshold: 0\n", walleterr.ErrConfigInvalidParam, `5:14: breaker.threshold: "0" is not an integer of at least 1`,
+		},
+		"bad enum": {
+			"backend:\n  type: aws\n  key_id: k\npolicy:\n  duplicate_digest: ignore\n", walleterr.ErrConfigInvalidParam, `policy.duplicate_digest: "ignore" is not one of warn, reject`,
+		},
+		"not a scalar": {
+			"backend:\n  type: aws\n  key_id: [k]\n", walleterr.ErrConfigInvalidParam, "3:11: backend.key_id: not a scalar value",
+		},
+		"unset variable": {
+			"backend:\n  type: aws\n  key_id: ${TEST_UNSET_VARIABLE}\n", walleterr.ErrConfigInvalidParam, "environment variable TEST_UNSET_VARIABLE is not set",
+		},
+		"missing file": {
+			"backend:\n  type: aws\n  key_id: k\n  secret_access_key: file:///nonexistent/secret\n", walleterr.ErrConfigInvalidParam, "4:22: backend.secret_access_key: open /nonexistent/secret",
+		},
+		"missing required": {
+			"backend:\n  type: gcp\n  project_id: p\n  key_ring: r\n", walleterr.ErrConfigMissingParam, "backend: missing key, key_version, location_id for gcp backends",
+		},
+		"missing in an endpoint": {
+			"backend:\n  type: aws\nbackends:\n  - key_id: k\n  - region: eu-west-1\n", walleterr.ErrConfigMissingParam, "5:5: backends[1]: missing key_id for aws backends",
+		},
+		"invalid yaml": {
+			"backend: [\n", walleterr.ErrConfigInvalidParam, "config_file",
+		},
+	} {
+		path := writeConfig(t, "config.yaml", tc.content)
+		_, err := loadConfigFile(map[string]string{"config_file": path})
+		if !errors.Is(err, tc.kind) || !strings.Contains(err.Error(), tc.msg) {
+			t.Errorf("%s: got %v, want %s with %q", name, err, tc.kind, tc.msg)
+		}
+	}
+
+	if _, err := loadConfigFile(map[string]string{"config_file": "/nonexistent/config.yaml"}); !errors.Is(err, walleterr.ErrConfigInvalidParam) {
+		t.Errorf("missing config_file returned %v", err)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/hex"
+	"fmt"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultSignHistorySize = 10000
+
+// Policies for a digest that was already signed.
+const (
+	duplicateWarn   = "warn"   // log and count it, then sign
+	duplicateReject = "reject" // fail with ErrDuplicateDigest
+)
+
+// signGuard protects a validator key against being used by two processes at
+// once and against signing the same digest twice. It is enabled by the
+// state_dir param and keeps two files there, named after the address of the
+// key so every configuration of the same key shares them:
+//
+//   - ADDRESS.lock is held with an exclusive flock for the life of the
+//     process. A second process signing with the key on this host can not
+//     take it and refuses to load.
+//   - ADDRESS.history lists the hex digests signed recently, so duplicates
+//     are also caught across restarts.
+type signGuard struct {
+	policy string
+	lock   *os.File
+
+	mu      sync.Mutex
+	history *digestLRU
+	pending map[string]bool // reserved digests that were not in the history
+	file    *os.File        // history, appended to
+	path    string
+	lines   int
+}
+
+// newSignGuard takes the lock of addr in the state_dir param and loads its
+// signing history. It returns nil if state_dir is not set.
+func newSignGuard(params map[string]string, addr string) (*signGuard, error) {
+	dir := params["state_dir"]
+	if dir == "" {
+		return nil, nil
+	}
+	g := &signGuard{policy: duplicateWarn}
+	switch p := params["duplicate_digest"]; p {
+	case "":
+	case duplicateWarn, duplicateReject:
+		g.policy = p
+	default:
+		return nil, invalidParam("duplicate_digest", fmt.Errorf("%q is neither %s nor %s", p, duplicateWarn, duplicateReject))
+	}
+	size := defaultSignHistorySize
+	if v := params["sign_history_size"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, invalidParam("sign_history_size", fmt.Errorf("%q is not a positive integer", v))
+		}
+		size = n
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, invalidParam("state_dir", err)
+	}
+
+	lock, err := lockKey(filepath.Join(dir, addr+".lock"))
+	if err != nil {
+		return nil, err
+	}
+	g.lock = lock
+	g.history = newDigestLRU(size)
+	g.pending = make(map[string]bool)
+	g.path = filepath.Join(dir, addr+".history")
+	if err := g.load(); err != nil {
+		g.close()
+		return nil, err
+	}
+	return g, nil
+}
+
+// lockKey takes an exclusive flock on path and writes who holds it. The lock
+// is released by the kernel when the process exits, however it exits.
+func lockKey(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, invalidParam("state_dir", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		holder, _ := os.ReadFile(path)
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			str := fmt.Sprintf("key is in use by another signer (%s), lock %s", strings.TrimSpace(string(holder)), path)
+			return nil, walleterr.New(walleterr.ErrKeyInUse, str)
+		}
+		return nil, walleterr.Wrap(walleterr.ErrConfigInvalidParam, err, "lock "+path)
+	}
+
+	host, _ := os.Hostname()
+	holder := fmt.Sprintf("pid %d on %s since %s\n", os.Getpid(), host, time.Now().UTC().Format(time.RFC3339))
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt([]byte(holder), 0)
+	}
+	return f, nil
+}
+
+// load reads the history file and compacts it.
+func (g *signGuard) load() error {
+	f, err := os.Open(g.path)
+	if err != nil && !os.IsNotExist(err) {
+		return invalidParam("state_dir", err)
+	}
+	if err == nil {
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			if digest, err := hex.DecodeString(s.Text()); err == nil && len(digest) == 32 {
+				g.history.add(string(digest))
+			}
+		}
+		f.Close()
+		if err := s.Err(); err != nil {
+			return invalidParam("state_dir", err)
+		}
+	}
+	if err := g.compact(); err != nil {
+		return invalidParam("state_dir", err)
+	}
+	return nil
+}
+
+// compact rewrites the history file with the digests in the LRU only.
+func (g *signGuard) compact() error {
+	tmp := g.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	digests := g.history.keys()
+	for _, d := range digests {
+		fmt.Fprintln(w, hex.EncodeToString([]byte(d)))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, g.path); err != nil {
+		return err
+	}
+
+	if g.file != nil {
+		g.file.Close()
+	}
+	g.file, err = os.OpenFile(g.path, os.O_WRONLY|os.O_APPEND, 0600)
+	g.lines = len(digests)
+	return err
+}
+
+// reserve checks digest against the history before it is signed. A
+// duplicate is rejected or only reported, depending on the policy. A new
+// digest is added to the history right away, so concurrent requests for it
+// are caught too. Every reserved digest must be passed to done.
+func (g *signGuard) reserve(digest []byte) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.history.contains(string(digest)) {
+		duplicateDigests.Inc(g.policy)
+		if g.policy == duplicateReject {
+			return walleterr.New(walleterr.ErrDuplicateDigest, "digest 0x"+hex.EncodeToString(digest)+" was already signed")
+		}
+		logger.Warn("signing a digest again", "digest", digest)
+		return nil
+	}
+	g.history.add(string(digest))
+	g.pending[string(digest)] = true
+	return nil
+}
+
+// done records the outcome of signing a reserved digest. A digest that was
+// new stays in the history only if it was signed, and is then written to the
+// history file. The history is an extra safety net, so failing to write it
+// is logged but does not fail the signature.
+func (g *signGuard) done(digest []byte, signed bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	k := string(digest)
+	if !g.pending[k] {
+		return
+	}
+	delete(g.pending, k)
+	if !signed {
+		g.history.remove(k)
+		return
+	}
+	if _, err := fmt.Fprintln(g.file, hex.EncodeToString(digest)); err != nil {
+		logger.Error("write signing history", "path", g.path, "err", err)
+		return
+	}
+	g.lines++
+	if g.lines > 2*g.history.size {
+		if err := g.compact(); err != nil {
+			logger.Error("compact signing history", "path", g.path, "err", err)
+		}
+	}
+}
+
+// close releases the lock and closes the history file.
+func (g *signGuard) close() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.file != nil {
+		g.file.Close()
+	}
+	if g.lock != nil {
+		g.lock.Close()
+	}
+}
+
+// digestLRU is a set of digests that forgets the least recently added one
+// once it holds size digests.
+type digestLRU struct {
+	size  int
+	order *list.List // of string, most recent at the front
+	items map[string]*list.Element
+}
+
+func newDigestLRU(size int) *digestLRU {
+	return &digestLRU{size: size, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *digestLRU) contains(k string) bool {
+	_, ok := c.items[k]
+	return ok
+}
+
+func (c *digestLRU) add(k string) {
+	if e, ok := c.items[k]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[k] = c.order.PushFront(k)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(string))
+	}
+}
+
+func (c *digestLRU) remove(k string) {
+	if e, ok := c.items[k]; ok {
+		c.order.Remove(e)
+		delete(c.items, k)
+	}
+}
+
+// keys returns the digests from the oldest to the most recent.
+func (c *digestLRU) keys() []string {
+	keys := make([]string, 0, c.order.Len())
+	for e := c.order.Back(); e != nil; e = e.Prev() {
+		keys = append(keys, e.Value.(string))
+	}
+	return keys
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newGuardedWallet(t *testing.T, key *fakeSigner, params map[string]string) Wallet {
+	t.Helper()
+	w, err := newWallet(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.policy = testRetryPolicy
+	w.guard, err = newSignGuard(params, w.addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(w.guard.close)
+	return w
+}
+
+func TestKeyLock(t *testing.T) {
+	dir := t.TempDir()
+	key := newFakeSigner(t)
+	w := newGuardedWallet(t, key, map[string]string{"state_dir": dir})
+
+	// A second signer with the same key is refused while the first runs.
+	_, err := newSignGuard(map[string]string{"state_dir": dir}, w.addr.String())
+	if !errors.Is(err, walleterr.ErrKeyInUse) || !strings.Contains(err.Error(), "pid") {
+		t.Fatalf("second guard returned %v", err)
+	}
+	other := newGuardedWallet(t, newFakeSigner(t), map[string]string{"state_dir": dir})
+
+	w.guard.close()
+	g, err := newSignGuard(map[string]string{"state_dir": dir}, w.addr.String())
+	if err != nil {
+		t.Fatalf("lock not released: %v", err)
+	}
+	g.close()
+	other.guard.close()
+
+	// A wallet whose lease can not be set up does not keep the lock.
+	if err := w.claimKey(map[string]string{"state_dir": dir, "lease_type": "none"}); !errors.Is(err, walleterr.ErrConfigInvalidParam) {
+		t.Fatalf("claimKey with a bad lease_type returned %v", err)
+	}
+	if g, err = newSignGuard(map[string]string{"state_dir": dir}, w.addr.String()); err != nil {
+		t.Fatalf("lock kept after a failed claimKey: %v", err)
+	}
+	g.close()
+
+	for _, params := range []map[string]string{
+		{"state_dir": dir, "duplicate_digest": "ignore"},
+		{"state_dir": dir, "sign_history_size": "0"},
+	} {
+		if _, err := newSignGuard(params, w.addr.String()); !errors.Is(err, walleterr.ErrConfigInvalidParam) {
+			t.Errorf("newSignGuard(%v) returned %v", params, err)
+		}
+	}
+}
+
+func TestDuplicateDigest(t *testing.T) {
+	dir := t.TempDir()
+	key := newFakeSigner(t)
+	digest := sha256.Sum256([]byte("vote"))
+
+	w := newGuardedWallet(t, key, map[string]string{"state_dir": dir, "duplicate_digest": "reject"})
+	if _, err := w.Sign(digest[:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Sign(digest[:]); !errors.Is(err, walleterr.ErrDuplicateDigest) {
+		t.Fatalf("second Sign returned %v", err)
+	}
+
+	// The history survives a restart.
+	w.guard.close()
+	w = newGuardedWallet(t, key, map[string]string{"state_dir": dir, "duplicate_digest": "reject"})
+	if _, err := w.Sign(digest[:]); !errors.Is(err, walleterr.ErrDuplicateDigest) {
+		t.Fatalf("Sign after a restart returned %v", err)
+	}
+
+	// The warn policy only counts duplicates.
+	w.guard.close()
+	w = newGuardedWallet(t, key, map[string]string{"state_dir": dir})
+	warned := duplicateDigests.Value(duplicateWarn)
+	if _, err := w.Sign(digest[:]); err != nil {
+		t.Fatal(err)
+	}
+	if duplicateDigests.Value(duplicateWarn) != warned+1 {
+		t.Error("duplicate not counted")
+	}
+}
+
+func TestFailedDigestNotRemembered(t *testing.T) {
+	key := newFakeSigner(t)
+	w := newGuardedWallet(t, key, map[string]string{"state_dir": t.TempDir(), "duplicate_digest": "reject"})
+	w.signer = &faultySigner{fakeSigner: key, faults: []kmsFault{{code: "AccessDeniedException"}}}
+	digest := sha256.Sum256([]byte("vote"))
+
+	if _, err := w.Sign(digest[:]); !errors.Is(err, walleterr.ErrPermissionDenied) {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := w.Sign(digest[:]); err != nil {
+		t.Errorf("a digest that failed to sign was remembered: %v", err)
+	}
+}
+
+func TestUnrecordedDigestNotRemembered(t *testing.T) {
+	key := newFakeSigner(t)
+	w := newGuardedWallet(t, key, map[string]string{"state_dir": t.TempDir(), "duplicate_digest": "reject"})
+	a, err := newAuditor(map[string]string{"audit_log": filepath.Join(t.TempDir(), "audit.log")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.audit = a
+	a.log.Close()
+	digest := sha256.Sum256([]byte("vote"))
+
+	if _, err := w.Sign(digest[:]); !errors.Is(err, walleterr.ErrAuditLog) {
+		t.Fatalf("Sign with a closed audit log returned %v", err)
+	}
+	w.audit = nil
+	if _, err := w.Sign(digest[:]); err != nil {
+		t.Errorf("a digest whose signature was not handed out was remembered: %v", err)
+	}
+}
+
+func TestSignHistoryCompaction(t *testing.T) {
+	dir := t.TempDir()
+	key := newFakeSigner(t)
+	w := newGuardedWallet(t, key, map[string]string{"state_dir": dir, "sign_history_size": "4", "duplicate_digest": "reject"})
+
+	for i := 0; i < 20; i++ {
+		digest := sha256.Sum256([]byte{byte(i)})
+		if _, err := w.Sign(digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := os.ReadFile(filepath.Join(dir, w.addr.String()+".history"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(b), "\n"); n > 8 {
+		t.Errorf("history has %d lines", n)
+	}
+
+	// Only the last digests are remembered.
+	old := sha256.Sum256([]byte{0})
+	recent := sha256.Sum256([]byte{19})
+	if _, err := w.Sign(old[:]); err != nil {
+		t.Errorf("an evicted digest is still rejected: %v", err)
+	}
+	if _, err := w.Sign(recent[:]); !errors.Is(err, walleterr.ErrDuplicateDigest) {
+		t.Errorf("a recent digest is accepted: %v", err)
+	}
+}
@@ -656,6 +656,49 @@ func sign(privKey, nonce *secp256k1.ModNScalar, hash []byte) (*Signature, byte,
 	return NewSignature(&r, s), pubKeyRecoveryCode, true
 }
 
+// signRFC6979 generates a deterministic ECDSA signature according to RFC 6979
+// and BIP0062 and returns it along with an additional public key recovery code
+// for efficiently recovering the public key from the signature.
+func signRFC6979(privKey *secp256k1.PrivateKey, hash []byte) (*Signature, byte) {
+	// The algorithm for producing an ECDSA signature is given as algorithm 4.29
+	// in [GECC].  See sign for the steps performed for each nonce.
+	//
+	// Step 1 is modified here to conform to RFC6979 by generating a
+	// deterministic nonce in [1, N-1] parameterized by the private key, message
+	// being signed, and an iteration count for the repeat cases instead of
+	// selecting a random one.
+	privKeyScalar := &privKey.Key
+	var privKeyBytes [32]byte
+	privKeyScalar.PutBytes(&privKeyBytes)
+	defer zeroArray32(&privKeyBytes)
+	for iteration := uint32(0); ; iteration++ {
+		// Step 1 with modification A.
+		//
+		// Generate a deterministic nonce in [1, N-1] parameterized by the
+		// private key, message being signed, and iteration count.
+		k := secp256k1.NonceRFC6979(privKeyBytes[:], hash, nil, nil, iteration)
+
+		// Steps 2-6.
+		sig, pubKeyRecoveryCode, success := sign(privKeyScalar, k, hash)
+		k.Zero()
+		if !success {
+			continue
+		}
+
+		return sig, pubKeyRecoveryCode
+	}
+}
+
+// Sign generates an ECDSA signature over the secp256k1 curve for the provided
+// hash (which should be the result of hashing a larger message) using the given
+// private key.  The produced signature is deterministic (same message and same
+// key yield the same signature) and canonical in accordance with RFC6979 and
+// BIP0062.
+func Sign(key *secp256k1.PrivateKey, hash []byte) *Signature {
+	signature, _ := signRFC6979(key, hash)
+	return signature
+}
+
 const (
 	// compactSigSize is the size of a compact signature.  It consists of a
 	// compact signature recovery code byte followed by the R and S components
@@ -685,6 +728,33 @@ const (
 	pubKeyRecoveryCodeOverflowBit = 1 << 1
 )
 
+// SignCompact produces a compact ECDSA signature over the secp256k1 curve for
+// the provided hash (which should be the result of hashing a larger message)
+// using the given private key.  The isCompressedKey parameter specifies if the
+// produced signature should reference a compressed public key or not.
+//
+// Compact signature format:
+// <1-byte compact sig recovery code><32-byte R><32-byte S>
+//
+// The compact sig recovery code is the value 27 + public key recovery code + 4
+// if the compact signature was created with a compressed public key.
+func SignCompact(key *secp256k1.PrivateKey, hash []byte, isCompressedKey bool) []byte {
+	// Create the signature and associated pubkey recovery code and calculate
+	// the compact signature recovery code.
+	sig, pubKeyRecoveryCode := signRFC6979(key, hash)
+	compactSigRecoveryCode := compactSigMagicOffset + pubKeyRecoveryCode
+	if isCompressedKey {
+		compactSigRecoveryCode += compactSigCompPubKey
+	}
+
+	// Output <compactSigRecoveryCode><32-byte R><32-byte S>.
+	var b [compactSigSize]byte
+	b[0] = compactSigRecoveryCode
+	sig.r.PutBytesUnchecked(b[1:33])
+	sig.s.PutBytesUnchecked(b[33:65])
+	return b[:]
+}
+
 // RecoverCompact attempts to recover the secp256k1 public key from the provided
 // compact signature and message hash.  It first verifies the signature, and, if
 // the signature matches then the recovered public key will be returned as well
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"net/http"
+	"strings"
+)
+
+// requireParams returns an ErrConfigMissingParam error naming every one of
+// names that is not set in params.
+func requireParams(params map[string]string, names ...string) error {
+	var missing []string
+	for _, name := range names {
+		if params[name] == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		str := "invalid inputs: missing " + strings.Join(missing, ", ")
+		return walleterr.New(walleterr.ErrConfigMissingParam, str)
+	}
+	return nil
+}
+
+// invalidParam returns an ErrConfigInvalidParam error for the named param.
+func invalidParam(name string, cause error) error {
+	return walleterr.Wrap(walleterr.ErrConfigInvalidParam, cause, "invalid inputs: "+name)
+}
+
+// httpStatusKind maps the status code of a REST backend to an error kind.
+func httpStatusKind(status int) walleterr.ErrorKind {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return walleterr.ErrBackendThrottled
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return walleterr.ErrPermissionDenied
+	case status == http.StatusNotFound:
+		return walleterr.ErrKeyNotFound
+	case status >= 500 || status == http.StatusRequestTimeout:
+		return walleterr.ErrBackendUnavailable
+	default:
+		return walleterr.ErrConfigInvalidParam
+	}
+}
+
+// httpStatusError creates an Error for a failed REST call.
+func httpStatusError(status int, desc string) error {
+	return walleterr.New(httpStatusKind(status), fmt.Sprintf("%s (status %d)", desc, status))
+}
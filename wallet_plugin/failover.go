@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	crypto "github.com/remote-signing/wallet_plugin/key"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"sync"
+	"time"
+)
+
+// failoverSigner signs with the first healthy one of several endpoints that
+// hold the same key material, e.g. the replicas of an AWS multi-region key or
+// the same key imported into several GCP locations. Every endpoint has its
+// own circuit breaker so a dead region does not cost every call a timeout.
+type failoverSigner struct {
+	endpoints []*endpoint
+	pkey      *crypto.PublicKey
+	timeout   time.Duration // for each endpoint
+}
+
+// endpoint is one backend of a failoverSigner along with its health.
+type endpoint struct {
+	name    string
+	params  map[string]string
+	breaker *circuitBreaker
+
+	mu     sync.Mutex
+	signer Signer // nil until the backend could be reached
+}
+
+// newFailoverSigner builds a failoverSigner from the backends param, a JSON
+// array of objects. Each object holds the params of one endpoint and
+// inherits the top-level params it does not set, so only what differs, such
+// as the region and key id, has to be repeated.
+//
+// Every reachable endpoint must expose the same public key. An endpoint that
+// is unavailable at startup is checked once it can be reached.
+func newFailoverSigner(params map[string]string, c breakerConfig) (*failoverSigner, error) {
+	var entries []map[string]string
+	if err := json.Unmarshal([]byte(params["backends"]), &entries); err != nil {
+		return nil, invalidParam("backends", err)
+	}
+	if len(entries) == 0 {
+		return nil, walleterr.New(walleterr.ErrConfigMissingParam, "invalid inputs: backends is empty")
+	}
+
+	f := &failoverSigner{timeout: defaultCallTimeout}
+
+	var firstErr error
+	for i, entry := range entries {
+		merged := make(map[string]string, len(params)+len(entry))
+		for k, v := range params {
+			if k != "backends" {
+				merged[k] = v
+			}
+		}
+		for k, v := range entry {
+			merged[k] = v
+		}
+		name := endpointName(i, merged)
+		e := &endpoint{name: name, params: merged, breaker: newCircuitBreaker(name, c)}
+		f.endpoints = append(f.endpoints, e)
+
+		if _, err := f.load(e); err != nil {
+			if !retryable(err) {
+				f.close()
+				return nil, err
+			}
+			e.breaker.trip(err, time.Now())
+			if firstErr == nil {
+				firstErr = err
+			}
+			logger.Warn("backend unavailable", "backend", e.name, "err", err)
+		}
+	}
+	if f.pkey == nil {
+		return nil, firstErr
+	}
+	return f, nil
+}
+
+// endpointName describes an endpoint in logs and health reports.
+func endpointName(i int, params map[string]string) string {
+	if name := params["name"]; name != "" {
+		return name
+	}
+	for _, k := range []string{"region", "location_id", "vault_url", "vault_addr", "token_label", "keystore_path", "remote_endpoint"} {
+		if v := params[k]; v != "" {
+			return fmt.Sprintf("%s:%s", signerName(params["kms_type"]), v)
+		}
+	}
+	return fmt.Sprintf("%s:%d", signerName(params["kms_type"]), i)
+}
+
+// endpointError adds the endpoint name to err and keeps its kind.
+func endpointError(e *endpoint, err error) error {
+	return walleterr.Error{Err: walleterr.KindOf(err), Description: "backend " + e.name, Cause: err}
+}
+
+// load returns the signer of e, connecting to the backend first if that did
+// not succeed before. Concurrent calls wait for the same connection under
+// e.mu, so a backend is only built once.
+func (f *failoverSigner) load(e *endpoint) (Signer, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.signer != nil {
+		return e.signer, nil
+	}
+
+	signer, err := NewSigner(e.params["kms_type"], e.params)
+	if err != nil {
+		return nil, endpointError(e, err)
+	}
+	pkey := signer.PublicKey()
+	if f.pkey == nil {
+		f.pkey = pkey
+	} else if !pkey.Equal(f.pkey) {
+		closeSigner(signer)
+		str := fmt.Sprintf("backend %s holds key %s (%s) instead of %s (%s)", e.name,
+			pkey, NewAccountAddressFromPublicKey(pkey), f.pkey, NewAccountAddressFromPublicKey(f.pkey))
+		return nil, walleterr.New(walleterr.ErrConfigInvalidParam, str)
+	}
+	e.signer = signer
+	return signer, nil
+}
+
+// close closes the signers of the endpoints that could be reached.
+func (f *failoverSigner) close() {
+	for _, e := range f.endpoints {
+		e.mu.Lock()
+		closeSigner(e.signer)
+		e.signer = nil
+		e.mu.Unlock()
+	}
+}
+
+func (f *failoverSigner) PublicKey() *crypto.PublicKey {
+	return f.pkey
+}
+
+// SignDigest tries the endpoints in the configured order, skipping those
+// whose breaker is open, and returns the first signature it gets. A primary
+// that recovers is used again as soon as its breaker closes.
+func (f *failoverSigner) SignDigest(ctx context.Context, digest []byte) ([]byte, []byte, error) {
+	var lastErr, openErr error
+	for _, e := range f.endpoints {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := e.breaker.allow(time.Now()); err != nil {
+			if openErr == nil {
+				openErr = err
+			}
+			continue
+		}
+
+		var r, s []byte
+		start := time.Now()
+		signer, err := f.load(e)
+		if err == nil {
+			r, s, err = signWithTimeout(ctx, f.timeout, signer, digest)
+			if err != nil {
+				err = endpointError(e, err)
+			}
+		}
+		observeBackendCall(e.name, start, err)
+		e.breaker.record(err, time.Now())
+		if err == nil {
+			return r, s, nil
+		}
+		lastErr = err
+	}
+
+	switch {
+	case lastErr != nil:
+		return nil, nil, lastErr
+	case openErr != nil:
+		return nil, nil, openErr
+	}
+	return nil, nil, walleterr.Wrap(walleterr.ErrBackendUnavailable, ctx.Err(), "no backend was tried")
+}
+
+func (f *failoverSigner) health(now time.Time) []BackendHealth {
+	hs := make([]BackendHealth, 0, len(f.endpoints))
+	for _, e := range f.endpoints {
+		hs = append(hs, e.breaker.health(now))
+	}
+	return hs
+}
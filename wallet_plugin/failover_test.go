@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	RegisterSigner("fake", newTestBackend)
+}
+
+// testBackends holds the keys of the "fake" backend by the key param and
+// counts the signers it built that were not closed yet.
+var testBackends = struct {
+	sync.Mutex
+	keys map[string]*fakeSigner
+	open int
+}{keys: make(map[string]*fakeSigner)}
+
+// closingSigner is a signer of the "fake" backend.
+type closingSigner struct {
+	*fakeSigner
+}
+
+func (s closingSigner) close() {
+	testBackends.Lock()
+	testBackends.open--
+	testBackends.Unlock()
+}
+
+// newTestBackend fails with the kind of the fail param if set and otherwise
+// serves the key of the key param.
+func newTestBackend(params map[string]string) (Signer, error) {
+	testBackends.Lock()
+	defer testBackends.Unlock()
+	if kind := params["fail"]; kind != "" {
+		return nil, walleterr.New(walleterr.ErrorKind(kind), "fake backend")
+	}
+	testBackends.open++
+	return closingSigner{testBackends.keys[params["key"]]}, nil
+}
+
+func openTestBackends() int {
+	testBackends.Lock()
+	defer testBackends.Unlock()
+	return testBackends.open
+}
+
+func newFailoverWallet(t *testing.T, c breakerConfig, signers ...*faultySigner) (Wallet, *failoverSigner) {
+	t.Helper()
+	f := &failoverSigner{timeout: 50 * time.Millisecond}
+	for i, s := range signers {
+		name := endpointName(i, map[string]string{"kms_type": "fake"})
+		f.endpoints = append(f.endpoints, &endpoint{name: name, signer: s, breaker: newCircuitBreaker(name, c)})
+	}
+	f.pkey = signers[0].PublicKey()
+	w, err := newWallet(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.policy = testRetryPolicy
+	w.policy.callTimeout = w.policy.signDeadline
+	return w, f
+}
+
+func TestFailoverSigner(t *testing.T) {
+	signData, _ := hex.DecodeString("356355dae4212533ce182cbb31492a6c2665fcf8f17e089d929e7a3efd1d1ba1")
+	key := newFakeSigner(t)
+
+	tests := []struct {
+		name      string
+		primary   []kmsFault
+		secondary []kmsFault
+		calls     [2]int // after two Sign calls
+		kind      walleterr.ErrorKind
+	}{{
+		name:  "healthy primary",
+		calls: [2]int{2, 0},
+	}, {
+		name:    "primary error",
+		primary: []kmsFault{{code: "KMSInternalException"}},
+		calls:   [2]int{1, 2},
+	}, {
+		name:    "primary timeout",
+		primary: []kmsFault{{latency: time.Second}},
+		calls:   [2]int{1, 2},
+	}, {
+		name:    "primary permission denied",
+		primary: []kmsFault{{code: "AccessDeniedException"}},
+		calls:   [2]int{1, 2},
+	}, {
+		name:      "both denied",
+		primary:   []kmsFault{{code: "AccessDeniedException"}, {code: "AccessDeniedException"}},
+		secondary: []kmsFault{{code: "AccessDeniedException"}, {code: "AccessDeniedException"}},
+		calls:     [2]int{1, 1}, // then both breakers are open
+		kind:      walleterr.ErrPermissionDenied,
+	}}
+
+	for _, test := range tests {
+		primary := &faultySigner{fakeSigner: key, faults: test.primary}
+		secondary := &faultySigner{fakeSigner: key, faults: test.secondary}
+		w, _ := newFailoverWallet(t, breakerConfig{threshold: 1, openTimeout: time.Hour}, primary, secondary)
+
+		for i := 0; i < 2; i++ {
+			signature, err := w.Sign(signData)
+			if test.kind != "" {
+				if !errors.Is(err, test.kind) {
+					t.Errorf("%s: got error %v, want %v", test.name, err, test.kind)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+				continue
+			}
+			verifyRecoverable(t, signData, signature, w.PublicKey())
+		}
+		if got := [2]int{primary.count(), secondary.count()}; got != test.calls {
+			t.Errorf("%s: calls %v, want %v", test.name, got, test.calls)
+		}
+	}
+}
+
+func TestFailoverCooldown(t *testing.T) {
+	signData, _ := hex.DecodeString("356355dae4212533ce182cbb31492a6c2665fcf8f17e089d929e7a3efd1d1ba1")
+	key := newFakeSigner(t)
+	primary := &faultySigner{fakeSigner: key, faults: []kmsFault{{code: "KMSInternalException"}}}
+	secondary := &faultySigner{fakeSigner: key}
+	w, _ := newFailoverWallet(t, breakerConfig{threshold: 1, openTimeout: 50 * time.Millisecond}, primary, secondary)
+
+	if _, err := w.Sign(signData); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := w.Sign(signData); err != nil {
+		t.Fatal(err)
+	}
+	if primary.count() != 2 || secondary.count() != 1 {
+		t.Errorf("calls %d, %d: primary not back after its cooldown", primary.count(), secondary.count())
+	}
+}
+
+func TestAwsKmsFailover(t *testing.T) {
+	isolateAwsEnv(t)
+	signer := newFakeSigner(t)
+	primary, primarySrv := newFakeAwsKms(t, signer)
+	secondary, secondarySrv := newFakeAwsKms(t, signer)
+	_, otherSrv := newFakeAwsKms(t, newFakeSigner(t))
+
+	backends := func(urls ...string) string {
+		var entries []map[string]string
+		for i, url := range urls {
+			entries = append(entries, map[string]string{
+				"region":       []string{"us-east-1", "eu-west-1"}[i],
+				"endpoint_url": url,
+			})
+		}
+		b, _ := json.Marshal(entries)
+		return string(b)
+	}
+	params := map[string]string{
+		"kms_type":             "aws",
+		"access_key_id":        "AKIASTATIC",
+		"secret_access_key":    "secret",
+		"key_id":               "mrk-1234",
+		"breaker_threshold":    "1",
+		"breaker_open_timeout": "50ms",
+		"call_timeout":         "100ms",
+		"retry_base_delay":     "1ms",
+		"self_test":            "false", // the Sign calls below are counted
+	}
+
+	params["backends"] = backends(primarySrv.URL, otherSrv.URL)
+	if _, err := NewWallet(params); !errors.Is(err, walleterr.ErrConfigInvalidParam) {
+		t.Fatalf("NewWallet with different keys returned %v", err)
+	}
+
+	// The primary region is down at startup and is only checked once back.
+	primary.failures = map[string]string{"GetPublicKey": "KMSInternalException"}
+	params["backends"] = backends(primarySrv.URL, secondarySrv.URL)
+	iWallet, err := NewWallet(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	walletInst := iWallet.(walletImpl)
+
+	signData, _ := hex.DecodeString("356355dae4212533ce182cbb31492a6c2665fcf8f17e089d929e7a3efd1d1ba1")
+	if _, err := walletInst.Sign(signData); err != nil {
+		t.Fatal(err)
+	}
+	if primary.count("Sign") != 0 || secondary.count("Sign") != 1 {
+		t.Errorf("Sign calls %d, %d", primary.count("Sign"), secondary.count("Sign"))
+	}
+
+	primary.failures = nil
+	time.Sleep(50 * time.Millisecond)
+	signature, err := walletInst.Sign(signData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyRecoverable(t, signData, signature, walletInst.PublicKey())
+	if primary.count("Sign") != 1 || secondary.count("Sign") != 1 {
+		t.Errorf("Sign calls %d, %d after the primary came back", primary.count("Sign"), secondary.count("Sign"))
+	}
+
+	primary.faults = []kmsFault{{latency: time.Second}}
+	if _, err := walletInst.Sign(signData); err != nil {
+		t.Fatal(err)
+	}
+	if secondary.count("Sign") != 2 {
+		t.Errorf("no failover on a primary timeout")
+	}
+}
+
+func TestFailoverLoad(t *testing.T) {
+	testBackends.Lock()
+	testBackends.keys["a"], testBackends.keys["b"] = newFakeSigner(t), newFakeSigner(t)
+	testBackends.Unlock()
+	c := breakerConfig{threshold: 1, openTimeout: time.Hour}
+	newSigner := func(backends string) (*failoverSigner, error) {
+		return newFailoverSigner(map[string]string{"kms_type": "fake", "backends": backends}, c)
+	}
+
+	// A backend that fails for good closes the ones loaded before it.
+	if _, err := newSigner(`[{"key":"a"},{"fail":"ErrPermissionDenied"}]`); !errors.Is(err, walleterr.ErrPermissionDenied) {
+		t.Fatalf("newFailoverSigner = %v, want ErrPermissionDenied", err)
+	}
+	if n := openTestBackends(); n != 0 {
+		t.Fatalf("%d signers left open by a failed newFailoverSigner", n)
+	}
+
+	// Concurrent Sign calls load a backend that came back only once.
+	f, err := newSigner(`[{"key":"a","fail":"ErrBackendUnavailable"},{"key":"a"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.endpoints[0].params["fail"] = ""
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := f.load(f.endpoints[0]); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := openTestBackends(); n != 2 {
+		t.Errorf("%d signers open for 2 backends", n)
+	}
+	f.close()
+
+	// A backend that comes back with another key is closed.
+	f, err = newSigner(`[{"key":"b","fail":"ErrBackendUnavailable"},{"key":"a"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.endpoints[0].params["fail"] = ""
+	if _, err := f.load(f.endpoints[0]); !errors.Is(err, walleterr.ErrConfigInvalidParam) {
+		t.Fatalf("load of another key = %v, want ErrConfigInvalidParam", err)
+	}
+	f.close()
+	if n := openTestBackends(); n != 0 {
+		t.Fatalf("%d signers left open", n)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	cloudkms "cloud.google.com/go/kms/apiv1"
+	"cloud.google.com/go/kms/apiv1/kmspb"
+	"context"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/googleapis/gax-go/v2"
+	crypto "github.com/remote-signing/wallet_plugin/key"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math/big"
+	"os"
+	"strings"
+)
+
+func init() {
+	RegisterSigner("gcp", newGcpSigner, GCP)
+}
+
+// ///////////////////
+// GG CLOUD - KMS
+type KMS struct {
+	parentName string
+	opts       []option.ClientOption
+	pkey       *crypto.PublicKey
+	kmsClient  *cloudkms.KeyManagementClient
+}
+
+func newGcpSigner(params map[string]string) (Signer, error) {
+	if err := requireParams(params, "project_id", "location_id", "key_ring", "key", "key_version"); err != nil {
+		return nil, err
+	}
+
+	opts, source, err := gcpClientOptions(context.Background(), params)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("gcp credentials", "source", source)
+
+	gcpKMS := &KMS{
+		parentName: fmt.Sprintf("projects/%s/locations/%s/keyRings/%s/cryptoKeys/%s/cryptoKeyVersions/%s",
+			params["project_id"], params["location_id"], params["key_ring"], params["key"], params["key_version"]),
+		opts: opts,
+	}
+
+	err = NewKMSCrypto(gcpKMS)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcpKMS, nil
+}
+
+// gcpClientOptions picks the credentials for the KMS client and describes
+// where they came from. An inline base64 service account JSON wins over a
+// credential file, and without either Application Default Credentials are
+// used (GOOGLE_APPLICATION_CREDENTIALS, the gcloud well-known file or the GCE
+// metadata server, which also serves GKE workload identity). With
+// impersonate_service_account those credentials only mint tokens for the
+// target service account.
+func gcpClientOptions(ctx context.Context, params map[string]string) ([]option.ClientOption, string, error) {
+	var base option.ClientOption
+	var source string
+	switch {
+	case params["credential_json"] != "":
+		credJson, err := base64.StdEncoding.DecodeString(params["credential_json"])
+		if err != nil {
+			return nil, "", invalidParam("credential_json", err)
+		}
+		if !json.Valid(credJson) {
+			return nil, "", invalidParam("credential_json", errors.New("not a JSON credential"))
+		}
+		base = option.WithCredentialsJSON(credJson)
+		source = "inline credential_json"
+	case params["credential_path"] != "":
+		base = option.WithCredentialsFile(params["credential_path"])
+		source = "credential file " + params["credential_path"]
+	default:
+		creds, err := google.FindDefaultCredentials(ctx, cloudkms.DefaultAuthScopes()...)
+		if err != nil {
+			return nil, "", walleterr.Wrap(walleterr.ErrPermissionDenied, err, "application default credentials")
+		}
+		base = option.WithCredentials(creds)
+		if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+			source = "application default credentials from GOOGLE_APPLICATION_CREDENTIALS=" + path
+		} else if len(creds.JSON) == 0 {
+			source = "application default credentials from the metadata server"
+		} else {
+			source = "application default credentials from the gcloud well-known file"
+		}
+	}
+
+	target := params["impersonate_service_account"]
+	if target == "" {
+		return []option.ClientOption{base}, source, nil
+	}
+
+	var delegates []string
+	if d := params["impersonate_delegates"]; d != "" {
+		delegates = strings.Split(d, ",")
+	}
+	ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: target,
+		Scopes:          cloudkms.DefaultAuthScopes(),
+		Delegates:       delegates,
+	}, base)
+	if err != nil {
+		return nil, "", invalidParam("impersonate_service_account", err)
+	}
+	return []option.ClientOption{option.WithTokenSource(ts)}, source + " impersonating " + target, nil
+}
+
+func NewKMSCrypto(conf *KMS) error {
+	kmsClient, err := cloudkms.NewKeyManagementClient(context.Background(), conf.opts...)
+	if err != nil {
+		return gcpError(err, "Google KMS client")
+	}
+
+	dresp, err := kmsClient.GetPublicKey(context.Background(), &kmspb.GetPublicKeyRequest{Name: conf.parentName})
+	if err != nil {
+		kmsClient.Close()
+		return gcpError(err, "Google KMS GetPublicKey")
+	}
+
+	if dresp.Algorithm != kmspb.CryptoKeyVersion_EC_SIGN_SECP256K1_SHA256 {
+		kmsClient.Close()
+		str := fmt.Sprintf("Google KMS key %q algorithm %s instead of %s", conf.parentName,
+			dresp.Algorithm, kmspb.CryptoKeyVersion_EC_SIGN_SECP256K1_SHA256)
+		return walleterr.New(walleterr.ErrKeyAlgorithmMismatch, str)
+	}
+
+	conf.pkey, err = parsePemPublicKey([]byte(dresp.Pem))
+	if err != nil {
+		kmsClient.Close()
+		return walleterr.Wrap(walleterr.ErrKeyAlgorithmMismatch, err, fmt.Sprintf("Google KMS public key %q", conf.parentName))
+	}
+
+	conf.kmsClient = kmsClient
+	return nil
+}
+
+func (t *KMS) PublicKey() *crypto.PublicKey {
+	return t.pkey
+}
+
+func (t *KMS) SignDigest(ctx context.Context, data []byte) ([]byte, []byte, error) {
+	signData, err := t.kmsClient.AsymmetricSign(ctx, &kmspb.AsymmetricSignRequest{Name: t.parentName, Digest: &kmspb.Digest{
+		Digest: &kmspb.Digest_Sha256{
+			Sha256: data[:],
+		},
+	}}, gax.WithRetry(nil)) // the wallet retries within its signing deadline
+
+	if err != nil {
+		return nil, nil, gcpError(err, "Google KMS AsymmetricSign")
+	}
+
+	var params struct{ R, S *big.Int }
+	_, err = asn1.Unmarshal(signData.Signature, &params)
+	if err != nil {
+		return nil, nil, walleterr.Wrap(walleterr.ErrSignatureMalformed, err, "Google KMS asymmetric signature encoding")
+	}
+	var rLen, sLen int // byte size
+	if params.R != nil {
+		rLen = (params.R.BitLen() + 7) / 8
+	}
+	if params.S != nil {
+		sLen = (params.S.BitLen() + 7) / 8
+	}
+	if rLen == 0 || rLen > 32 || sLen == 0 || sLen > 32 {
+		str := fmt.Sprintf("Google KMS asymmetric signature with %d-byte r and %d-byte s denied on size", rLen, sLen)
+		return nil, nil, walleterr.New(walleterr.ErrSignatureMalformed, str)
+	}
+
+	return params.R.Bytes(), params.S.Bytes(), nil
+}
+
+// DescribeKey reports the key version as Cloud KMS keeps it. The algorithm
+// of the version fixes the purpose of its key to ASYMMETRIC_SIGN.
+func (t *KMS) DescribeKey(ctx context.Context) (KeyDescription, error) {
+	v, err := t.kmsClient.GetCryptoKeyVersion(ctx, &kmspb.GetCryptoKeyVersionRequest{Name: t.parentName})
+	if err != nil {
+		return KeyDescription{}, gcpError(err, "Google KMS GetCryptoKeyVersion")
+	}
+	desc := KeyDescription{
+		KeyID:           v.Name,
+		KeySpec:         v.Algorithm.String(),
+		KeyUsage:        kmspb.CryptoKey_ASYMMETRIC_SIGN.String(),
+		KeyState:        v.State.String(),
+		ProtectionLevel: v.ProtectionLevel.String(),
+		Origin:          "GENERATED",
+	}
+	if v.ImportJob != "" {
+		desc.Origin = "IMPORTED"
+	}
+	if v.ProtectionLevel == kmspb.ProtectionLevel_EXTERNAL || v.ProtectionLevel == kmspb.ProtectionLevel_EXTERNAL_VPC {
+		desc.ProtectionLevel = "EXTERNAL"
+	}
+
+	if v.Algorithm != kmspb.CryptoKeyVersion_EC_SIGN_SECP256K1_SHA256 {
+		str := fmt.Sprintf("Google KMS key %q algorithm %s instead of %s", t.parentName,
+			v.Algorithm, kmspb.CryptoKeyVersion_EC_SIGN_SECP256K1_SHA256)
+		return desc, walleterr.New(walleterr.ErrKeyAlgorithmMismatch, str)
+	}
+	if v.State != kmspb.CryptoKeyVersion_ENABLED {
+		str := fmt.Sprintf("Google KMS key %q is %s", t.parentName, v.State)
+		return desc, walleterr.New(walleterr.ErrKeyStateInvalid, str)
+	}
+	return desc, nil
+}
+
+// gcpError wraps an error of the Cloud KMS client into the matching kind.
+func gcpError(err error, desc string) error {
+	switch status.Code(err) {
+	case codes.ResourceExhausted:
+		return walleterr.Wrap(walleterr.ErrBackendThrottled, err, desc)
+	case codes.PermissionDenied, codes.Unauthenticated:
+		return walleterr.Wrap(walleterr.ErrPermissionDenied, err, desc)
+	case codes.NotFound:
+		return walleterr.Wrap(walleterr.ErrKeyNotFound, err, desc)
+	case codes.FailedPrecondition:
+		return walleterr.Wrap(walleterr.ErrKeyStateInvalid, err, desc)
+	case codes.InvalidArgument:
+		return walleterr.Wrap(walleterr.ErrConfigInvalidParam, err, desc)
+	}
+	return walleterr.Wrap(walleterr.ErrBackendUnavailable, err, desc)
+}
+
+func (t *KMS) close() {
+	_ = t.kmsClient.Close()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// fakeGcpKms implements the GetPublicKey, GetCryptoKeyVersion and
+// AsymmetricSign RPCs of Cloud KMS backed by a fakeSigner.
+type fakeGcpKms struct {
+	kmspb.UnimplementedKeyManagementServiceServer
+	signer    *fakeSigner
+	pem       string
+	algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm
+	state     kmspb.CryptoKeyVersion_CryptoKeyVersionState // ENABLED when unset
+	err       error                                        // returned by every RPC when set
+}
+
+func (f *fakeGcpKms) GetPublicKey(_ context.Context, req *kmspb.GetPublicKeyRequest) (*kmspb.PublicKey, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &kmspb.PublicKey{
+		Pem:       f.pem,
+		Algorithm: f.algorithm,
+		Name:      req.Name,
+	}, nil
+}
+
+func (f *fakeGcpKms) GetCryptoKeyVersion(_ context.Context, req *kmspb.GetCryptoKeyVersionRequest) (*kmspb.CryptoKeyVersion, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	state := f.state
+	if state == kmspb.CryptoKeyVersion_CRYPTO_KEY_VERSION_STATE_UNSPECIFIED {
+		state = kmspb.CryptoKeyVersion_ENABLED
+	}
+	return &kmspb.CryptoKeyVersion{
+		Name:            req.Name,
+		State:           state,
+		ProtectionLevel: kmspb.ProtectionLevel_HSM,
+		Algorithm:       f.algorithm,
+		ImportJob:       "projects/p/locations/l/keyRings/r/importJobs/job",
+	}, nil
+}
+
+func (f *fakeGcpKms) AsymmetricSign(ctx context.Context, req *kmspb.AsymmetricSignRequest) (*kmspb.AsymmetricSignResponse, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	rb, sb, _ := f.signer.SignDigest(ctx, req.Digest.GetSha256())
+	der, _ := asn1.Marshal(struct{ R, S *big.Int }{new(big.Int).SetBytes(rb), new(big.Int).SetBytes(sb)})
+	return &kmspb.AsymmetricSignResponse{Signature: der, Name: req.Name}, nil
+}
+
+// newFakeGcpKms starts an in-process Cloud KMS and returns the client options
+// to reach it.
+func newFakeGcpKms(t *testing.T, signer *fakeSigner) (*fakeGcpKms, []option.ClientOption) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	fake := &fakeGcpKms{
+		signer:    signer,
+		pem:       string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: fakeDerPublicKey(t, signer)})),
+		algorithm: kmspb.CryptoKeyVersion_EC_SIGN_SECP256K1_SHA256,
+	}
+	kmspb.RegisterKeyManagementServiceServer(srv, fake)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	return fake, []option.ClientOption{
+		option.WithEndpoint(lis.Addr().String()),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	}
+}
+
+func TestGcpKms(t *testing.T) {
+	signer := newFakeSigner(t)
+	signer.highS = true
+	_, opts := newFakeGcpKms(t, signer)
+	gcpKMS := &KMS{
+		parentName: "projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1",
+		opts:       opts,
+	}
+	if err := NewKMSCrypto(gcpKMS); err != nil {
+		t.Fatal(err)
+	}
+	w, err := newWallet(gcpKMS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signData, _ := hex.DecodeString("356355dae4212533ce182cbb31492a6c2665fcf8f17e089d929e7a3efd1d1ba1")
+	signature, err := w.Sign(signData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyRecoverable(t, signData, signature, signer.PublicKey().SerializeCompressed())
+}
+
+func TestGcpKmsErrors(t *testing.T) {
+	signer := newFakeSigner(t)
+	fake, opts := newFakeGcpKms(t, signer)
+
+	for name, tc := range map[string]struct {
+		algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm
+		err       error
+		kind      walleterr.ErrorKind
+	}{
+		"wrong algorithm": {algorithm: kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256, kind: walleterr.ErrKeyAlgorithmMismatch},
+		"quota":           {err: status.Error(codes.ResourceExhausted, "quota"), kind: walleterr.ErrBackendThrottled},
+		"denied":          {err: status.Error(codes.PermissionDenied, "denied"), kind: walleterr.ErrPermissionDenied},
+		"destroyed":       {err: status.Error(codes.FailedPrecondition, "destroyed"), kind: walleterr.ErrKeyStateInvalid},
+	} {
+		fake.algorithm, fake.err = tc.algorithm, tc.err
+		gcpKMS := &KMS{
+			parentName: "projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1",
+			opts:       opts,
+		}
+		err := NewKMSCrypto(gcpKMS)
+		if !errors.Is(err, tc.kind) {
+			t.Errorf("%s: NewKMSCrypto returned %v, want %v", name, err, tc.kind)
+		}
+		if tc.err != nil && status.Code(errors.Unwrap(err)) != status.Code(tc.err) {
+			t.Errorf("%s: gRPC status not reachable from %v", name, err)
+		}
+		if gcpKMS.kmsClient != nil {
+			t.Errorf("%s: NewKMSCrypto kept the client of a failed key", name)
+		}
+	}
+}
+
+func TestGcpClientOptions(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	adc := filepath.Join(dir, "adc.json")
+	credJson := `{"type":"authorized_user","client_id":"id","client_secret":"secret","refresh_token":"token"}`
+	if err := os.WriteFile(adc, []byte(credJson), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range map[string]struct {
+		params map[string]string
+		source string
+	}{
+		"inline json": {
+			params: map[string]string{"credential_json": base64.StdEncoding.EncodeToString([]byte(credJson))},
+			source: "inline credential_json",
+		},
+		"credential file": {
+			params: map[string]string{"credential_path": adc},
+			source: "credential file " + adc,
+		},
+		"adc": {
+			params: map[string]string{},
+			source: "application default credentials from GOOGLE_APPLICATION_CREDENTIALS=" + adc,
+		},
+		"impersonation": {
+			params: map[string]string{"impersonate_service_account": "signer@p.iam.gserviceaccount.com"},
+			source: "impersonating signer@p.iam.gserviceaccount.com",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", adc)
+			opts, source, err := gcpClientOptions(ctx, tc.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(opts) != 1 || !strings.HasSuffix(source, tc.source) {
+				t.Fatalf("got %d options from %q", len(opts), source)
+			}
+		})
+	}
+
+	if _, _, err := gcpClientOptions(ctx, map[string]string{"credential_json": "not base64!"}); err == nil {
+		t.Fatal("gcpClientOptions accepted invalid credential_json")
+	}
+}
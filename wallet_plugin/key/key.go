@@ -1,7 +1,10 @@
 package crypto
 
 import (
+	stdecdsa "crypto/ecdsa"
 	"encoding/hex"
+	"errors"
+	"math/big"
 
 	"github.com/remote-signing/wallet_plugin/secp256k1"
 	"github.com/remote-signing/wallet_plugin/sha3"
@@ -12,7 +15,62 @@ const (
 	PrivateKeyLen = 32
 )
 
-// TODO add 'func ToECDSA() ecdsa.PrivateKey' if needed
+// PrivateKey is a type representing a private key.
+type PrivateKey struct {
+	real *secp256k1.PrivateKey
+}
+
+// ParsePrivateKey parses the 32-byte big-endian integer to a private key.
+// It fails if the value is zero or not less than the curve order.
+func ParsePrivateKey(b []byte) (*PrivateKey, error) {
+	if len(b) != PrivateKeyLen {
+		return nil, errors.New("wrong private key length")
+	}
+	var k secp256k1.ModNScalar
+	if overflow := k.SetByteSlice(b); overflow || k.IsZero() {
+		return nil, errors.New("private key is out of range")
+	}
+	return &PrivateKey{real: secp256k1.NewPrivateKey(&k)}, nil
+}
+
+// GenerateKeyPair generates a private and public key pair.
+func GenerateKeyPair() (*PrivateKey, *PublicKey) {
+	priv, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		panic(err)
+	}
+	privKey := &PrivateKey{real: priv}
+	return privKey, privKey.PublicKey()
+}
+
+// Bytes serializes the private key as a 32-byte big-endian integer.
+func (key *PrivateKey) Bytes() []byte {
+	return key.real.Serialize()
+}
+
+// PublicKey returns the public key corresponding to this private key.
+func (key *PrivateKey) PublicKey() *PublicKey {
+	return &PublicKey{real: key.real.PubKey()}
+}
+
+// ToECDSA returns the private key as a crypto/ecdsa private key.
+func (key *PrivateKey) ToECDSA() *stdecdsa.PrivateKey {
+	return &stdecdsa.PrivateKey{
+		PublicKey: *key.real.PubKey().ToECDSA(),
+		D:         new(big.Int).SetBytes(key.Bytes()),
+	}
+}
+
+// Zeroize clears the private key from memory. The key can't be used
+// afterwards.
+func (key *PrivateKey) Zeroize() {
+	key.real.Zero()
+}
+
+// String returns the string representation. It never shows the key itself.
+func (key *PrivateKey) String() string {
+	return "[private key]"
+}
 
 const (
 	// PublicKeyLenCompressed is the byte length of a compressed public key
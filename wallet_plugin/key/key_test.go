@@ -0,0 +1,101 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/remote-signing/wallet_plugin/ecdsa"
+	"github.com/remote-signing/wallet_plugin/secp256k1"
+)
+
+func TestParsePrivateKey(t *testing.T) {
+	priv, pub := GenerateKeyPair()
+	parsed, err := ParsePrivateKey(priv.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.PublicKey().Equal(pub) {
+		t.Fatalf("parsed key has pubkey %s, want %s", parsed.PublicKey(), pub)
+	}
+	if parsed.ToECDSA().D.Cmp(priv.ToECDSA().D) != 0 {
+		t.Fatal("ToECDSA returned different scalars")
+	}
+
+	n := secp256k1.Params().N.Bytes()
+	for name, b := range map[string][]byte{
+		"short": make([]byte, PrivateKeyLen-1),
+		"zero":  make([]byte, PrivateKeyLen),
+		"order": n,
+	} {
+		if _, err := ParsePrivateKey(b); err == nil {
+			t.Errorf("%s: ParsePrivateKey accepted %x", name, b)
+		}
+	}
+}
+
+func TestPrivateKeyZeroize(t *testing.T) {
+	priv, _ := GenerateKeyPair()
+	priv.Zeroize()
+	if !bytes.Equal(priv.Bytes(), make([]byte, PrivateKeyLen)) {
+		t.Fatalf("key not cleared: %x", priv.Bytes())
+	}
+}
+
+func TestSignRFC6979(t *testing.T) {
+	// Well known secp256k1 RFC6979 vector with d = 1.
+	d, _ := hex.DecodeString("0000000000000000000000000000000000000000000000000000000000000001")
+	priv, err := ParsePrivateKey(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256([]byte("Satoshi Nakamoto"))
+
+	sig, err := priv.Sign(hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := sig.SerializeRS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "934b1ea10a4b3c1757e2b0c017d0b6143ce3c9a7e6a4a49860d7a6ab210ee3d8" +
+		"2442ce9d2b916064108014783e923ec36b49743e2ffa1c4496f01a512aafd9e5"
+	if got := hex.EncodeToString(rs); got != want {
+		t.Fatalf("signature %s, want %s", got, want)
+	}
+}
+
+func TestSignRecover(t *testing.T) {
+	priv, pub := GenerateKeyPair()
+	for i := 0; i < 32; i++ {
+		hash := sha256.Sum256([]byte{byte(i)})
+		sig, err := priv.Sign(hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		recovered, err := sig.RecoverPublicKey(hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !recovered.Equal(pub) {
+			t.Fatalf("recovered %s, want %s", recovered, pub)
+		}
+
+		rs, _ := sig.SerializeRS()
+		var r, s secp256k1.ModNScalar
+		r.SetByteSlice(rs[:32])
+		s.SetByteSlice(rs[32:])
+		if s.IsOverHalfOrder() {
+			t.Fatalf("signature %s has high S", sig)
+		}
+		if !ecdsa.NewSignature(&r, &s).Verify(hash[:], pub.real) {
+			t.Fatalf("signature %s does not verify", sig)
+		}
+	}
+
+	if _, err := priv.Sign(nil); err == nil {
+		t.Fatal("Sign accepted an empty hash")
+	}
+}
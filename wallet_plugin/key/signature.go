@@ -5,6 +5,7 @@ import (
 	"errors"
 
 	"github.com/remote-signing/wallet_plugin/ecdsa"
+	"github.com/remote-signing/wallet_plugin/secp256k1"
 )
 
 const (
@@ -127,6 +128,18 @@ func (sig *Signature) SerializeRSV() ([]byte, error) {
 	return s, nil
 }
 
+// Sign makes a recoverable signature for the hash of a message with the
+// private key. The nonce is derived deterministically as in RFC6979 and S is
+// always in the lower half of the curve order.
+func (key *PrivateKey) Sign(hash []byte) (*Signature, error) {
+	if len(hash) == 0 || len(hash) > HashLen {
+		return nil, errors.New("message hash is illegal")
+	}
+	// SignCompact returns [V|R|S] with V already offset by 27, the same layout
+	// kept in Signature.
+	return &Signature{bytes: ecdsa.SignCompact(key.real, hash, false)}, nil
+}
+
 // RecoverPublicKey recovers a public key from the hash of message and its signature.
 func (sig *Signature) RecoverPublicKey(hash []byte) (*PublicKey, error) {
 	if !sig.HasV() {
@@ -142,6 +155,23 @@ func (sig *Signature) RecoverPublicKey(hash []byte) (*PublicKey, error) {
 	return &PublicKey{real: pk}, err
 }
 
+// Verify checks that the signature is valid for the hash of a message and the
+// public key. The V value is not used.
+func (sig *Signature) Verify(hash []byte, pubKey *PublicKey) bool {
+	rs, err := sig.SerializeRS()
+	if err != nil || len(hash) == 0 || len(hash) > HashLen || pubKey == nil {
+		return false
+	}
+	var r, s secp256k1.ModNScalar
+	if overflow := r.SetByteSlice(rs[:32]); overflow {
+		return false
+	}
+	if overflow := s.SetByteSlice(rs[32:]); overflow {
+		return false
+	}
+	return ecdsa.NewSignature(&r, &s).Verify(hash, pubKey.real)
+}
+
 // String returns the string representation.
 func (sig *Signature) String() string {
 	if sig == nil || len(sig.bytes) == 0 {
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	crypto "github.com/remote-signing/wallet_plugin/key"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+	"os"
+	"strings"
+)
+
+func init() {
+	RegisterSigner("keystore", newKeyStoreSigner)
+}
+
+// keyStoreData is the goloop keystore JSON, the same format the node reads
+// from KEY_STORE_FILENAME.
+type keyStoreData struct {
+	Address  string         `json:"address"`
+	ID       string         `json:"id"`
+	Version  int            `json:"version"`
+	CoinType string         `json:"coinType"`
+	Crypto   keyStoreCrypto `json:"crypto"`
+}
+
+type keyStoreCrypto struct {
+	Cipher       string               `json:"cipher"`
+	CipherParams keyStoreCipherParams `json:"cipherparams"`
+	CipherText   string               `json:"ciphertext"`
+	KDF          string               `json:"kdf"`
+	KDFParams    json.RawMessage      `json:"kdfparams"`
+	MAC          string               `json:"mac"`
+}
+
+type keyStoreCipherParams struct {
+	IV string `json:"iv"`
+}
+
+type keyStoreScryptParams struct {
+	DkLen int    `json:"dklen"`
+	N     int    `json:"n"`
+	R     int    `json:"r"`
+	P     int    `json:"p"`
+	Salt  string `json:"salt"`
+}
+
+type keyStorePbkdf2Params struct {
+	DkLen int    `json:"dklen"`
+	C     int    `json:"c"`
+	PRF   string `json:"prf"`
+	Salt  string `json:"salt"`
+}
+
+// keyStoreSigner signs locally with the private key decrypted from a goloop
+// keystore file.
+type keyStoreSigner struct {
+	path string
+	priv *crypto.PrivateKey
+	pkey *crypto.PublicKey
+}
+
+func newKeyStoreSigner(params map[string]string) (Signer, error) {
+	if err := requireParams(params, "keystore_path"); err != nil {
+		return nil, err
+	}
+	keyStorePath := params["keystore_path"]
+
+	password, err := keyStorePassword(params)
+	if err != nil {
+		return nil, err
+	}
+
+	ksBytes, err := os.ReadFile(keyStorePath)
+	if err != nil {
+		return nil, invalidParam("keystore_path", err)
+	}
+
+	privBytes, err := decryptKeyStore(ksBytes, password)
+	if err != nil {
+		return nil, walleterr.Wrap(walleterr.ErrConfigInvalidParam, err, "invalid keystore "+keyStorePath)
+	}
+
+	priv, err := crypto.ParsePrivateKey(privBytes)
+	for i := range privBytes {
+		privBytes[i] = 0
+	}
+	if err != nil {
+		return nil, walleterr.Wrap(walleterr.ErrKeyAlgorithmMismatch, err, "keystore private key")
+	}
+	pkey := priv.PublicKey()
+
+	var ks keyStoreData
+	_ = json.Unmarshal(ksBytes, &ks)
+	if addr := NewAccountAddressFromPublicKey(pkey); ks.Address != "" && ks.Address != addr.String() {
+		str := fmt.Sprintf("keystore address %s does not match key address %s", ks.Address, addr)
+		return nil, walleterr.New(walleterr.ErrConfigInvalidParam, str)
+	}
+
+	return &keyStoreSigner{path: keyStorePath, priv: priv, pkey: pkey}, nil
+}
+
+// keyStorePassword reads the keystore password from password_file or from the
+// environment variable named by password_env.
+func keyStorePassword(params map[string]string) ([]byte, error) {
+	if passwordFile := params["password_file"]; passwordFile != "" {
+		b, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return nil, invalidParam("password_file", err)
+		}
+		return bytes.TrimRight(b, "\r\n"), nil
+	}
+	if passwordEnv := params["password_env"]; passwordEnv != "" {
+		password, ok := os.LookupEnv(passwordEnv)
+		if !ok {
+			str := fmt.Sprintf("invalid inputs: environment variable %s is not set", passwordEnv)
+			return nil, walleterr.New(walleterr.ErrConfigMissingParam, str)
+		}
+		return []byte(password), nil
+	}
+	str := "invalid inputs: missing password_file or password_env"
+	return nil, walleterr.New(walleterr.ErrConfigMissingParam, str)
+}
+
+// decryptKeyStore returns the private key held in a goloop keystore.
+func decryptKeyStore(ksBytes []byte, password []byte) ([]byte, error) {
+	var ks keyStoreData
+	if err := json.Unmarshal(ksBytes, &ks); err != nil {
+		return nil, err
+	}
+	if ks.CoinType != "" && ks.CoinType != "icx" {
+		return nil, fmt.Errorf("keystore coin type %q is not supported", ks.CoinType)
+	}
+	if ks.Crypto.Cipher != "aes-128-ctr" {
+		return nil, fmt.Errorf("keystore cipher %q is not supported", ks.Crypto.Cipher)
+	}
+
+	derivedKey, err := keyStoreDeriveKey(&ks.Crypto, password)
+	if err != nil {
+		return nil, err
+	}
+
+	cipherText, err := hex.DecodeString(ks.Crypto.CipherText)
+	if err != nil {
+		return nil, err
+	}
+	mac, err := hex.DecodeString(ks.Crypto.MAC)
+	if err != nil {
+		return nil, err
+	}
+
+	calculatedMac := crypto.SHA3Sum256(append(append([]byte{}, derivedKey[16:32]...), cipherText...))
+	if !hmac.Equal(calculatedMac, mac) {
+		return nil, walleterr.New(walleterr.ErrPermissionDenied, "keystore MAC mismatch, wrong password")
+	}
+
+	iv, err := hex.DecodeString(ks.Crypto.CipherParams.IV)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(derivedKey[:16])
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, errors.New("keystore IV has an invalid length")
+	}
+
+	plain := make([]byte, len(cipherText))
+	cipher.NewCTR(block, iv).XORKeyStream(plain, cipherText)
+	if len(plain) != crypto.PrivateKeyLen {
+		return nil, errors.New("keystore holds an invalid private key")
+	}
+	return plain, nil
+}
+
+func keyStoreDeriveKey(c *keyStoreCrypto, password []byte) ([]byte, error) {
+	switch strings.ToLower(c.KDF) {
+	case "scrypt":
+		var p keyStoreScryptParams
+		if err := json.Unmarshal(c.KDFParams, &p); err != nil {
+			return nil, err
+		}
+		salt, err := hex.DecodeString(p.Salt)
+		if err != nil {
+			return nil, err
+		}
+		if p.DkLen < 32 {
+			return nil, errors.New("keystore dklen is too short")
+		}
+		return scrypt.Key(password, salt, p.N, p.R, p.P, p.DkLen)
+	case "pbkdf2":
+		var p keyStorePbkdf2Params
+		if err := json.Unmarshal(c.KDFParams, &p); err != nil {
+			return nil, err
+		}
+		if p.PRF != "hmac-sha256" {
+			return nil, fmt.Errorf("keystore pbkdf2 prf %q is not supported", p.PRF)
+		}
+		salt, err := hex.DecodeString(p.Salt)
+		if err != nil {
+			return nil, err
+		}
+		if p.DkLen < 32 || p.C <= 0 {
+			return nil, errors.New("keystore pbkdf2 parameters are invalid")
+		}
+		return pbkdf2.Key(password, salt, p.C, p.DkLen, sha256.New), nil
+	default:
+		return nil, fmt.Errorf("keystore kdf %q is not supported", c.KDF)
+	}
+}
+
+func (s *keyStoreSigner) PublicKey() *crypto.PublicKey {
+	return s.pkey
+}
+
+// DescribeKey reports the key decrypted from the keystore file, which is held
+// in the memory of the process.
+func (s *keyStoreSigner) DescribeKey(_ context.Context) (KeyDescription, error) {
+	return KeyDescription{
+		KeyID:           s.path,
+		KeySpec:         "secp256k1",
+		KeyUsage:        "sign",
+		KeyState:        "ENABLED",
+		ProtectionLevel: "SOFTWARE",
+		Origin:          "KEYSTORE",
+	}, nil
+}
+
+func (s *keyStoreSigner) SignDigest(_ context.Context, digest []byte) ([]byte, []byte, error) {
+	if len(digest) != crypto.HashLen {
+		return nil, nil, walleterr.New(walleterr.ErrDigestLength, "message hash is illegal")
+	}
+	sig, err := s.priv.Sign(digest)
+	if err != nil {
+		return nil, nil, walleterr.Wrap(walleterr.ErrSignatureMalformed, err, "keystore sign")
+	}
+	rs, err := sig.SerializeRS()
+	if err != nil {
+		return nil, nil, walleterr.Wrap(walleterr.ErrSignatureMalformed, err, "keystore sign")
+	}
+	return rs[:32], rs[32:], nil
+}
+
+// close clears the private key from memory once a reload replaced s.
+func (s *keyStoreSigner) close() {
+	s.priv.Zeroize()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	crypto "github.com/remote-signing/wallet_plugin/key"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// writeKeyStore encrypts priv the way goloop does and writes the keystore
+// JSON into a temporary file.
+func writeKeyStore(t *testing.T, priv *crypto.PrivateKey, password, kdf string) string {
+	t.Helper()
+	salt := make([]byte, 32)
+	iv := make([]byte, 16)
+	_, _ = rand.Read(salt)
+	_, _ = rand.Read(iv)
+
+	var derivedKey []byte
+	var kdfParams interface{}
+	switch kdf {
+	case "scrypt":
+		// Cheaper than goloop's n=16384 to keep the test fast.
+		var err error
+		derivedKey, err = scrypt.Key([]byte(password), salt, 1024, 8, 1, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kdfParams = keyStoreScryptParams{DkLen: 32, N: 1024, R: 8, P: 1, Salt: hex.EncodeToString(salt)}
+	case "pbkdf2":
+		derivedKey = pbkdf2.Key([]byte(password), salt, 1024, 32, sha256.New)
+		kdfParams = keyStorePbkdf2Params{DkLen: 32, C: 1024, PRF: "hmac-sha256", Salt: hex.EncodeToString(salt)}
+	}
+
+	block, _ := aes.NewCipher(derivedKey[:16])
+	cipherText := make([]byte, 32)
+	cipher.NewCTR(block, iv).XORKeyStream(cipherText, priv.Bytes())
+	mac := crypto.SHA3Sum256(append(append([]byte{}, derivedKey[16:32]...), cipherText...))
+
+	kdfParamsJson, _ := json.Marshal(kdfParams)
+	pkey := priv.PublicKey()
+	ksBytes, _ := json.Marshal(keyStoreData{
+		Address:  NewAccountAddressFromPublicKey(pkey).String(),
+		ID:       "c9f3a4d2-8a5b-4e7a-9f2c-0e8a3a1f5b6d",
+		Version:  3,
+		CoinType: "icx",
+		Crypto: keyStoreCrypto{
+			Cipher:       "aes-128-ctr",
+			CipherParams: keyStoreCipherParams{IV: hex.EncodeToString(iv)},
+			CipherText:   hex.EncodeToString(cipherText),
+			KDF:          kdf,
+			KDFParams:    kdfParamsJson,
+			MAC:          hex.EncodeToString(mac),
+		},
+	})
+
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	if err := os.WriteFile(path, ksBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestKeyStore(t *testing.T) {
+	priv, pub := crypto.GenerateKeyPair()
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("gochain@123\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("WALLET_TEST_KEY_PASSWORD", "gochain@123")
+
+	for _, kdf := range []string{"scrypt", "pbkdf2"} {
+		t.Run(kdf, func(t *testing.T) {
+			for _, params := range []map[string]string{
+				{"password_file": passwordFile},
+				{"password_env": "WALLET_TEST_KEY_PASSWORD"},
+			} {
+				params["kms_type"] = "keystore"
+				params["keystore_path"] = writeKeyStore(t, priv, "gochain@123", kdf)
+
+				iWallet, err := NewWallet(params)
+				if err != nil {
+					t.Fatal(err)
+				}
+				walletInst := iWallet.(walletImpl)
+				if hex.EncodeToString(walletInst.PublicKey()) != hex.EncodeToString(pub.SerializeCompressed()) {
+					t.Fatalf("unexpected pubkey %x", walletInst.PublicKey())
+				}
+
+				signData, _ := hex.DecodeString("356355dae4212533ce182cbb31492a6c2665fcf8f17e089d929e7a3efd1d1ba1")
+				signature, err := walletInst.Sign(signData)
+				if err != nil {
+					t.Fatal(err)
+				}
+				verifyRecoverable(t, signData, signature, walletInst.PublicKey())
+
+				// RFC6979 makes the signature deterministic.
+				again, err := walletInst.Sign(signData)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if hex.EncodeToString(again) != hex.EncodeToString(signature) {
+					t.Fatalf("signatures differ: %x != %x", again, signature)
+				}
+
+				signer := iWallet.(Wallet).signer.(*keyStoreSigner)
+				closeSigner(signer)
+				if !bytes.Equal(signer.priv.Bytes(), make([]byte, crypto.PrivateKeyLen)) {
+					t.Fatal("closed keystore signer still holds the key")
+				}
+			}
+		})
+	}
+}
+
+func TestKeyStoreWrongPassword(t *testing.T) {
+	priv, _ := crypto.GenerateKeyPair()
+	t.Setenv("WALLET_TEST_KEY_PASSWORD", "wrong")
+
+	_, err := NewWallet(map[string]string{
+		"kms_type":      "keystore",
+		"keystore_path": writeKeyStore(t, priv, "gochain@123", "scrypt"),
+		"password_env":  "WALLET_TEST_KEY_PASSWORD",
+	})
+	if !errors.Is(err, walleterr.ErrPermissionDenied) {
+		t.Fatalf("NewWallet with a wrong password returned %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package lease
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// DynamoStore keeps the lease record in an item of a DynamoDB table whose
+// partition key is the string attribute lease_key. Writes are PutItem calls
+// conditioned on the version attribute of the item, so only one of two
+// concurrent writers succeeds.
+//
+// It speaks the DynamoDB JSON protocol directly with SigV4 signed requests,
+// which keeps the plugin free of the DynamoDB SDK.
+type DynamoStore struct {
+	Client      *http.Client
+	Endpoint    string // e.g. https://dynamodb.us-east-1.amazonaws.com
+	Region      string
+	Credentials aws.CredentialsProvider
+	Table       string
+	Key         string
+}
+
+// NewDynamoStore returns a DynamoStore for the item key of table. An empty
+// endpoint means the public endpoint of region.
+func NewDynamoStore(creds aws.CredentialsProvider, region, endpoint, table, key string) *DynamoStore {
+	if endpoint == "" {
+		endpoint = "https://dynamodb." + region + ".amazonaws.com"
+	}
+	return &DynamoStore{
+		Client:      &http.Client{},
+		Endpoint:    strings.TrimSuffix(endpoint, "/"),
+		Region:      region,
+		Credentials: creds,
+		Table:       table,
+		Key:         key,
+	}
+}
+
+func (s *DynamoStore) String() string {
+	return fmt.Sprintf("dynamodb %s/%s", s.Table, s.Key)
+}
+
+type dynamoAttr struct {
+	S string `json:"S,omitempty"`
+	N string `json:"N,omitempty"`
+}
+
+type dynamoError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+func (e *dynamoError) Error() string {
+	name := e.Type[strings.LastIndex(e.Type, "#")+1:]
+	return "dynamodb " + name + ": " + e.Message
+}
+
+// call sends a DynamoDB API request and decodes the response into out.
+func (s *DynamoStore) call(ctx context.Context, target string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "DynamoDB_20120810."+target)
+
+	creds, err := s.Credentials.Retrieve(ctx)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(body)
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(hash[:]), "dynamodb", s.Region, time.Now()); err != nil {
+		return err
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e dynamoError
+		if json.Unmarshal(b, &e) != nil || e.Type == "" {
+			return fmt.Errorf("dynamodb %s: %s", target, resp.Status)
+		}
+		if strings.HasSuffix(e.Type, "#ConditionalCheckFailedException") {
+			return ErrConflict
+		}
+		return &e
+	}
+	return json.Unmarshal(b, out)
+}
+
+func (s *DynamoStore) Get(ctx context.Context) (Record, string, error) {
+	in := map[string]interface{}{
+		"TableName":      s.Table,
+		"Key":            map[string]dynamoAttr{"lease_key": {S: s.Key}},
+		"ConsistentRead": true,
+	}
+	var out struct {
+		Item map[string]dynamoAttr `json:"Item"`
+	}
+	if err := s.call(ctx, "GetItem", in, &out); err != nil {
+		return Record{}, "", err
+	}
+	if out.Item == nil {
+		return Record{}, "", ErrNotFound
+	}
+	expires, err := strconv.ParseInt(out.Item["expires"].N, 10, 64)
+	if err != nil {
+		return Record{}, "", fmt.Errorf("dynamodb lease item %s: expires: %v", s.Key, err)
+	}
+	rec := Record{Holder: out.Item["holder"].S, Expires: time.UnixMilli(expires)}
+	return rec, out.Item["version"].N, nil
+}
+
+func (s *DynamoStore) Put(ctx context.Context, rec Record, version string) (string, error) {
+	next := uint64(1)
+	if version != "" {
+		v, err := strconv.ParseUint(version, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("lease version %q: %v", version, err)
+		}
+		next = v + 1
+	}
+	in := map[string]interface{}{
+		"TableName": s.Table,
+		"Item": map[string]dynamoAttr{
+			"lease_key": {S: s.Key},
+			"holder":    {S: rec.Holder},
+			"expires":   {N: strconv.FormatInt(rec.Expires.UnixMilli(), 10)},
+			"version":   {N: strconv.FormatUint(next, 10)},
+		},
+	}
+	if version == "" {
+		in["ConditionExpression"] = "attribute_not_exists(lease_key)"
+	} else {
+		in["ConditionExpression"] = "version = :v"
+		in["ExpressionAttributeValues"] = map[string]dynamoAttr{":v": {N: version}}
+	}
+	if err := s.call(ctx, "PutItem", in, &struct{}{}); err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(next, 10), nil
+}
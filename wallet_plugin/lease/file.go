@@ -0,0 +1,129 @@
+package lease
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FileStore keeps the lease record in a directory shared by the nodes, which
+// may be on NFS. Every write creates the next generation NAME.GEN of the
+// record with link(2), which is atomic and fails if the file exists on local
+// file systems and NFS alike, so two nodes can not both write generation
+// GEN. The record is the file with the highest generation.
+type FileStore struct {
+	dir  string
+	name string
+}
+
+// NewFileStore returns a FileStore for the record name in dir.
+func NewFileStore(dir, name string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir, name: name}, nil
+}
+
+func (s *FileStore) String() string {
+	return "file " + filepath.Join(s.dir, s.name)
+}
+
+// generations returns the generations of the record, in increasing order.
+func (s *FileStore) generations() ([]uint64, error) {
+	matches, err := filepath.Glob(filepath.Join(s.dir, s.name+".*"))
+	if err != nil {
+		return nil, err
+	}
+	var gens []uint64
+	for _, m := range matches {
+		suffix := strings.TrimPrefix(filepath.Base(m), s.name+".")
+		if gen, err := strconv.ParseUint(suffix, 10, 64); err == nil {
+			gens = append(gens, gen)
+		}
+	}
+	sort.Slice(gens, func(i, j int) bool { return gens[i] < gens[j] })
+	return gens, nil
+}
+
+func (s *FileStore) path(gen uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s.%020d", s.name, gen))
+}
+
+func (s *FileStore) Get(ctx context.Context) (Record, string, error) {
+	gens, err := s.generations()
+	if err != nil {
+		return Record{}, "", err
+	}
+	if len(gens) == 0 {
+		return Record{}, "", ErrNotFound
+	}
+	gen := gens[len(gens)-1]
+	b, err := os.ReadFile(s.path(gen))
+	if err != nil {
+		return Record{}, "", err
+	}
+	var rec Record
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return Record{}, "", fmt.Errorf("lease record %s: %v", s.path(gen), err)
+	}
+	return rec, strconv.FormatUint(gen, 10), nil
+}
+
+func (s *FileStore) Put(ctx context.Context, rec Record, version string) (string, error) {
+	var gen uint64
+	if version != "" {
+		var err error
+		if gen, err = strconv.ParseUint(version, 10, 64); err != nil {
+			return "", fmt.Errorf("lease version %q: %v", version, err)
+		}
+	}
+	next := gen + 1
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(s.dir, s.name+".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	tmp.Close()
+
+	if err := os.Link(tmp.Name(), s.path(next)); err != nil {
+		if os.IsExist(err) {
+			return "", ErrConflict
+		}
+		return "", err
+	}
+
+	// A writer that read an old generation may win a generation that was
+	// already cleaned up; a higher one shows that it lost.
+	gens, err := s.generations()
+	if err != nil {
+		return "", err
+	}
+	if gens[len(gens)-1] != next {
+		os.Remove(s.path(next))
+		return "", ErrConflict
+	}
+	for _, g := range gens {
+		if g+1 < next {
+			os.Remove(s.path(g))
+		}
+	}
+	return strconv.FormatUint(next, 10), nil
+}
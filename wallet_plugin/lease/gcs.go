@@ -0,0 +1,122 @@
+package lease
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// GCSStore keeps the lease record in a Cloud Storage object. Writes are
+// uploads with an ifGenerationMatch precondition on the generation of the
+// object that was read, so only one of two concurrent writers succeeds.
+type GCSStore struct {
+	Client   *http.Client // authorized for the bucket
+	Endpoint string       // e.g. https://storage.googleapis.com
+	Bucket   string
+	Object   string
+}
+
+// NewGCSStore returns a GCSStore for object in bucket. An empty endpoint
+// means the public Cloud Storage endpoint.
+func NewGCSStore(client *http.Client, endpoint, bucket, object string) *GCSStore {
+	if endpoint == "" {
+		endpoint = "https://storage.googleapis.com"
+	}
+	return &GCSStore{Client: client, Endpoint: strings.TrimSuffix(endpoint, "/"), Bucket: bucket, Object: object}
+}
+
+func (s *GCSStore) String() string {
+	return "gcs gs://" + s.Bucket + "/" + s.Object
+}
+
+func (s *GCSStore) Get(ctx context.Context) (Record, string, error) {
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media", s.Endpoint, url.PathEscape(s.Bucket), url.PathEscape(s.Object))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return Record{}, "", err
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return Record{}, "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Record{}, "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return Record{}, "", ErrNotFound
+	default:
+		return Record{}, "", gcsError("get", resp.Status, b)
+	}
+
+	generation := resp.Header.Get("X-Goog-Generation")
+	if generation == "" {
+		return Record{}, "", fmt.Errorf("gcs lease object %s has no generation", s.Object)
+	}
+	var rec Record
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return Record{}, "", fmt.Errorf("gcs lease object %s: %v", s.Object, err)
+	}
+	return rec, generation, nil
+}
+
+func (s *GCSStore) Put(ctx context.Context, rec Record, version string) (string, error) {
+	if version == "" {
+		version = "0" // the object must not exist
+	}
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{"uploadType": {"media"}, "name": {s.Object}, "ifGenerationMatch": {version}}
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", s.Endpoint, url.PathEscape(s.Bucket), q.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusPreconditionFailed:
+		return "", ErrConflict
+	default:
+		return "", gcsError("put", resp.Status, b)
+	}
+
+	var obj struct {
+		Generation string `json:"generation"`
+	}
+	if err := json.Unmarshal(b, &obj); err != nil || obj.Generation == "" {
+		return "", fmt.Errorf("gcs lease object %s: no generation in the upload response", s.Object)
+	}
+	return obj.Generation, nil
+}
+
+func gcsError(op, status string, body []byte) error {
+	var e struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &e) == nil && e.Error.Message != "" {
+		return fmt.Errorf("gcs lease %s %s: %s", op, status, e.Error.Message)
+	}
+	return fmt.Errorf("gcs lease %s %s", op, status)
+}
@@ -0,0 +1,206 @@
+// Package lease implements a time-bounded signer lease on top of a shared
+// compare-and-swap store, so that of several nodes configured with the same
+// key only one signs at a time.
+//
+// The lease is a record naming its holder and when it expires. A node takes
+// it when there is none, when it expired or when it already holds it, and
+// only by a conditional write that fails if another node wrote the record in
+// the meantime. The holder renews the lease well before it expires and stops
+// signing once it could not: a standby node takes over when the record
+// expires. Nodes are expected to keep their clocks within a fraction of the
+// TTL of each other, which a lease Margin absorbs.
+package lease
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by Store.Get when there is no lease record yet.
+var ErrNotFound = errors.New("lease: no lease record")
+
+// ErrConflict is returned by Store.Put when the record changed since it was
+// read.
+var ErrConflict = errors.New("lease: lease record changed concurrently")
+
+// Record is the content of a lease.
+type Record struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// Store holds the lease record of one key.
+type Store interface {
+	// Get returns the current record and its opaque version, or
+	// ErrNotFound.
+	Get(ctx context.Context) (rec Record, version string, err error)
+
+	// Put writes rec if the record is still at version, an empty version
+	// meaning there must be no record yet, and returns the new version. It
+	// fails with ErrConflict otherwise.
+	Put(ctx context.Context, rec Record, version string) (string, error)
+
+	// String describes the store in logs.
+	String() string
+}
+
+// HeldError is returned by Acquire when another node holds the lease.
+type HeldError struct {
+	Holder  string
+	Expires time.Time
+}
+
+func (e *HeldError) Error() string {
+	return fmt.Sprintf("lease held by %s until %s", e.Holder, e.Expires.UTC().Format(time.RFC3339))
+}
+
+// Lease is the lease of one node on a Store. It is safe for concurrent use.
+type Lease struct {
+	store  Store
+	holder string
+	ttl    time.Duration
+	margin time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	version string    // of the record we wrote last
+	until   time.Time // when the held lease expires, zero if not held
+	owner   Record    // the record seen last
+}
+
+// New returns the Lease of holder on store. Acquire writes records that
+// expire after ttl, and the lease counts as held until a fifth of ttl before
+// that, the margin left for clock differences between the nodes.
+func New(store Store, holder string, ttl time.Duration) *Lease {
+	return &Lease{store: store, holder: holder, ttl: ttl, margin: ttl / 5, now: time.Now}
+}
+
+// Holder returns the name this node holds the lease under.
+func (l *Lease) Holder() string {
+	return l.holder
+}
+
+// TTL returns the time a lease is written for.
+func (l *Lease) TTL() time.Duration {
+	return l.ttl
+}
+
+// String describes the lease in logs.
+func (l *Lease) String() string {
+	return l.store.String()
+}
+
+// Acquire takes the lease or renews it if this node holds it already. It
+// returns a *HeldError if another node holds an unexpired lease.
+func (l *Lease) Acquire(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// The lease is only counted from before the write, so it never lasts
+	// longer here than in the store.
+	start := l.now()
+	rec := Record{Holder: l.holder, Expires: start.Add(l.ttl)}
+
+	// A holder renews blindly, a conflict means it has to look again.
+	if l.version != "" {
+		version, err := l.store.Put(ctx, rec, l.version)
+		if err == nil {
+			l.held(rec, version, start)
+			return nil
+		}
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+		l.lost()
+	}
+
+	current, version, err := l.store.Get(ctx)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		version = ""
+	case err != nil:
+		return err
+	case current.Holder != l.holder && start.Before(current.Expires):
+		l.lost()
+		l.owner = current
+		return &HeldError{Holder: current.Holder, Expires: current.Expires}
+	}
+
+	version, err = l.store.Put(ctx, rec, version)
+	if err != nil {
+		l.lost()
+		return err
+	}
+	l.held(rec, version, start)
+	return nil
+}
+
+func (l *Lease) held(rec Record, version string, start time.Time) {
+	l.version = version
+	l.until = start.Add(l.ttl - l.margin)
+	l.owner = rec
+}
+
+func (l *Lease) lost() {
+	l.version = ""
+	l.until = time.Time{}
+}
+
+// Held reports whether this node holds the lease and may sign.
+func (l *Lease) Held() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.now().Before(l.until)
+}
+
+// Check returns nil if this node holds the lease, or an error naming the
+// node that holds it as far as is known.
+func (l *Lease) Check() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.now().Before(l.until) {
+		return nil
+	}
+	if l.owner.Holder != "" && l.owner.Holder != l.holder && l.now().Before(l.owner.Expires) {
+		return &HeldError{Holder: l.owner.Holder, Expires: l.owner.Expires}
+	}
+	return errors.New("lease: lease not held")
+}
+
+// Release gives the lease up so a standby node can take it at once.
+func (l *Lease) Release(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.version == "" {
+		return nil
+	}
+	rec := Record{Holder: l.holder, Expires: l.now()}
+	_, err := l.store.Put(ctx, rec, l.version)
+	l.lost()
+	return err
+}
+
+// Keep acquires or renews the lease every third of its TTL until ctx is
+// done, so that the holder keeps it and a standby takes it over once it
+// expires. Errors other than a lease held elsewhere are passed to report.
+func (l *Lease) Keep(ctx context.Context, report func(error)) {
+	interval := l.ttl / 3
+	for {
+		actx, cancel := context.WithTimeout(ctx, interval)
+		err := l.Acquire(actx)
+		cancel()
+		var held *HeldError
+		if err != nil && !errors.As(err, &held) && report != nil {
+			report(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package lease
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+// fakeDynamo is a local stand-in for the GetItem and PutItem calls of
+// DynamoDB, including condition expressions.
+type fakeDynamo struct {
+	mu    sync.Mutex
+	items map[string]map[string]dynamoAttr
+}
+
+func newFakeDynamo(t *testing.T) (*fakeDynamo, *httptest.Server) {
+	f := &fakeDynamo{items: make(map[string]map[string]dynamoAttr)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeDynamo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"__type":"com.amazon.coral.service#MissingAuthenticationTokenException","message":"unsigned"}`)
+		return
+	}
+	var in struct {
+		TableName                 string
+		Key                       map[string]dynamoAttr
+		Item                      map[string]dynamoAttr
+		ConditionExpression       string
+		ExpressionAttributeValues map[string]dynamoAttr
+	}
+	_ = json.NewDecoder(r.Body).Decode(&in)
+
+	switch r.Header.Get("X-Amz-Target") {
+	case "DynamoDB_20120810.GetItem":
+		item := f.items[in.TableName+"/"+in.Key["lease_key"].S]
+		json.NewEncoder(w).Encode(map[string]interface{}{"Item": item})
+	case "DynamoDB_20120810.PutItem":
+		k := in.TableName + "/" + in.Item["lease_key"].S
+		current, exists := f.items[k]
+		ok := false
+		switch in.ConditionExpression {
+		case "attribute_not_exists(lease_key)":
+			ok = !exists
+		case "version = :v":
+			ok = exists && current["version"].N == in.ExpressionAttributeValues[":v"].N
+		}
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException","message":"The conditional request failed"}`)
+			return
+		}
+		f.items[k] = in.Item
+		io.WriteString(w, `{}`)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// fakeGCS is a local stand-in for the media download and upload of Cloud
+// Storage objects, including generation preconditions.
+type fakeGCS struct {
+	mu         sync.Mutex
+	objects    map[string][]byte
+	generation map[string]int64
+	next       int64
+}
+
+func newFakeGCS(t *testing.T) (*fakeGCS, *httptest.Server) {
+	f := &fakeGCS{objects: make(map[string][]byte), generation: make(map[string]int64), next: 1690000000000000}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/storage/v1/b/"):
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/storage/v1/b/"), "/o/", 2)
+		k := parts[0] + "/" + parts[1]
+		b, ok := f.objects[k]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"error":{"code":404,"message":"No such object"}}`)
+			return
+		}
+		w.Header().Set("X-Goog-Generation", strconv.FormatInt(f.generation[k], 10))
+		w.Write(b)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/upload/storage/v1/b/"):
+		bucket := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/upload/storage/v1/b/"), "/o")
+		k := bucket + "/" + r.URL.Query().Get("name")
+		if r.URL.Query().Get("ifGenerationMatch") != strconv.FormatInt(f.generation[k], 10) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			io.WriteString(w, `{"error":{"code":412,"message":"conditionNotMet"}}`)
+			return
+		}
+		f.objects[k], _ = io.ReadAll(r.Body)
+		f.next++
+		f.generation[k] = f.next
+		json.NewEncoder(w).Encode(map[string]string{"name": k, "generation": strconv.FormatInt(f.next, 10)})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func testStores(t *testing.T) map[string]func() Store {
+	creds := credentials.NewStaticCredentialsProvider("AKIATEST", "secret", "")
+	_, dynamoSrv := newFakeDynamo(t)
+	_, gcsSrv := newFakeGCS(t)
+	n := 0
+	return map[string]func() Store{
+		"file": func() Store {
+			s, err := NewFileStore(t.TempDir(), "hx0001")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+		"dynamodb": func() Store {
+			n++
+			return NewDynamoStore(creds, "us-east-1", dynamoSrv.URL, "leases", "hx000"+strconv.Itoa(n))
+		},
+		"gcs": func() Store {
+			n++
+			return NewGCSStore(gcsSrv.Client(), gcsSrv.URL, "bucket", "leases/hx000"+strconv.Itoa(n))
+		},
+	}
+}
+
+func TestStores(t *testing.T) {
+	ctx := context.Background()
+	expires := time.UnixMilli(time.Now().UnixMilli())
+	for name, newStore := range testStores(t) {
+		s := newStore()
+		if _, _, err := s.Get(ctx); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("%s: Get of a new store returned %v", name, err)
+		}
+		v1, err := s.Put(ctx, Record{Holder: "a", Expires: expires}, "")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := s.Put(ctx, Record{Holder: "b"}, ""); !errors.Is(err, ErrConflict) {
+			t.Errorf("%s: second create returned %v", name, err)
+		}
+		rec, version, err := s.Get(ctx)
+		if err != nil || rec.Holder != "a" || !rec.Expires.Equal(expires) || version != v1 {
+			t.Errorf("%s: Get = %+v, %q, %v", name, rec, version, err)
+		}
+		if _, err := s.Put(ctx, Record{Holder: "b"}, v1); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if _, err := s.Put(ctx, Record{Holder: "c"}, v1); !errors.Is(err, ErrConflict) {
+			t.Errorf("%s: stale write returned %v", name, err)
+		}
+		if rec, _, _ := s.Get(ctx); rec.Holder != "b" {
+			t.Errorf("%s: holder %s after a stale write", name, rec.Holder)
+		}
+	}
+}
+
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func TestLeaseHandover(t *testing.T) {
+	ctx := context.Background()
+	for name, newStore := range testStores(t) {
+		store := newStore()
+		clock := &fakeClock{t: time.Now()}
+		active := New(store, "node-a", 10*time.Second)
+		standby := New(store, "node-b", 10*time.Second)
+		active.now, standby.now = clock.now, clock.now
+
+		if err := active.Acquire(ctx); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var held *HeldError
+		if err := standby.Acquire(ctx); !errors.As(err, &held) || held.Holder != "node-a" {
+			t.Fatalf("%s: standby Acquire returned %v", name, err)
+		}
+		if !active.Held() || standby.Held() {
+			t.Fatalf("%s: both or neither hold the lease", name)
+		}
+		if err := standby.Check(); !errors.As(err, &held) {
+			t.Errorf("%s: standby Check returned %v", name, err)
+		}
+
+		// Renewals keep the lease with the active node.
+		clock.advance(5 * time.Second)
+		if err := active.Acquire(ctx); err != nil {
+			t.Fatalf("%s: renew: %v", name, err)
+		}
+		clock.advance(7 * time.Second)
+		if err := standby.Acquire(ctx); !errors.As(err, &held) {
+			t.Fatalf("%s: standby took a renewed lease: %v", name, err)
+		}
+
+		// The active node stops signing before its lease expires, and the
+		// standby takes over once it has.
+		clock.advance(time.Second)
+		if active.Held() {
+			t.Errorf("%s: lease held within its margin", name)
+		}
+		clock.advance(3 * time.Second)
+		if err := standby.Acquire(ctx); err != nil {
+			t.Fatalf("%s: takeover: %v", name, err)
+		}
+		if err := active.Acquire(ctx); !errors.As(err, &held) || held.Holder != "node-b" {
+			t.Errorf("%s: the old holder renewed over the takeover: %v", name, err)
+		}
+
+		// A release hands the lease over at once.
+		if err := standby.Release(ctx); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := active.Acquire(ctx); err != nil || !active.Held() || standby.Held() {
+			t.Errorf("%s: no handover after a release: %v", name, err)
+		}
+	}
+}
+
+func TestLeaseRace(t *testing.T) {
+	for name, newStore := range testStores(t) {
+		store := newStore()
+		var wg sync.WaitGroup
+		leases := make([]*Lease, 8)
+		for i := range leases {
+			leases[i] = New(store, "node-"+strconv.Itoa(i), time.Minute)
+			wg.Add(1)
+			go func(l *Lease) {
+				defer wg.Done()
+				_ = l.Acquire(context.Background())
+			}(leases[i])
+		}
+		wg.Wait()
+
+		holders := 0
+		for _, l := range leases {
+			if l.Held() {
+				holders++
+			}
+		}
+		if holders != 1 {
+			t.Errorf("%s: %d nodes hold the lease", name, holders)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// Package log is the leveled, structured logger of the wallet plugin.
+//
+// Every entry has a level, a message and key/value fields, and is written as
+// a logfmt line or as a JSON object. The level names follow goloop, so the
+// plugin can log at the level of the node through GOLOOP_LOG_LEVEL. Fields
+// whose key was registered with Redact are never written, even when nested in
+// a parameter map.
+package log
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+// Levels in increasing severity. Fatal and Panic are only accepted as
+// thresholds so that a node running at those levels keeps the plugin quiet.
+const (
+	TraceLevel Level = iota
+	DebugLevel
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+	FatalLevel
+	PanicLevel
+)
+
+var levelNames = []string{"trace", "debug", "info", "warn", "error", "fatal", "panic"}
+
+func (l Level) String() string {
+	if l < TraceLevel || l > PanicLevel {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name as used by GOLOOP_LOG_LEVEL, ignoring case.
+func ParseLevel(s string) (Level, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	if name == "warning" {
+		return WarnLevel, nil
+	}
+	for i, n := range levelNames {
+		if n == name {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// Format is the encoding of log entries.
+type Format string
+
+const (
+	TextFormat Format = "text" // logfmt key=value pairs
+	JSONFormat Format = "json" // one JSON object per line
+)
+
+// ParseFormat parses "text" or "json".
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(strings.TrimSpace(s))); f {
+	case TextFormat, JSONFormat:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown log format %q", s)
+}
+
+// Redacted replaces the value of a secret field.
+const Redacted = "[REDACTED]"
+
+// core is shared by a Logger and the loggers derived from it with With.
+type core struct {
+	mu     sync.Mutex
+	out    io.Writer
+	level  Level
+	format Format
+	redact map[string]bool
+	now    func() time.Time
+}
+
+// Logger writes log entries. It is safe for concurrent use, and changing the
+// level, format or redacted keys also affects the loggers derived with With.
+type Logger struct {
+	c      *core
+	fields []interface{}
+}
+
+// New returns a Logger writing text entries of InfoLevel and above to out.
+func New(out io.Writer) *Logger {
+	return &Logger{c: &core{
+		out:    out,
+		level:  InfoLevel,
+		format: TextFormat,
+		redact: make(map[string]bool),
+		now:    time.Now,
+	}}
+}
+
+// SetOutput sets the destination of the entries.
+func (l *Logger) SetOutput(out io.Writer) {
+	l.c.mu.Lock()
+	defer l.c.mu.Unlock()
+	l.c.out = out
+}
+
+// SetLevel sets the lowest level that is written.
+func (l *Logger) SetLevel(level Level) {
+	l.c.mu.Lock()
+	defer l.c.mu.Unlock()
+	l.c.level = level
+}
+
+// SetFormat sets the encoding of the entries.
+func (l *Logger) SetFormat(format Format) {
+	l.c.mu.Lock()
+	defer l.c.mu.Unlock()
+	l.c.format = format
+}
+
+// Redact registers keys whose values must never be written.
+func (l *Logger) Redact(keys ...string) {
+	l.c.mu.Lock()
+	defer l.c.mu.Unlock()
+	for _, k := range keys {
+		l.c.redact[k] = true
+	}
+}
+
+// Enabled reports whether entries of level are written.
+func (l *Logger) Enabled(level Level) bool {
+	l.c.mu.Lock()
+	defer l.c.mu.Unlock()
+	return level >= l.c.level
+}
+
+// With returns a Logger that adds the key/value pairs to every entry.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(append(fields, l.fields...), kv...)
+	return &Logger{c: l.c, fields: fields}
+}
+
+// Trace logs msg and the key/value pairs at TraceLevel.
+func (l *Logger) Trace(msg string, kv ...interface{}) { l.log(TraceLevel, msg, kv) }
+
+// Debug logs msg and the key/value pairs at DebugLevel.
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(DebugLevel, msg, kv) }
+
+// Info logs msg and the key/value pairs at InfoLevel.
+func (l *Logger) Info(msg string, kv ...interface{}) { l.log(InfoLevel, msg, kv) }
+
+// Warn logs msg and the key/value pairs at WarnLevel.
+func (l *Logger) Warn(msg string, kv ...interface{}) { l.log(WarnLevel, msg, kv) }
+
+// Error logs msg and the key/value pairs at ErrorLevel.
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(ErrorLevel, msg, kv) }
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	l.c.mu.Lock()
+	defer l.c.mu.Unlock()
+	if level < l.c.level {
+		return
+	}
+
+	fields := []field{
+		{"time", l.c.now().UTC().Format("2006-01-02T15:04:05.000Z07:00")},
+		{"level", level.String()},
+		{"msg", msg},
+	}
+	all := append(append([]interface{}{}, l.fields...), kv...)
+	for i := 0; i < len(all); i += 2 {
+		key, ok := all[i].(string)
+		if !ok {
+			key = fmt.Sprint(all[i])
+		}
+		if i+1 == len(all) {
+			fields = append(fields, field{key, "!MISSING"})
+			break
+		}
+		fields = append(fields, field{key, l.c.value(key, all[i+1])})
+	}
+
+	var buf bytes.Buffer
+	if l.c.format == JSONFormat {
+		writeJSON(&buf, fields)
+	} else {
+		writeText(&buf, fields)
+	}
+	buf.WriteByte('\n')
+	_, _ = l.c.out.Write(buf.Bytes())
+}
+
+// value converts v into what is written for key, replacing secrets.
+func (c *core) value(key string, v interface{}) interface{} {
+	if c.redact[key] {
+		return Redacted
+	}
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case error:
+		return v.Error()
+	case []byte:
+		return "0x" + hex.EncodeToString(v)
+	case fmt.Stringer:
+		return v.String()
+	case map[string]string:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = c.value(k, e)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = c.value(k, e)
+		}
+		return m
+	case []map[string]string:
+		s := make([]interface{}, len(v))
+		for i, e := range v {
+			s[i] = c.value("", e)
+		}
+		return s
+	}
+	return v
+}
+
+func writeJSON(buf *bytes.Buffer, fields []field) {
+	buf.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(f.key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(f.value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(f.value))
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+}
+
+func writeText(buf *bytes.Buffer, fields []field) {
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(f.key)
+		buf.WriteByte('=')
+		buf.WriteString(quote(textValue(f.value)))
+	}
+}
+
+func textValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "<nil>"
+	case string:
+		return v
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
+
+// quote quotes s when it would not read back as a single logfmt value.
+func quote(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\\\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,92 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLogger() (*Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	l := New(&buf)
+	l.c.now = func() time.Time { return time.Date(2023, 11, 2, 8, 30, 0, 0, time.UTC) }
+	return l, &buf
+}
+
+func TestText(t *testing.T) {
+	l, buf := newTestLogger()
+	l.With("backend", "aws").Info("sign failed", "err", errors.New("access denied"), "attempts", 2, "pubkey", []byte{2, 0xab})
+
+	want := `time=2023-11-02T08:30:00.000Z level=info msg="sign failed" backend=aws err="access denied" attempts=2 pubkey=0x02ab` + "\n"
+	if buf.String() != want {
+		t.Errorf("got  %q\nwant %q", buf.String(), want)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	l, buf := newTestLogger()
+	l.SetFormat(JSONFormat)
+	l.Warn("backend unavailable", "backend", "aws:us-east-1", "odd")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("%q: %v", buf.String(), err)
+	}
+	for k, v := range map[string]string{
+		"time":    "2023-11-02T08:30:00.000Z",
+		"level":   "warn",
+		"msg":     "backend unavailable",
+		"backend": "aws:us-east-1",
+		"odd":     "!MISSING",
+	} {
+		if entry[k] != v {
+			t.Errorf("%s = %v, want %v", k, entry[k], v)
+		}
+	}
+}
+
+func TestLevels(t *testing.T) {
+	l, buf := newTestLogger()
+	l.Debug("hidden")
+	l.SetLevel(DebugLevel)
+	l.Debug("shown")
+	l.Trace("hidden")
+	if strings.Count(buf.String(), "\n") != 1 || !strings.Contains(buf.String(), "msg=shown") {
+		t.Errorf("got %q", buf.String())
+	}
+	if !l.Enabled(ErrorLevel) || l.Enabled(TraceLevel) {
+		t.Error("wrong Enabled")
+	}
+
+	for s, want := range map[string]Level{"trace": TraceLevel, "DEBUG": DebugLevel, "warning": WarnLevel, " panic": PanicLevel} {
+		if got, err := ParseLevel(s); err != nil || got != want {
+			t.Errorf("ParseLevel(%q) = %v, %v", s, got, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("ParseLevel accepted verbose")
+	}
+}
+
+func TestRedact(t *testing.T) {
+	for _, format := range []Format{TextFormat, JSONFormat} {
+		l, buf := newTestLogger()
+		l.SetFormat(format)
+		l.Redact("secret_access_key", "pin")
+		l.Info("loaded",
+			"secret_access_key", "AKIA-SECRET-1",
+			"params", map[string]string{"region": "us-east-1", "pin": "SECRET-2"},
+			"backends", []map[string]string{{"secret_access_key": "SECRET-3"}})
+
+		out := buf.String()
+		if strings.Contains(out, "SECRET") {
+			t.Errorf("%s: secret leaked: %s", format, out)
+		}
+		if strings.Count(out, Redacted) != 3 || !strings.Contains(out, "us-east-1") {
+			t.Errorf("%s: got %s", format, out)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/remote-signing/wallet_plugin/log"
+	"os"
+)
+
+// logger is the logger of the plugin. It writes to stdout like goloop.
+var logger = newLogger()
+
+// secretParams are the plugin parameters holding credentials. Their values
+// are never logged, also when nested in a params map or a backends entry.
+var secretParams = []string{
+	"secret_access_key",
+	"session_token",
+	"external_id",
+	"credential_json",
+	"client_secret",
+	"vault_token",
+	"approle_secret_id",
+	"pin",
+	"admin_token",
+	"api_key",
+}
+
+func newLogger() *log.Logger {
+	l := log.New(os.Stdout)
+	l.Redact(secretParams...)
+	return l
+}
+
+// configureLogger applies the log_level and log_format params. The level
+// defaults to GOLOOP_LOG_LEVEL so the plugin follows the node, then to info.
+func configureLogger(params map[string]string) error {
+	level := log.InfoLevel
+	if v := params["log_level"]; v != "" {
+		l, err := log.ParseLevel(v)
+		if err != nil {
+			return invalidParam("log_level", err)
+		}
+		level = l
+	} else if v := os.Getenv("GOLOOP_LOG_LEVEL"); v != "" {
+		if l, err := log.ParseLevel(v); err == nil {
+			level = l
+		}
+	}
+
+	format := log.TextFormat
+	if v := params["log_format"]; v != "" {
+		f, err := log.ParseFormat(v)
+		if err != nil {
+			return invalidParam("log_format", err)
+		}
+		format = f
+	}
+
+	logger.SetLevel(level)
+	logger.SetFormat(format)
+	return nil
+}
+
+// loggableParams returns params for logging, with the backends and
+// migration_incoming JSON decoded so the secrets in them are redacted too.
+func loggableParams(params map[string]string) map[string]interface{} {
+	m := make(map[string]interface{}, len(params))
+	for k, v := range params {
+		m[k] = v
+	}
+	if v, ok := params["backends"]; ok {
+		var entries []map[string]string
+		if err := json.Unmarshal([]byte(v), &entries); err == nil {
+			m["backends"] = entries
+		} else {
+			m["backends"] = log.Redacted
+		}
+	}
+	if v, ok := params["migration_incoming"]; ok {
+		var entry map[string]string
+		if err := json.Unmarshal([]byte(v), &entry); err == nil {
+			m["migration_incoming"] = loggableParams(entry)
+		} else {
+			m["migration_incoming"] = log.Redacted
+		}
+	}
+	return m
+}
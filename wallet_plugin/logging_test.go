@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	crypto "github.com/remote-signing/wallet_plugin/key"
+	"github.com/remote-signing/wallet_plugin/log"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"os"
+	"strings"
+	"testing"
+)
+
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	logger.SetOutput(&buf)
+	t.Cleanup(func() {
+		logger.SetOutput(os.Stdout)
+		logger.SetLevel(log.InfoLevel)
+		logger.SetFormat(log.TextFormat)
+	})
+	return &buf
+}
+
+func TestConfigureLogger(t *testing.T) {
+	captureLogs(t)
+
+	t.Setenv("GOLOOP_LOG_LEVEL", "debug")
+	if err := configureLogger(map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+	if !logger.Enabled(log.DebugLevel) || logger.Enabled(log.TraceLevel) {
+		t.Error("GOLOOP_LOG_LEVEL not applied")
+	}
+	if err := configureLogger(map[string]string{"log_level": "error"}); err != nil {
+		t.Fatal(err)
+	}
+	if logger.Enabled(log.WarnLevel) {
+		t.Error("log_level does not override GOLOOP_LOG_LEVEL")
+	}
+
+	for _, params := range []map[string]string{{"log_level": "verbose"}, {"log_format": "xml"}} {
+		if err := configureLogger(params); !errors.Is(err, walleterr.ErrConfigInvalidParam) {
+			t.Errorf("configureLogger(%v) returned %v", params, err)
+		}
+	}
+}
+
+func TestWalletLogs(t *testing.T) {
+	buf := captureLogs(t)
+	priv, _ := crypto.GenerateKeyPair()
+	password := "gochain@123"
+
+	params := map[string]string{
+		"kms_type":          "keystore",
+		"keystore_path":     writeKeyStore(t, priv, password, "pbkdf2"),
+		"password_env":      "TEST_KEYSTORE_PASSWORD",
+		"secret_access_key": "SECRET-1",
+		"log_level":         "debug",
+		"log_format":        "json",
+	}
+	t.Setenv("TEST_KEYSTORE_PASSWORD", password)
+	iWallet, err := NewWallet(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := iWallet.(walletImpl)
+
+	out := buf.String()
+	if strings.Contains(out, "SECRET") || strings.Contains(out, password) {
+		t.Errorf("secret logged: %s", out)
+	}
+	pubkey := "0x" + hex.EncodeToString(w.PublicKey())
+	for _, want := range []string{`"level":"info"`, `"address":"` + iWallet.(Wallet).addr.String() + `"`, `"pubkey":"` + pubkey + `"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("logs lack %s: %s", want, out)
+		}
+	}
+}
+
+func TestMigrationLogs(t *testing.T) {
+	buf := captureLogs(t)
+	outPriv, _ := crypto.GenerateKeyPair()
+	inPriv, _ := crypto.GenerateKeyPair()
+	params := migrationParams(t, outPriv, inPriv, t.TempDir())
+	params["migration_incoming"] = `{"keystore_path":"` + writeKeyStore(t, inPriv, "gochain@123", "scrypt") + `","client_secret":"SECRET-2"}`
+	params["log_level"] = "debug"
+	loadMigration(t, params)
+
+	out := buf.String()
+	if strings.Contains(out, "SECRET") || !strings.Contains(out, log.Redacted) {
+		t.Errorf("incoming secret not redacted: %s", out)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/remote-signing/wallet_plugin/metrics"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Metrics of the wallet, served by the metrics_listen listener. Backend
+// labels use the kms_type of a single backend or the endpoint names of a
+// failover wallet.
+var (
+	metricsRegistry = metrics.NewRegistry()
+
+	signTotal = metricsRegistry.NewCounterVec("wallet_sign_total",
+		"Sign calls by result, the kind of the error or success.", "result")
+	signRetries = metricsRegistry.NewCounterVec("wallet_sign_retries_total",
+		"Backend calls retried after a throttled or transient failure.")
+	recoveryFallbacks = metricsRegistry.NewCounterVec("wallet_recovery_id_fallback_total",
+		"Signatures whose public key was only recovered with recovery id 1.")
+	duplicateDigests = metricsRegistry.NewCounterVec("wallet_duplicate_digest_total",
+		"Requests to sign a digest that was signed before, by double-sign policy.", "policy")
+	backendDuration = metricsRegistry.NewHistogramVec("wallet_backend_sign_duration_seconds",
+		"Latency of backend signing calls, including failed ones.", metrics.DefaultBuckets, "backend")
+	backendTotal = metricsRegistry.NewCounterVec("wallet_backend_sign_total",
+		"Backend signing calls by backend and result.", "backend", "result")
+	backendThrottled = metricsRegistry.NewCounterVec("wallet_backend_throttled_total",
+		"Backend signing calls rejected because of rate limits or quota.", "backend")
+	configReloads = metricsRegistry.NewCounterVec("wallet_config_reloads_total",
+		"Reloads of the config_file by result, the kind of the error or success.", "result")
+	keySwitches = metricsRegistry.NewCounterVec("wallet_key_switches_total",
+		"Switches between the outgoing and incoming key of a migration, by key switched to and trigger.", "to", "trigger")
+)
+
+// resultLabel returns the result label of a call that returned err.
+func resultLabel(err error) string {
+	if err == nil {
+		return "success"
+	}
+	if kind := walleterr.KindOf(err); kind != "" {
+		return string(kind)
+	}
+	return "unknown"
+}
+
+// observeBackendCall records a backend signing call that started at start.
+func observeBackendCall(backend string, start time.Time, err error) {
+	backendDuration.Observe(time.Since(start).Seconds(), backend)
+	backendTotal.Inc(backend, resultLabel(err))
+	if errors.Is(err, walleterr.ErrBackendThrottled) {
+		backendThrottled.Inc(backend)
+	}
+}
+
+var (
+	metricsMu      sync.Mutex
+	metricsServers = make(map[string]net.Addr)
+)
+
+// serveMetrics serves the metrics at /metrics of addr in the Prometheus text
+// format. The signing node should not expose anything beyond the host, so
+// addr must be a loopback address. Serving an address twice, e.g. when
+// goloop loads the wallet again, reuses the running listener.
+func serveMetrics(addr string) (net.Addr, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, invalidParam("metrics_listen", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, invalidParam("metrics_listen", fmt.Errorf("%s is not a loopback address", host))
+	}
+
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	if a, ok := metricsServers[addr]; ok {
+		return a, nil
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, invalidParam("metrics_listen", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsRegistry.Handler())
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := srv.Serve(l); err != nil {
+			logger.Error("metrics listener stopped", "addr", l.Addr(), "err", err)
+		}
+	}()
+	metricsServers[addr] = l.Addr()
+	logger.Info("serving metrics", "addr", l.Addr())
+	return l.Addr(), nil
+}
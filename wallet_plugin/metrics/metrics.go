@@ -0,0 +1,277 @@
+// Package metrics implements the counters and histograms of the wallet plugin
+// and writes them in the Prometheus text exposition format.
+//
+// The plugin is loaded into the goloop process, which links its own
+// Prometheus client. A Go plugin must not bring a different version of a
+// package the host already has, and registering into the host's default
+// registry would collide with its metrics, so the plugin keeps this small,
+// self-contained implementation instead.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets suit the latency of a remote signing call, in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// Registry holds a set of metrics and exposes them.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteText writes every metric of the registry in the Prometheus text
+// format, version 0.0.4.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler serves the registry to a Prometheus scraper.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = r.WriteText(w)
+	})
+}
+
+// desc is the name, help and label names shared by the series of a metric.
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+// key joins label values into a map key. The values are checked against the
+// label names so a wrong call fails loudly in tests.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs formats the labels of a series, extra is appended as is.
+func (d *desc) labelPairs(key string, extra string) string {
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+`="`+escapeLabel(v)+`"`)
+		}
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// CounterVec is a counter partitioned by label values.
+type CounterVec struct {
+	desc
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounterVec creates and registers a counter.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{name: name, help: help, typ: "counter", labels: labels},
+		values: make(map[string]float64),
+	}
+	r.register(c)
+	return c
+}
+
+// Inc adds one to the series with the given label values.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the series with the given label
+// values.
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("metrics: counter " + c.name + " can not decrease")
+	}
+	k := c.key(labelValues)
+	c.mu.Lock()
+	c.values[k] += v
+	c.mu.Unlock()
+}
+
+// Value returns the current value of the series with the given label values.
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	k := c.key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[k]
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeHeader(w)
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(k, ""), formatFloat(c.values[k]))
+	}
+}
+
+// HistogramVec is a histogram partitioned by label values.
+type HistogramVec struct {
+	desc
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec creates and registers a histogram with the given upper
+// bucket bounds, which must be sorted.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if !sort.Float64sAreSorted(buckets) {
+		panic("metrics: buckets of " + name + " are not sorted")
+	}
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, typ: "histogram", labels: labels},
+		buckets: buckets,
+		series:  make(map[string]*histogram),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe adds v to the series with the given label values.
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	k := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[k]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+// Count returns the number of observations of the series with the given
+// label values.
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	k := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.series[k]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.writeHeader(w)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			le := `le="` + formatFloat(bound) + `"`
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(k, le), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(k, `le="+Inf"`), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(k, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(k, ""), s.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounterVec("test_requests_total", "Requests by result.", "backend", "result")
+	retries := r.NewCounterVec("test_retries_total", "Retries.")
+	latency := r.NewHistogramVec("test_duration_seconds", "Latency.", []float64{0.1, 1}, "backend")
+
+	requests.Inc("aws", "success")
+	requests.Inc("aws", "success")
+	requests.Inc(`we"ird`, "ErrBackendThrottled")
+	retries.Add(3)
+	latency.Observe(0.05, "aws")
+	latency.Observe(0.5, "aws")
+	latency.Observe(7, "aws")
+
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_requests_total Requests by result.
+# TYPE test_requests_total counter
+test_requests_total{backend="aws",result="success"} 2
+test_requests_total{backend="we\"ird",result="ErrBackendThrottled"} 1
+# HELP test_retries_total Retries.
+# TYPE test_retries_total counter
+test_retries_total 3
+# HELP test_duration_seconds Latency.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{backend="aws",le="0.1"} 1
+test_duration_seconds_bucket{backend="aws",le="1"} 2
+test_duration_seconds_bucket{backend="aws",le="+Inf"} 3
+test_duration_seconds_sum{backend="aws"} 7.55
+test_duration_seconds_count{backend="aws"} 3
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	if v := requests.Value("aws", "success"); v != 2 {
+		t.Errorf("Value = %v", v)
+	}
+	if n := latency.Count("aws"); n != 3 {
+		t.Errorf("Count = %v", n)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("test_total", "Test.").Inc()
+
+	srv := httptest.NewServer(r.Handler())
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %q", ct)
+	}
+	if !strings.Contains(string(body), "test_total 1\n") {
+		t.Errorf("body %q", body)
+	}
+}
+
+func TestLabelCount(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic on a missing label value")
+		}
+	}()
+	NewRegistry().NewCounterVec("test_total", "Test.", "backend").Inc()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	crypto "github.com/remote-signing/wallet_plugin/key"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignMetrics(t *testing.T) {
+	signData, _ := hex.DecodeString("356355dae4212533ce182cbb31492a6c2665fcf8f17e089d929e7a3efd1d1ba1")
+	w, _ := newFaultyWallet(t, kmsFault{code: "ThrottlingException"}, kmsFault{code: "KMSInternalException"})
+	w.backend = "metrics-test"
+
+	success := signTotal.Value("success")
+	retries := signRetries.Value()
+	if _, err := w.Sign(signData); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Sign(signData[:31]); !errors.Is(err, walleterr.ErrDigestLength) {
+		t.Fatalf("got %v for a short digest", err)
+	}
+
+	if d := signTotal.Value("success") - success; d != 1 {
+		t.Errorf("wallet_sign_total success grew by %v", d)
+	}
+	if v := signTotal.Value(string(walleterr.ErrDigestLength)); v < 1 {
+		t.Errorf("wallet_sign_total %s is %v", walleterr.ErrDigestLength, v)
+	}
+	if d := signRetries.Value() - retries; d != 2 {
+		t.Errorf("wallet_sign_retries_total grew by %v", d)
+	}
+	for result, want := range map[string]float64{
+		"success":                                    1,
+		string(walleterr.ErrBackendThrottled):        1,
+		string(walleterr.ErrBackendUnavailable):      1,
+		string(walleterr.ErrSignatureRecoveryFailed): 0,
+	} {
+		if v := backendTotal.Value("metrics-test", result); v != want {
+			t.Errorf("wallet_backend_sign_total %s is %v, want %v", result, v, want)
+		}
+	}
+	if n := backendDuration.Count("metrics-test"); n != 3 {
+		t.Errorf("wallet_backend_sign_duration_seconds has %d observations", n)
+	}
+	if v := backendThrottled.Value("metrics-test"); v != 1 {
+		t.Errorf("wallet_backend_throttled_total is %v", v)
+	}
+}
+
+func TestRecoveryFallbackMetric(t *testing.T) {
+	w, _ := newFaultyWallet(t)
+	before := recoveryFallbacks.Value()
+
+	var fallbacks float64
+	for i := 0; i < 20; i++ {
+		digest := sha256.Sum256([]byte{byte(i)})
+		signature, err := w.Sign(digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signature[64] == 1 {
+			fallbacks++
+		}
+	}
+	if d := recoveryFallbacks.Value() - before; d != fallbacks {
+		t.Errorf("wallet_recovery_id_fallback_total grew by %v for %v signatures with v=1", d, fallbacks)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	for _, addr := range []string{"0.0.0.0:0", "192.0.2.1:9464", "localhost"} {
+		if _, err := serveMetrics(addr); !errors.Is(err, walleterr.ErrConfigInvalidParam) {
+			t.Errorf("serveMetrics(%q) returned %v", addr, err)
+		}
+	}
+
+	addr, err := serveMetrics("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := serveMetrics("127.0.0.1:0"); err != nil || again.String() != addr.String() {
+		t.Errorf("serving again returned %v, %v", again, err)
+	}
+
+	w, _ := newFaultyWallet(t)
+	signData, _ := hex.DecodeString("356355dae4212533ce182cbb31492a6c2665fcf8f17e089d929e7a3efd1d1ba1")
+	if _, err := w.Sign(signData); err != nil {
+		t.Fatal(err)
+	}
+
+	client := http.Client{Timeout: time.Second}
+	resp, err := client.Get("http://" + addr.String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	for _, want := range []string{
+		"# TYPE wallet_backend_sign_duration_seconds histogram\n",
+		`wallet_backend_sign_duration_seconds_bucket{backend="signer",le="+Inf"}`,
+		`wallet_sign_total{result="success"}`,
+		"# TYPE wallet_recovery_id_fallback_total counter\n",
+		"# TYPE wallet_backend_throttled_total counter\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics lack %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsListenFailure(t *testing.T) {
+	priv, _ := crypto.GenerateKeyPair()
+	t.Setenv("WALLET_TEST_KEY_PASSWORD", "gochain@123")
+	params := map[string]string{
+		"kms_type":       "keystore",
+		"keystore_path":  writeKeyStore(t, priv, "gochain@123", "pbkdf2"),
+		"password_env":   "WALLET_TEST_KEY_PASSWORD",
+		"state_dir":      t.TempDir(),
+		"metrics_listen": "0.0.0.0:0",
+	}
+	if _, err := NewWallet(params); !errors.Is(err, walleterr.ErrConfigInvalidParam) {
+		t.Fatalf("NewWallet with a public metrics_listen returned %v", err)
+	}
+
+	// The failed load gave up the key lock.
+	delete(params, "metrics_listen")
+	iWallet, err := NewWallet(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iWallet.(Wallet).releaseKey()
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/remote-signing/wallet_plugin/address"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMigrationPollInterval = 2 * time.Second
+	defaultMigrationRPCURL       = "http://127.0.0.1:9000/api/v3"
+)
+
+// Keys of a migration.
+const (
+	keyOutgoing = "outgoing"
+	keyIncoming = "incoming"
+)
+
+// Triggers of a key switch.
+const (
+	triggerHeight = "height"
+	triggerTime   = "time"
+	triggerAdmin  = "admin"
+)
+
+// migrationState is kept in the migration_state file, so a switch survives
+// a restart. An operator edits active or retired in the file to switch, roll
+// back or retire the outgoing key; the wallet applies the change and writes
+// the file back.
+type migrationState struct {
+	Active   string    `json:"active"`
+	Auto     bool      `json:"auto"` // the height and time triggers are armed
+	Retired  bool      `json:"retired"`
+	Outgoing string    `json:"outgoing"`
+	Incoming string    `json:"incoming"`
+	Trigger  string    `json:"trigger,omitempty"`
+	Changed  time.Time `json:"changed,omitempty"`
+}
+
+// MigrationWallet signs with an outgoing key until it switches to an incoming
+// one, e.g. to move a validator from an AWS key to a GCP key it registered
+// as its new node key. It switches once the node reaches migration_height,
+// at migration_time or when an operator sets active to incoming in the
+// migration_state file, whichever comes first.
+//
+// Setting active back to outgoing rolls the switch back and disarms the
+// height and time triggers. That is possible until retired is set, which
+// closes the outgoing signer and releases its key for good.
+type MigrationWallet struct {
+	// mu is held for reading by Sign calls, so a switch waits for the
+	// calls signing with the other key.
+	mu       sync.RWMutex
+	outgoing *Wallet // nil once retired
+	incoming Wallet
+	state    migrationState
+
+	statePath string
+	written   []byte // the state file as last written
+
+	height   int64     // 0 if not set
+	at       time.Time // zero if not set
+	rpcURL   string
+	client   *http.Client
+	interval time.Duration
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newMigrationWallet loads the outgoing wallet from params and the incoming
+// one from the migration_incoming param, a JSON object of the params in
+// which it differs. Both are self-tested unless the outgoing key is retired,
+// in which case it is not loaded at all.
+func newMigrationWallet(params map[string]string) (*MigrationWallet, error) {
+	if err := requireParams(params, "migration_state"); err != nil {
+		return nil, err
+	}
+	m := &MigrationWallet{
+		statePath: params["migration_state"],
+		rpcURL:    defaultMigrationRPCURL,
+		client:    &http.Client{Timeout: time.Second},
+		interval:  defaultMigrationPollInterval,
+		stop:      make(chan struct{}),
+	}
+	if v := params["migration_height"]; v != "" {
+		h, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || h <= 0 {
+			return nil, invalidParam("migration_height", fmt.Errorf("%q is not a block height", v))
+		}
+		m.height = h
+	}
+	if v := params["migration_time"]; v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, invalidParam("migration_time", err)
+		}
+		m.at = t
+	}
+	if v := params["migration_rpc_url"]; v != "" {
+		m.rpcURL = v
+	}
+	if v := params["migration_poll_interval"]; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, invalidParam("migration_poll_interval", fmt.Errorf("%q is not a positive duration", v))
+		}
+		m.interval = d
+	}
+	incomingParams, err := migrationIncomingParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := readMigrationState(m.statePath)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		state = &migrationState{Active: keyOutgoing, Auto: true}
+	}
+
+	if !state.Retired {
+		logger.Info("loading outgoing key")
+		outgoing, err := loadWallet(params)
+		if err != nil {
+			return nil, err
+		}
+		m.outgoing = &outgoing
+	}
+	logger.Info("loading incoming key")
+	if m.incoming, err = loadWallet(incomingParams); err != nil {
+		m.closeWallets()
+		return nil, err
+	}
+	if m.outgoing != nil {
+		m.incoming.control = m.outgoing.control
+	}
+	if err := m.checkState(state); err != nil {
+		m.closeWallets()
+		return nil, err
+	}
+	m.state = *state
+	if err := m.save(); err != nil {
+		m.closeWallets()
+		return nil, err
+	}
+
+	logger.Info("key migration loaded", "active", m.state.Active, "outgoing", m.state.Outgoing, "incoming", m.state.Incoming,
+		"height", m.height, "time", m.at, "auto", m.state.Auto, "retired", m.state.Retired)
+	if err := m.poll(); err != nil {
+		logger.Warn("key migration check failed", "err", err)
+	}
+	go m.watch()
+	return m, nil
+}
+
+// migrationIncomingParams returns the params of the incoming key. They
+// inherit the params of the outgoing key other than its backend fields if
+// the backend type changes, so a new AWS key only needs its key_id while an
+// AWS to GCP migration does not pass the AWS key_id to the GCP backend.
+func migrationIncomingParams(params map[string]string) (map[string]string, error) {
+	if err := requireParams(params, "migration_incoming"); err != nil {
+		return nil, err
+	}
+	var entry map[string]string
+	if err := json.Unmarshal([]byte(params["migration_incoming"]), &entry); err != nil {
+		return nil, invalidParam("migration_incoming", err)
+	}
+
+	outgoingType := signerName(params["kms_type"])
+	incomingType := outgoingType
+	if t, ok := entry["kms_type"]; ok {
+		incomingType = signerName(t)
+	}
+	merged := make(map[string]string, len(params)+len(entry))
+	for k, v := range params {
+		if k == "backends" || strings.HasPrefix(k, "migration_") {
+			continue
+		}
+		if _, ok := backendFields[outgoingType][k]; ok && incomingType != outgoingType {
+			continue
+		}
+		merged[k] = v
+	}
+	for k, v := range entry {
+		merged[k] = v
+	}
+	return merged, nil
+}
+
+// checkState completes a new state with the addresses of the keys, or checks
+// that a loaded one was written for them.
+func (m *MigrationWallet) checkState(s *migrationState) error {
+	incoming := m.incoming.addr.String()
+	if m.outgoing != nil && m.outgoing.addr.Equal(m.incoming.addr) {
+		return walleterr.New(walleterr.ErrConfigInvalidParam, "invalid inputs: migration_incoming holds the outgoing key "+incoming)
+	}
+	if s.Outgoing == "" {
+		if m.outgoing == nil {
+			return invalidParam("migration_state", errors.New("outgoing key retired but its address is missing"))
+		}
+		s.Outgoing, s.Incoming = m.outgoing.addr.String(), incoming
+	}
+	if (m.outgoing != nil && s.Outgoing != m.outgoing.addr.String()) || s.Incoming != incoming {
+		str := fmt.Sprintf("invalid inputs: migration_state %s is for %s to %s", m.statePath, s.Outgoing, s.Incoming)
+		return walleterr.New(walleterr.ErrConfigInvalidParam, str)
+	}
+	if s.Active != keyOutgoing && s.Active != keyIncoming {
+		return invalidParam("migration_state", fmt.Errorf("active %q is neither %s nor %s", s.Active, keyOutgoing, keyIncoming))
+	}
+	if s.Retired && s.Active != keyIncoming {
+		return invalidParam("migration_state", errors.New("outgoing key retired while active"))
+	}
+	return nil
+}
+
+func readMigrationState(path string) (*migrationState, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, invalidParam("migration_state", err)
+	}
+	s := &migrationState{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, invalidParam("migration_state", err)
+	}
+	return s, nil
+}
+
+// save writes the state file, replacing it in one rename.
+func (m *MigrationWallet) save() error {
+	b, err := json.MarshalIndent(m.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	tmp := m.statePath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return walleterr.Wrap(walleterr.ErrConfigInvalidParam, err, "write migration_state")
+	}
+	if err := os.Rename(tmp, m.statePath); err != nil {
+		return walleterr.Wrap(walleterr.ErrConfigInvalidParam, err, "write migration_state")
+	}
+	m.written = b
+	return nil
+}
+
+// active returns the wallet of the active key. m.mu must be held.
+func (m *MigrationWallet) active() Wallet {
+	if m.state.Active == keyOutgoing {
+		return *m.outgoing
+	}
+	return m.incoming
+}
+
+func (m *MigrationWallet) Address() address.IAddress {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.active().Address()
+}
+
+func (m *MigrationWallet) PublicKey() []byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.active().PublicKey()
+}
+
+func (m *MigrationWallet) Health() Health {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.active().Health()
+}
+
+// SelfTest tests the active key.
+func (m *MigrationWallet) SelfTest() (Attestation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.active().SelfTest()
+}
+
+func (m *MigrationWallet) Sign(data []byte) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.active().Sign(data)
+}
+
+// MigrationStatus returns the state of the migration.
+func (m *MigrationWallet) MigrationStatus() migrationState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state
+}
+
+// SwitchToIncoming makes the incoming key the active one.
+func (m *MigrationWallet) SwitchToIncoming(trigger string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.switchKey(keyIncoming, trigger)
+}
+
+// Rollback makes the outgoing key the active one again and disarms the
+// height and time triggers. It fails once the outgoing key is retired, and
+// leaves the triggers armed while the outgoing key still is active.
+func (m *MigrationWallet) Rollback(trigger string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state.Retired {
+		return walleterr.New(walleterr.ErrKeyStateInvalid, "outgoing key "+m.state.Outgoing+" is retired")
+	}
+	if m.state.Active == keyOutgoing {
+		return nil
+	}
+	if m.state.Auto {
+		m.state.Auto = false
+		if err := m.save(); err != nil {
+			m.state.Auto = true
+			return err
+		}
+	}
+	return m.switchKey(keyOutgoing, trigger)
+}
+
+// RetireOutgoing closes the signer of the outgoing key and releases its key
+// lock and lease. It fails unless the incoming key is active.
+func (m *MigrationWallet) RetireOutgoing() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state.Retired {
+		return nil
+	}
+	if m.state.Active != keyIncoming {
+		return walleterr.New(walleterr.ErrKeyStateInvalid, "outgoing key "+m.state.Outgoing+" is still active")
+	}
+	m.state.Retired = true
+	if err := m.save(); err != nil {
+		m.state.Retired = false
+		return err
+	}
+	m.outgoing.releaseKey()
+	closeSigner(m.outgoing.signer)
+	m.outgoing = nil
+	logger.Warn("outgoing key retired", "address", m.state.Outgoing)
+	return nil
+}
+
+// switchKey makes key the active one. m.mu must be held for writing.
+func (m *MigrationWallet) switchKey(key, trigger string) error {
+	if m.state.Active == key {
+		return nil
+	}
+	prev := m.state
+	m.state.Active, m.state.Trigger, m.state.Changed = key, trigger, time.Now().UTC()
+	if err := m.save(); err != nil {
+		m.state = prev
+		return err
+	}
+	keySwitches.Inc(key, trigger)
+	logger.Warn("signing key switched", "to", key, "address", m.active().addr, "trigger", trigger)
+	return nil
+}
+
+// autoSwitch switches to the incoming key unless the triggers were disarmed
+// in the meantime.
+func (m *MigrationWallet) autoSwitch(trigger string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.state.Auto {
+		return nil
+	}
+	return m.switchKey(keyIncoming, trigger)
+}
+
+// Close stops the triggers. The active key keeps signing.
+func (m *MigrationWallet) Close() {
+	m.stopOnce.Do(func() { close(m.stop) })
+}
+
+func (m *MigrationWallet) closeWallets() {
+	if m.outgoing != nil {
+		m.outgoing.releaseKey()
+		closeSigner(m.outgoing.signer)
+	}
+	if m.incoming.signer != nil {
+		m.incoming.releaseKey()
+		closeSigner(m.incoming.signer)
+	}
+}
+
+func (m *MigrationWallet) watch() {
+	t := time.NewTicker(m.interval)
+	defer t.Stop()
+	var lastErr string
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-t.C:
+		}
+		err := m.poll()
+		if err != nil && err.Error() != lastErr {
+			logger.Warn("key migration check failed", "err", err)
+		}
+		lastErr = ""
+		if err != nil {
+			lastErr = err.Error()
+		}
+	}
+}
+
+// poll applies the changes an operator made to the state file and fires the
+// height and time triggers.
+func (m *MigrationWallet) poll() error {
+	if err := m.applyStateFile(); err != nil {
+		return err
+	}
+	m.mu.RLock()
+	armed := m.state.Auto && m.state.Active == keyOutgoing
+	m.mu.RUnlock()
+	if !armed {
+		return nil
+	}
+
+	if !m.at.IsZero() && !time.Now().Before(m.at) {
+		return m.autoSwitch(triggerTime)
+	}
+	if m.height > 0 {
+		h, err := m.lastHeight()
+		if err != nil {
+			return err
+		}
+		if h >= m.height {
+			return m.autoSwitch(triggerHeight)
+		}
+	}
+	return nil
+}
+
+// applyStateFile switches, rolls back or retires as the state file says if
+// it was changed by someone else, then writes back the resulting state.
+func (m *MigrationWallet) applyStateFile() error {
+	b, err := os.ReadFile(m.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.save()
+	}
+	if err != nil {
+		return err
+	}
+	m.mu.RLock()
+	unchanged := bytes.Equal(b, m.written)
+	m.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	var want migrationState
+	err = json.Unmarshal(b, &want)
+	if err == nil {
+		m.mu.RLock()
+		armed := m.state.Auto
+		m.mu.RUnlock()
+		logger.Info("migration_state changed", "active", want.Active, "auto", want.Auto, "retired", want.Retired)
+		// Triggers disarmed by a rollback are armed again by setting
+		// auto, not by leaving it set.
+		err = m.apply(want, want.Auto && !armed)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if serr := m.save(); err == nil {
+		err = serr
+	}
+	if err != nil {
+		return fmt.Errorf("migration_state %s: %w", m.statePath, err)
+	}
+	return nil
+}
+
+func (m *MigrationWallet) apply(want migrationState, arm bool) error {
+	switch want.Active {
+	case keyIncoming:
+		if err := m.SwitchToIncoming(triggerAdmin); err != nil {
+			return err
+		}
+	case keyOutgoing:
+		if err := m.Rollback(triggerAdmin); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("active %q is neither %s nor %s", want.Active, keyOutgoing, keyIncoming)
+	}
+	if want.Retired {
+		if err := m.RetireOutgoing(); err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if arm && !m.state.Retired && m.state.Active == keyOutgoing {
+		m.state.Auto = true
+	}
+	return nil
+}
+
+// lastHeight asks the node for the height of its last block.
+func (m *MigrationWallet) lastHeight() (int64, error) {
+	body := strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"icx_getLastBlock"}`)
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, m.rpcURL, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("block height from %s: %v", m.rpcURL, err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	var out struct {
+		Result struct {
+			Height int64 `json:"height"`
+		} `json:"result"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return 0, fmt.Errorf("block height from %s: %s: %v", m.rpcURL, resp.Status, err)
+	}
+	if out.Error != nil {
+		return 0, fmt.Errorf("block height from %s: %s", m.rpcURL, out.Error.Message)
+	}
+	return out.Result.Height, nil
+}
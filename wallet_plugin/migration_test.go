@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	crypto "github.com/remote-signing/wallet_plugin/key"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+)
+
+// migrationParams returns the params of a migration between two keystore
+// keys, with the state kept in dir.
+func migrationParams(t *testing.T, outgoing, incoming *crypto.PrivateKey, dir string) map[string]string {
+	t.Setenv("TEST_KEY_PASSWORD", "gochain@123")
+	return map[string]string{
+		"kms_type":                "keystore",
+		"keystore_path":           writeKeyStore(t, outgoing, "gochain@123", "scrypt"),
+		"password_env":            "TEST_KEY_PASSWORD",
+		"migration_incoming":      `{"keystore_path":"` + writeKeyStore(t, incoming, "gochain@123", "scrypt") + `"}`,
+		"migration_state":         filepath.Join(dir, "migration.json"),
+		"migration_poll_interval": "10ms",
+	}
+}
+
+func loadMigration(t *testing.T, params map[string]string) *MigrationWallet {
+	t.Helper()
+	iWallet, err := NewWallet(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := iWallet.(*MigrationWallet)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func waitActive(t *testing.T, m *MigrationWallet, key string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); m.MigrationStatus().Active != key; {
+		if time.Now().After(deadline) {
+			t.Fatalf("active key %s instead of %s", m.MigrationStatus().Active, key)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// editState changes the state file the way an operator would.
+func editState(t *testing.T, m *MigrationWallet, edit func(s *migrationState)) {
+	t.Helper()
+	s, err := readMigrationState(m.statePath)
+	if err != nil || s == nil {
+		t.Fatalf("state %v, %v", s, err)
+	}
+	edit(s)
+	b, _ := json.Marshal(s)
+	if err := os.WriteFile(m.statePath, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func signsWith(t *testing.T, m *MigrationWallet, pub *crypto.PublicKey) {
+	t.Helper()
+	digest := crypto.SHA3Sum256([]byte(time.Now().String()))
+	signature, err := m.Sign(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyRecoverable(t, digest, signature, pub.SerializeCompressed())
+	if !NewAccountAddressFromPublicKey(pub).Equal(m.Address()) {
+		t.Errorf("address %s", m.Address())
+	}
+}
+
+func TestMigrationAdmin(t *testing.T) {
+	outPriv, outPub := crypto.GenerateKeyPair()
+	inPriv, inPub := crypto.GenerateKeyPair()
+	dir := t.TempDir()
+	params := migrationParams(t, outPriv, inPriv, dir)
+	m := loadMigration(t, params)
+	signsWith(t, m, outPub)
+
+	editState(t, m, func(s *migrationState) { s.Active = keyIncoming })
+	waitActive(t, m, keyIncoming)
+	signsWith(t, m, inPub)
+	if s := m.MigrationStatus(); s.Trigger != triggerAdmin || s.Outgoing != NewAccountAddressFromPublicKey(outPub).String() {
+		t.Errorf("state %+v", s)
+	}
+
+	// A rollback disarms the triggers.
+	editState(t, m, func(s *migrationState) { s.Active = keyOutgoing })
+	waitActive(t, m, keyOutgoing)
+	signsWith(t, m, outPub)
+	if m.MigrationStatus().Auto {
+		t.Error("triggers armed after a rollback")
+	}
+
+	// The outgoing key can not be retired while active.
+	if err := m.RetireOutgoing(); !errors.Is(err, walleterr.ErrKeyStateInvalid) {
+		t.Fatalf("retire of the active key returned %v", err)
+	}
+	if err := m.SwitchToIncoming(triggerAdmin); err != nil {
+		t.Fatal(err)
+	}
+	editState(t, m, func(s *migrationState) { s.Retired = true })
+	for deadline := time.Now().Add(5 * time.Second); !m.MigrationStatus().Retired; {
+		if time.Now().After(deadline) {
+			t.Fatal("outgoing key not retired")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := m.Rollback(triggerAdmin); !errors.Is(err, walleterr.ErrKeyStateInvalid) {
+		t.Fatalf("rollback after retirement returned %v", err)
+	}
+	editState(t, m, func(s *migrationState) { s.Active = keyOutgoing })
+	time.Sleep(50 * time.Millisecond)
+	if s, _ := readMigrationState(m.statePath); s.Active != keyIncoming || m.MigrationStatus().Active != keyIncoming {
+		t.Fatalf("rolled back to a retired key: %+v", s)
+	}
+	m.Close()
+
+	// A restart keeps the switch and no longer needs the outgoing key.
+	params["keystore_path"] = filepath.Join(dir, "deleted.json")
+	signsWith(t, loadMigration(t, params), inPub)
+}
+
+func TestMigrationTriggers(t *testing.T) {
+	outPriv, outPub := crypto.GenerateKeyPair()
+	inPriv, inPub := crypto.GenerateKeyPair()
+
+	t.Run("time", func(t *testing.T) {
+		params := migrationParams(t, outPriv, inPriv, t.TempDir())
+		params["migration_time"] = time.Now().Add(time.Second).Format(time.RFC3339Nano)
+		m := loadMigration(t, params)
+		signsWith(t, m, outPub)
+		waitActive(t, m, keyIncoming)
+		signsWith(t, m, inPub)
+		if s := m.MigrationStatus(); s.Trigger != triggerTime {
+			t.Errorf("state %+v", s)
+		}
+	})
+
+	t.Run("state edited while armed", func(t *testing.T) {
+		params := migrationParams(t, outPriv, inPriv, t.TempDir())
+		params["migration_time"] = time.Now().Add(time.Second).Format(time.RFC3339Nano)
+		m := loadMigration(t, params)
+		editState(t, m, func(s *migrationState) { s.Active = keyOutgoing })
+		time.Sleep(50 * time.Millisecond)
+		if !m.MigrationStatus().Auto {
+			t.Fatal("triggers disarmed by an edit that kept the outgoing key")
+		}
+		waitActive(t, m, keyIncoming)
+		if s := m.MigrationStatus(); s.Trigger != triggerTime {
+			t.Errorf("state %+v", s)
+		}
+	})
+
+	t.Run("height", func(t *testing.T) {
+		var height int64 = 98
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			var req struct{ Method string }
+			if json.Unmarshal(b, &req); req.Method != "icx_getLastBlock" {
+				io.WriteString(w, `{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"method not found"}}`)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": 1,
+				"result": map[string]interface{}{"height": atomic.LoadInt64(&height), "version": "2.0"}})
+		}))
+		t.Cleanup(srv.Close)
+
+		params := migrationParams(t, outPriv, inPriv, t.TempDir())
+		params["migration_height"] = "100"
+		params["migration_rpc_url"] = srv.URL + "/api/v3"
+		switches := keySwitches.Value(keyIncoming, triggerHeight)
+		m := loadMigration(t, params)
+		time.Sleep(50 * time.Millisecond)
+		signsWith(t, m, outPub)
+		atomic.StoreInt64(&height, 100)
+		waitActive(t, m, keyIncoming)
+		signsWith(t, m, inPub)
+		if keySwitches.Value(keyIncoming, triggerHeight) != switches+1 {
+			t.Error("switch not counted")
+		}
+	})
+}
+
+func TestMigrationLoad(t *testing.T) {
+	outPriv, _ := crypto.GenerateKeyPair()
+	inPriv, inPub := crypto.GenerateKeyPair()
+
+	// Both keys are verified at startup.
+	params := migrationParams(t, outPriv, inPriv, t.TempDir())
+	params["migration_incoming"] = `{"keystore_path":"` + writeKeyStore(t, inPriv, "other", "scrypt") + `"}`
+	if _, err := NewWallet(params); !errors.Is(err, walleterr.ErrPermissionDenied) {
+		t.Errorf("incoming key with a wrong password: %v", err)
+	}
+	params = migrationParams(t, outPriv, outPriv, t.TempDir())
+	if _, err := NewWallet(params); !errors.Is(err, walleterr.ErrConfigInvalidParam) {
+		t.Errorf("migration to the same key: %v", err)
+	}
+
+	// A state file of other keys is refused.
+	dir := t.TempDir()
+	loadMigration(t, migrationParams(t, outPriv, inPriv, dir)).Close()
+	other, _ := crypto.GenerateKeyPair()
+	if _, err := NewWallet(migrationParams(t, outPriv, other, dir)); !errors.Is(err, walleterr.ErrConfigInvalidParam) {
+		t.Errorf("state of other keys: %v", err)
+	}
+
+	// A retired state file without the addresses is refused.
+	params = migrationParams(t, outPriv, inPriv, t.TempDir())
+	if err := os.WriteFile(params["migration_state"], []byte(`{"active":"incoming","retired":true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewWallet(params); !errors.Is(err, walleterr.ErrConfigInvalidParam) {
+		t.Errorf("retired state without addresses: %v", err)
+	}
+
+	// The incoming section of a config file inherits the backend section.
+	path := writeConfig(t, "wallet.yaml", keyStoreConfig(t, outPriv, `migration:
+  state: `+filepath.Join(t.TempDir(), "migration.json")+`
+  time: "2020-01-01T00:00:00Z"
+  incoming:
+    keystore_path: `+writeKeyStore(t, inPriv, "gochain@123", "scrypt")+`
+`))
+	t.Setenv("TEST_KEY_PASSWORD", "gochain@123")
+	m := loadMigration(t, map[string]string{"config_file": path})
+	signsWith(t, m, inPub)
+
+	path = writeConfig(t, "wallet.yaml", keyStoreConfig(t, outPriv, "migration:\n  state: x\n  incoming:\n    type: aws\n"))
+	if _, err := NewWallet(map[string]string{"config_file": path}); err == nil ||
+		err.Error() != "invalid inputs: config_file "+path+": 9:5: migration.incoming: missing key_id for aws backends" {
+		t.Errorf("incoming aws backend without key_id: %v", err)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/miekg/pkcs11"
+	crypto "github.com/remote-signing/wallet_plugin/key"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// secp256k1Oid is the DER encoded named curve OID 1.3.132.0.10 as found in
+// CKA_EC_PARAMS.
+var secp256k1Oid = []byte{0x06, 0x05, 0x2b, 0x81, 0x04, 0x00, 0x0a}
+
+func init() {
+	RegisterSigner("pkcs11", newPkcs11Signer)
+}
+
+// pkcs11Modules holds the modules loaded by the signers. A module is
+// initialized once per process, so a reload that opens a new session on the
+// same token shares it with the old signer until that one is closed.
+var pkcs11Modules = struct {
+	sync.Mutex
+	loaded map[string]*pkcs11Module
+}{loaded: make(map[string]*pkcs11Module)}
+
+type pkcs11Module struct {
+	ctx  *pkcs11.Ctx
+	refs int
+}
+
+// loadPkcs11Module returns the initialized module at path.
+func loadPkcs11Module(path string) (*pkcs11.Ctx, error) {
+	pkcs11Modules.Lock()
+	defer pkcs11Modules.Unlock()
+	if m, ok := pkcs11Modules.loaded[path]; ok {
+		m.refs++
+		return m.ctx, nil
+	}
+
+	p := pkcs11.New(path)
+	if p == nil {
+		str := fmt.Sprintf("invalid inputs: can not load PKCS#11 module %s", path)
+		return nil, walleterr.New(walleterr.ErrConfigInvalidParam, str)
+	}
+	if err := p.Initialize(); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)) {
+		p.Destroy()
+		return nil, pkcs11Error(err, "PKCS#11 initialize")
+	}
+	pkcs11Modules.loaded[path] = &pkcs11Module{ctx: p, refs: 1}
+	return p, nil
+}
+
+// unloadPkcs11Module finalizes the module at path once no signer uses it.
+func unloadPkcs11Module(path string) {
+	pkcs11Modules.Lock()
+	defer pkcs11Modules.Unlock()
+	m, ok := pkcs11Modules.loaded[path]
+	if !ok {
+		return
+	}
+	if m.refs--; m.refs > 0 {
+		return
+	}
+	delete(pkcs11Modules.loaded, path)
+	_ = m.ctx.Finalize()
+	m.ctx.Destroy()
+}
+
+// pkcs11Signer signs with an EC secp256k1 key held in a PKCS#11 token.
+type pkcs11Signer struct {
+	// A PKCS#11 session must not be used by several goroutines at once.
+	mu      sync.Mutex
+	module  string
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+	pkey    *crypto.PublicKey
+}
+
+func newPkcs11Signer(params map[string]string) (Signer, error) {
+	if err := requireParams(params, "pkcs11_module"); err != nil {
+		return nil, err
+	}
+	modulePath := params["pkcs11_module"]
+	tokenLabel := params["token_label"]
+	slotId := params["slot_id"]
+	keyLabel := params["key_label"]
+	keyId := params["key_id"]
+	pin := params["pin"]
+	if pinFile := params["pin_file"]; pinFile != "" {
+		b, err := os.ReadFile(pinFile)
+		if err != nil {
+			return nil, invalidParam("pin_file", err)
+		}
+		pin = strings.TrimSpace(string(b))
+	}
+
+	if pin == "" {
+		return nil, walleterr.New(walleterr.ErrConfigMissingParam, "invalid inputs: missing pin or pin_file")
+	}
+	if tokenLabel == "" && slotId == "" {
+		return nil, walleterr.New(walleterr.ErrConfigMissingParam, "invalid inputs: missing token_label or slot_id")
+	}
+	if keyLabel == "" && keyId == "" {
+		return nil, walleterr.New(walleterr.ErrConfigMissingParam, "invalid inputs: missing key_label or key_id")
+	}
+
+	var id []byte
+	if keyId != "" {
+		var err error
+		if id, err = hex.DecodeString(keyId); err != nil {
+			return nil, invalidParam("key_id", err)
+		}
+	}
+
+	p, err := loadPkcs11Module(modulePath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &pkcs11Signer{module: modulePath, ctx: p}
+	if err := s.open(tokenLabel, slotId, pin, keyLabel, id); err != nil {
+		s.close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *pkcs11Signer) open(tokenLabel, slotId, pin, keyLabel string, keyId []byte) error {
+	slot, err := s.findSlot(tokenLabel, slotId)
+	if err != nil {
+		return err
+	}
+
+	s.session, err = s.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return pkcs11Error(err, "PKCS#11 open session")
+	}
+	if err = s.ctx.Login(s.session, pkcs11.CKU_USER, pin); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+		return pkcs11Error(err, "PKCS#11 login")
+	}
+
+	s.key, err = s.findObject(pkcs11.CKO_PRIVATE_KEY, keyLabel, keyId)
+	if err != nil {
+		return err
+	}
+	pub, err := s.findObject(pkcs11.CKO_PUBLIC_KEY, keyLabel, keyId)
+	if err != nil {
+		return err
+	}
+
+	attrs, err := s.ctx.GetAttributeValue(s.session, pub, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return pkcs11Error(err, "PKCS#11 get attributes")
+	}
+	if !bytes.Equal(attrs[0].Value, secp256k1Oid) {
+		str := fmt.Sprintf("PKCS#11 key has EC params %x instead of secp256k1", attrs[0].Value)
+		return walleterr.New(walleterr.ErrKeyAlgorithmMismatch, str)
+	}
+
+	s.pkey, err = parseEcPoint(attrs[1].Value)
+	if err != nil {
+		return walleterr.Wrap(walleterr.ErrKeyAlgorithmMismatch, err, "PKCS#11 EC point")
+	}
+	return nil
+}
+
+func (s *pkcs11Signer) findSlot(tokenLabel, slotId string) (uint, error) {
+	if slotId != "" {
+		id, err := strconv.ParseUint(slotId, 10, 32)
+		if err != nil {
+			return 0, invalidParam("slot_id", err)
+		}
+		return uint(id), nil
+	}
+
+	slots, err := s.ctx.GetSlotList(true)
+	if err != nil {
+		return 0, pkcs11Error(err, "PKCS#11 slot list")
+	}
+	for _, slot := range slots {
+		info, err := s.ctx.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+		if strings.TrimRight(info.Label, " \x00") == tokenLabel {
+			return slot, nil
+		}
+	}
+	str := fmt.Sprintf("PKCS#11 token %q not found", tokenLabel)
+	return 0, walleterr.New(walleterr.ErrConfigInvalidParam, str)
+}
+
+func (s *pkcs11Signer) findObject(class uint, label string, id []byte) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+	}
+	if label != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, label))
+	}
+	if id != nil {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, id))
+	}
+
+	if err := s.ctx.FindObjectsInit(s.session, template); err != nil {
+		return 0, pkcs11Error(err, "PKCS#11 find objects")
+	}
+	objs, _, err := s.ctx.FindObjects(s.session, 2)
+	if finalErr := s.ctx.FindObjectsFinal(s.session); err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return 0, pkcs11Error(err, "PKCS#11 find objects")
+	}
+
+	switch len(objs) {
+	case 0:
+		str := fmt.Sprintf("PKCS#11 key (label=%q id=%x) not found", label, id)
+		return 0, walleterr.New(walleterr.ErrKeyNotFound, str)
+	case 1:
+		return objs[0], nil
+	default:
+		str := fmt.Sprintf("PKCS#11 key (label=%q id=%x) is ambiguous", label, id)
+		return 0, walleterr.New(walleterr.ErrConfigInvalidParam, str)
+	}
+}
+
+// parseEcPoint parses CKA_EC_POINT, which the standard defines as a DER
+// OCTET STRING but some modules return as the raw point.
+func parseEcPoint(point []byte) (*crypto.PublicKey, error) {
+	var raw []byte
+	if rest, err := asn1.Unmarshal(point, &raw); err == nil && len(rest) == 0 {
+		point = raw
+	}
+	return crypto.ParsePublicKey(point)
+}
+
+func (s *pkcs11Signer) PublicKey() *crypto.PublicKey {
+	return s.pkey
+}
+
+// DescribeKey reports the attributes of the private key. A key that was not
+// generated on the token (CKA_LOCAL) has been imported, one that is
+// extractable or not sensitive may have left it.
+func (s *pkcs11Signer) DescribeKey(_ context.Context) (KeyDescription, error) {
+	s.mu.Lock()
+	attrs, err := s.ctx.GetAttributeValue(s.session, s.key, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_LOCAL, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, nil),
+	})
+	s.mu.Unlock()
+	if err != nil {
+		return KeyDescription{}, pkcs11Error(err, "PKCS#11 get attributes")
+	}
+	flag := func(a *pkcs11.Attribute) bool {
+		return len(a.Value) == 1 && a.Value[0] != 0
+	}
+
+	desc := KeyDescription{
+		KeyID:           fmt.Sprintf("label=%s id=%x", attrs[0].Value, attrs[1].Value),
+		KeySpec:         "CKK_EC/secp256k1",
+		KeyUsage:        "CKA_SIGN",
+		KeyState:        "ENABLED",
+		ProtectionLevel: "HSM",
+		Origin:          "GENERATED",
+	}
+	if !flag(attrs[3]) {
+		desc.Origin = "IMPORTED"
+	}
+	if !flag(attrs[4]) || flag(attrs[5]) {
+		desc.ProtectionLevel = "EXTRACTABLE"
+	}
+	if !flag(attrs[2]) {
+		desc.KeyUsage = ""
+		return desc, walleterr.New(walleterr.ErrKeyAlgorithmMismatch, "PKCS#11 key does not allow CKA_SIGN")
+	}
+	return desc, nil
+}
+
+func (s *pkcs11Signer) SignDigest(_ context.Context, digest []byte) ([]byte, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}
+	if err := s.ctx.SignInit(s.session, mech, s.key); err != nil {
+		return nil, nil, pkcs11Error(err, "PKCS#11 sign init")
+	}
+	sig, err := s.ctx.Sign(s.session, digest)
+	if err != nil {
+		return nil, nil, pkcs11Error(err, "PKCS#11 sign")
+	}
+
+	// CKM_ECDSA returns r|s, each padded to the size of the curve order.
+	if len(sig) != crypto.SignatureLenRaw {
+		str := fmt.Sprintf("PKCS#11 signature has %d bytes instead of %d", len(sig), crypto.SignatureLenRaw)
+		return nil, nil, walleterr.New(walleterr.ErrSignatureMalformed, str)
+	}
+	return sig[:32], sig[32:], nil
+}
+
+// pkcs11Error wraps an error returned by the PKCS#11 module with the kind that
+// matches its return value.
+func pkcs11Error(err error, desc string) error {
+	var rv pkcs11.Error
+	if !errors.As(err, &rv) {
+		return walleterr.Wrap(walleterr.ErrBackendUnavailable, err, desc)
+	}
+
+	kind := walleterr.ErrBackendUnavailable
+	switch rv {
+	case pkcs11.CKR_PIN_INCORRECT, pkcs11.CKR_PIN_INVALID, pkcs11.CKR_PIN_LEN_RANGE,
+		pkcs11.CKR_PIN_EXPIRED, pkcs11.CKR_PIN_LOCKED, pkcs11.CKR_USER_NOT_LOGGED_IN,
+		pkcs11.CKR_KEY_FUNCTION_NOT_PERMITTED:
+		kind = walleterr.ErrPermissionDenied
+	case pkcs11.CKR_SLOT_ID_INVALID, pkcs11.CKR_TOKEN_NOT_PRESENT, pkcs11.CKR_TOKEN_NOT_RECOGNIZED:
+		kind = walleterr.ErrConfigInvalidParam
+	case pkcs11.CKR_KEY_HANDLE_INVALID, pkcs11.CKR_OBJECT_HANDLE_INVALID:
+		kind = walleterr.ErrKeyNotFound
+	case pkcs11.CKR_KEY_TYPE_INCONSISTENT, pkcs11.CKR_MECHANISM_INVALID:
+		kind = walleterr.ErrKeyAlgorithmMismatch
+	}
+	return walleterr.Wrap(kind, err, desc)
+}
+
+// close closes the session of s. The login is left to the last session of the
+// module, since a logout would end it for every session on the token.
+func (s *pkcs11Signer) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.session != 0 {
+		_ = s.ctx.CloseSession(s.session)
+		s.session = 0
+	}
+	unloadPkcs11Module(s.module)
+}
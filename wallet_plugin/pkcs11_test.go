@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+func TestParseEcPoint(t *testing.T) {
+	signer := newFakeSigner(t)
+	raw := signer.PublicKey().SerializeUncompressed()
+	der, err := asn1.Marshal(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, point := range map[string][]byte{"der": der, "raw": raw} {
+		pkey, err := parseEcPoint(point)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !pkey.Equal(signer.PublicKey()) {
+			t.Fatalf("%s: parsed %s, want %s", name, pkey, signer.PublicKey())
+		}
+	}
+}
+
+// TestPkcs11SoftHSM runs against an initialized SoftHSM2 token, e.g.
+//
+//	softhsm2-util --init-token --free --label wallet-test --pin 1234 --so-pin 1234
+//	SOFTHSM2_MODULE=/usr/lib/softhsm/libsofthsm2.so SOFTHSM2_TOKEN=wallet-test SOFTHSM2_PIN=1234 go test -run Pkcs11
+func TestPkcs11SoftHSM(t *testing.T) {
+	module := os.Getenv("SOFTHSM2_MODULE")
+	tokenLabel := os.Getenv("SOFTHSM2_TOKEN")
+	pin := os.Getenv("SOFTHSM2_PIN")
+	if module == "" || tokenLabel == "" || pin == "" {
+		t.Skip("SoftHSM2 not configured")
+	}
+
+	keyLabel := fmt.Sprintf("wallet-test-%d", time.Now().UnixNano())
+	generatePkcs11Key(t, module, tokenLabel, pin, keyLabel)
+
+	iWallet, err := NewWallet(map[string]string{
+		"kms_type":      "pkcs11",
+		"pkcs11_module": module,
+		"token_label":   tokenLabel,
+		"pin":           pin,
+		"key_label":     keyLabel,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	walletInst := iWallet.(walletImpl)
+
+	signData, _ := hex.DecodeString("356355dae4212533ce182cbb31492a6c2665fcf8f17e089d929e7a3efd1d1ba1")
+	for i := 0; i < 8; i++ {
+		signature, err := walletInst.Sign(signData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifyRecoverable(t, signData, signature, walletInst.PublicKey())
+	}
+}
+
+func generatePkcs11Key(t *testing.T, module, tokenLabel, pin, keyLabel string) {
+	t.Helper()
+	p := pkcs11.New(module)
+	if p == nil {
+		t.Fatalf("can not load %s", module)
+	}
+	if err := p.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Destroy()
+	defer p.Finalize()
+
+	s := &pkcs11Signer{ctx: p}
+	slot, err := s.findSlot(tokenLabel, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := p.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.CloseSession(session)
+	if err := p.Login(session, pkcs11.CKU_USER, pin); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Logout(session)
+
+	_, _, err = p.GenerateKeyPair(session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, secp256k1Oid),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel),
+		},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel),
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/remote-signing/wallet_plugin/address"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const defaultConfigWatchInterval = 5 * time.Second
+
+// keyStateParams configure the key lock and the signer lease. They are kept
+// by a reload that does not change the address and only take effect on a
+// restart.
+var keyStateParams = []string{
+	"state_dir", "duplicate_digest", "sign_history_size",
+	"lease_type", "lease_ttl", "lease_holder", "lease_key", "lease_dir", "lease_table",
+	"lease_region", "lease_endpoint_url", "lease_bucket", "lease_object",
+}
+
+// processParams configure the metrics listener and the open audit logs,
+// which the wallets of the process share. Every reload keeps them, so they
+// only take effect on a restart too.
+var processParams = []string{"metrics_listen", "audit_max_size"}
+
+// ReloadableWallet is the wallet of a config_file. It loads the file again
+// when it changes, which covers the files its secrets refer to, or when the
+// process gets SIGHUP, which always rebuilds the clients of the backends and
+// so refreshes their credentials.
+//
+// A reload builds and self-tests a complete new wallet before it replaces the
+// current one, so a Sign call uses either the old or the new signer and a
+// failed reload leaves the old one in place. The key lock and the signer
+// lease carry over to the new wallet. A reload that would change the address
+// is refused unless allow_address_change is true.
+type ReloadableWallet struct {
+	params map[string]string // as given to NewWallet
+
+	current atomic.Value // *walletGeneration
+
+	// reloadMu serializes reloads. last holds the flat params of the last
+	// one, so the watcher does not retry a bad config until it changes.
+	reloadMu sync.Mutex
+	last     map[string]string
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// walletGeneration is the wallet of one load of the config. Sign calls hold
+// mu for reading, so once a reload holds it for writing the old signer is
+// idle and can be closed.
+type walletGeneration struct {
+	Wallet
+	params map[string]string
+
+	mu      sync.RWMutex
+	retired bool
+}
+
+// newReloadableWallet loads the wallet of the config_file param and watches
+// the file every config_watch_interval (default 5s, 0 to only reload on
+// SIGHUP). Without config_file it loads the wallet of params, which is only
+// reloaded by calling Reload.
+func newReloadableWallet(params map[string]string) (*ReloadableWallet, error) {
+	flat, err := loadConfigFile(params)
+	if err != nil {
+		return nil, err
+	}
+	interval := defaultConfigWatchInterval
+	if v := flat["config_watch_interval"]; v != "" {
+		if interval, err = time.ParseDuration(v); err != nil || interval < 0 {
+			return nil, invalidParam("config_watch_interval", fmt.Errorf("%q is not a duration, or 0 to only reload on SIGHUP", v))
+		}
+	}
+	if err := checkAllowAddressChange(flat); err != nil {
+		return nil, err
+	}
+
+	wallet, err := loadWallet(flat)
+	if err != nil {
+		return nil, err
+	}
+	r := &ReloadableWallet{params: params, last: flat, stop: make(chan struct{})}
+	r.current.Store(&walletGeneration{Wallet: wallet, params: flat})
+
+	if params["config_file"] == "" {
+		return r, nil
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go r.watch(interval, hup)
+	logger.Info("watching config file", "path", params["config_file"], "interval", interval)
+	return r, nil
+}
+
+func checkAllowAddressChange(params map[string]string) error {
+	switch params["allow_address_change"] {
+	case "", "true", "false":
+		return nil
+	default:
+		return invalidParam("allow_address_change", errors.New(`not "true" or "false"`))
+	}
+}
+
+func (r *ReloadableWallet) generation() *walletGeneration {
+	return r.current.Load().(*walletGeneration)
+}
+
+func (r *ReloadableWallet) Address() address.IAddress {
+	return r.generation().Address()
+}
+
+func (r *ReloadableWallet) PublicKey() []byte {
+	return r.generation().PublicKey()
+}
+
+func (r *ReloadableWallet) Health() Health {
+	return r.generation().Health()
+}
+
+func (r *ReloadableWallet) SelfTest() (Attestation, error) {
+	g := r.generation()
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.SelfTest()
+}
+
+// Sign signs data with the current wallet. A call that catches a wallet just
+// as a reload retires it moves on to the new one.
+func (r *ReloadableWallet) Sign(data []byte) ([]byte, error) {
+	for {
+		g := r.generation()
+		g.mu.RLock()
+		if g.retired {
+			g.mu.RUnlock()
+			continue
+		}
+		signature, err := g.Sign(data)
+		g.mu.RUnlock()
+		return signature, err
+	}
+}
+
+// Reload loads the config file again and replaces the wallet with one built
+// from it, even if the config did not change.
+func (r *ReloadableWallet) Reload() error {
+	params, err := loadConfigFile(r.params)
+	if err != nil {
+		r.reloaded(err)
+		return err
+	}
+	return r.reload(params)
+}
+
+// Close stops watching the config file. The current wallet keeps signing.
+func (r *ReloadableWallet) Close() {
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
+func (r *ReloadableWallet) watch(interval time.Duration, hup chan os.Signal) {
+	defer signal.Stop(hup)
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	var lastErr string
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-hup:
+			logger.Info("SIGHUP, reloading config file", "path", r.params["config_file"])
+			_ = r.Reload()
+		case <-tick:
+			params, err := loadConfigFile(r.params)
+			if err != nil {
+				// Report a broken file once, not on every tick.
+				if err.Error() != lastErr {
+					lastErr = err.Error()
+					r.reloaded(err)
+				}
+				continue
+			}
+			lastErr = ""
+			r.reloadMu.Lock()
+			changed := !reflect.DeepEqual(params, r.last)
+			r.reloadMu.Unlock()
+			if changed {
+				_ = r.reload(params)
+			}
+		}
+	}
+}
+
+// reload replaces the wallet with one built from params.
+func (r *ReloadableWallet) reload(params map[string]string) error {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+	r.last = params
+
+	err := r.swap(params)
+	r.reloaded(err)
+	return err
+}
+
+func (r *ReloadableWallet) reloaded(err error) {
+	configReloads.Inc(resultLabel(err))
+	if err != nil {
+		logger.Error("config reload failed, keeping the current wallet", "path", r.params["config_file"], "err", err)
+	}
+}
+
+func (r *ReloadableWallet) swap(params map[string]string) error {
+	if err := checkAllowAddressChange(params); err != nil {
+		return err
+	}
+	if err := configureLogger(params); err != nil {
+		return err
+	}
+	old := r.generation()
+	wallet, err := newSignerWallet(params)
+	if err != nil {
+		return err
+	}
+
+	sameAddress := wallet.addr.Equal(old.addr)
+	wallet.control = old.control
+	if sameAddress {
+		wallet.guard, wallet.lease, wallet.stopLease = old.guard, old.lease, old.stopLease
+		for _, k := range keyStateParams {
+			if params[k] != old.params[k] {
+				logger.Warn("config change takes effect on restart", "param", k)
+			}
+		}
+	} else {
+		if params["allow_address_change"] != "true" {
+			closeSigner(wallet.signer)
+			str := fmt.Sprintf("invalid inputs: reload would change the address from %s to %s without allow_address_change", old.addr, wallet.addr)
+			return walleterr.New(walleterr.ErrConfigInvalidParam, str)
+		}
+		if err := wallet.claimKey(params); err != nil {
+			closeSigner(wallet.signer)
+			return err
+		}
+	}
+	for _, k := range processParams {
+		if params[k] != old.params[k] {
+			logger.Warn("config change takes effect on restart", "param", k)
+		}
+	}
+	if wallet.audit, err = newAuditor(params); err != nil {
+		if !sameAddress {
+			wallet.releaseKey()
+		}
+		closeSigner(wallet.signer)
+		return err
+	}
+
+	r.current.Store(&walletGeneration{Wallet: wallet, params: params})
+
+	// Wait for the Sign calls of the old wallet before closing its signer.
+	old.mu.Lock()
+	old.retired = true
+	old.mu.Unlock()
+	closeSigner(old.signer)
+	if !sameAddress {
+		old.releaseKey()
+		logger.Warn("wallet address changed", "from", old.addr, "to", wallet.addr)
+	}
+	logger.Info("wallet reloaded", "backend", wallet.backendName(), "address", wallet.addr)
+	return nil
+}
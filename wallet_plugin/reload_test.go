@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	crypto "github.com/remote-signing/wallet_plugin/key"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+)
+
+// keyStoreConfig returns a config_file for a keystore wallet of priv with the
+// given extra sections.
+func keyStoreConfig(t *testing.T, priv *crypto.PrivateKey, extra string) string {
+	return `
+backend:
+  type: keystore
+  keystore_path: ` + writeKeyStore(t, priv, "gochain@123", "scrypt") + `
+  password_env: TEST_KEY_PASSWORD
+` + extra
+}
+
+func loadReloadable(t *testing.T, path string) *ReloadableWallet {
+	t.Helper()
+	iWallet, err := NewWallet(map[string]string{"config_file": path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := iWallet.(*ReloadableWallet)
+	t.Cleanup(r.Close)
+	return r
+}
+
+func rewriteConfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadWallet(t *testing.T) {
+	t.Setenv("TEST_KEY_PASSWORD", "gochain@123")
+	priv, pub := crypto.GenerateKeyPair()
+	stateDir := t.TempDir()
+	state := "policy:\n  state_dir: " + stateDir + "\n  self_test: false\nreload:\n  watch_interval: 0s\n"
+	path := writeConfig(t, "wallet.yaml", keyStoreConfig(t, priv, state))
+	r := loadReloadable(t, path)
+	addr := r.Address()
+
+	digest := crypto.SHA3Sum256([]byte("reload"))
+	if _, err := r.Sign(digest); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new keystore file of the same key is picked up, and the key lock
+	// carries over instead of being taken twice.
+	first := r.generation()
+	rewriteConfig(t, path, keyStoreConfig(t, priv, state))
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if r.generation() == first || !first.retired {
+		t.Fatal("reload kept the old wallet")
+	}
+	if r.generation().guard != first.guard {
+		t.Error("reload took the key lock again")
+	}
+	signature, err := r.Sign(crypto.SHA3Sum256([]byte("after reload")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyRecoverable(t, crypto.SHA3Sum256([]byte("after reload")), signature, pub.SerializeCompressed())
+
+	// The history carries over too.
+	duplicates := duplicateDigests.Value("warn")
+	if _, err := r.Sign(digest); err != nil {
+		t.Fatal(err)
+	}
+	if duplicateDigests.Value("warn") == duplicates {
+		t.Error("digest signed before the reload was not found in the history")
+	}
+
+	// Another key is refused, and the wallet keeps signing with the old one.
+	other, otherPub := crypto.GenerateKeyPair()
+	rewriteConfig(t, path, keyStoreConfig(t, other, state))
+	current := r.generation()
+	if err := r.Reload(); !errors.Is(err, walleterr.ErrConfigInvalidParam) {
+		t.Fatalf("reload to another key returned %v", err)
+	}
+	if r.generation() != current || !r.Address().Equal(addr) {
+		t.Fatal("refused reload replaced the wallet")
+	}
+
+	// Unless the config allows it.
+	rewriteConfig(t, path, keyStoreConfig(t, other, state+"  allow_address_change: true\n"))
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(r.PublicKey(), otherPub.SerializeCompressed()) {
+		t.Fatal("address change not applied")
+	}
+	if _, err := r.Sign(digest); err != nil {
+		t.Fatal(err)
+	}
+	// The lock of the old address was released.
+	g, err := newSignGuard(map[string]string{"state_dir": stateDir}, addr.String())
+	if err != nil {
+		t.Fatalf("old key still locked: %v", err)
+	}
+	g.close()
+
+	// A broken file leaves the wallet in place.
+	current = r.generation()
+	rewriteConfig(t, path, "backend: [")
+	if err := r.Reload(); err == nil || r.generation() != current {
+		t.Fatalf("broken config reloaded: %v", err)
+	}
+}
+
+func TestReloadWatch(t *testing.T) {
+	t.Setenv("TEST_KEY_PASSWORD", "gochain@123")
+	priv, _ := crypto.GenerateKeyPair()
+	extra := "policy:\n  self_test: false\nreload:\n  watch_interval: 10ms\n"
+	path := writeConfig(t, "wallet.yaml", keyStoreConfig(t, priv, extra))
+	r := loadReloadable(t, path)
+
+	waitReload := func(from *walletGeneration, what string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); r.generation() == from; {
+			if time.Now().After(deadline) {
+				t.Fatalf("no reload after %s", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	first := r.generation()
+	rewriteConfig(t, path, keyStoreConfig(t, priv, extra))
+	waitReload(first, "a config change")
+
+	// SIGHUP reloads an unchanged config.
+	second := r.generation()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	waitReload(second, "SIGHUP")
+
+}
+
+func TestReloadConcurrentSign(t *testing.T) {
+	t.Setenv("TEST_KEY_PASSWORD", "gochain@123")
+	priv, pub := crypto.GenerateKeyPair()
+	extra := "policy:\n  self_test: false\nreload:\n  watch_interval: 0s\n"
+	path := writeConfig(t, "wallet.yaml", keyStoreConfig(t, priv, extra))
+	r := loadReloadable(t, path)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				digest := crypto.SHA3Sum256([]byte{byte(i), byte(n), byte(n >> 8)})
+				signature, err := r.Sign(digest)
+				if err == nil {
+					err = verifySignature(digest, signature, pub)
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 5; i++ {
+		rewriteConfig(t, path, keyStoreConfig(t, priv, extra))
+		if err := r.Reload(); err != nil {
+			t.Error(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestReloadRestartParams(t *testing.T) {
+	t.Setenv("TEST_KEY_PASSWORD", "gochain@123")
+	priv, _ := crypto.GenerateKeyPair()
+	path := writeConfig(t, "wallet.yaml", keyStoreConfig(t, priv, "policy:\n  self_test: false\nreload:\n  watch_interval: 0s\n"))
+	r := loadReloadable(t, path)
+
+	buf := captureLogs(t)
+	rewriteConfig(t, path, keyStoreConfig(t, priv, "policy:\n  self_test: false\nreload:\n  watch_interval: 0s\n"+
+		"metrics:\n  listen: 127.0.0.1:0\naudit:\n  log: "+filepath.Join(t.TempDir(), "audit.log")+"\n  max_size: 1048576\n"))
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	for _, param := range processParams {
+		if !strings.Contains(buf.String(), "param="+param) {
+			t.Errorf("no restart warning for %s: %s", param, buf)
+		}
+	}
+}
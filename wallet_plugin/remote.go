@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	crypto "github.com/remote-signing/wallet_plugin/key"
+	"github.com/remote-signing/wallet_plugin/remotesigner"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"time"
+)
+
+// remoteConnectTimeout bounds the public key request of a new remote signer.
+const remoteConnectTimeout = 10 * time.Second
+
+func init() {
+	RegisterSigner("remote", newRemoteSigner)
+}
+
+// remoteSigner signs through the gRPC API of a remote-signer daemon, so the
+// node holds a client certificate and an API key instead of the credentials
+// of a KMS.
+//
+// The daemon is not trusted with the identity of the node: the public key it
+// serves must have the expected_address, and every signature it returns is
+// verified against that key before it is used.
+type remoteSigner struct {
+	endpoint string
+	apiKey   string
+	pkey     *crypto.PublicKey
+	conn     *grpc.ClientConn
+}
+
+func newRemoteSigner(params map[string]string) (Signer, error) {
+	if err := requireParams(params, "remote_endpoint", "expected_address", "tls_cert", "tls_key", "tls_ca", "api_key"); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := remotesigner.ClientTLSConfig(params["tls_cert"], params["tls_key"], params["tls_ca"], params["tls_server_name"])
+	if err != nil {
+		return nil, invalidParam("tls_cert", err)
+	}
+	conn, err := grpc.Dial(params["remote_endpoint"], grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	if err != nil {
+		return nil, invalidParam("remote_endpoint", err)
+	}
+	s := &remoteSigner{endpoint: params["remote_endpoint"], apiKey: params["api_key"], conn: conn}
+
+	ctx, cancel := context.WithTimeout(context.Background(), remoteConnectTimeout)
+	defer cancel()
+	s.pkey, err = s.readPublicKey(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if addr := NewAccountAddressFromPublicKey(s.pkey).String(); addr != params["expected_address"] {
+		conn.Close()
+		return nil, invalidParam("expected_address", fmt.Errorf("remote signer %s serves the key of %s", s.endpoint, addr))
+	}
+	return s, nil
+}
+
+func (s *remoteSigner) PublicKey() *crypto.PublicKey {
+	return s.pkey
+}
+
+// SignDigest returns the r and s of the signature of the daemon once it
+// verifies against the pinned public key.
+func (s *remoteSigner) SignDigest(ctx context.Context, digest []byte) ([]byte, []byte, error) {
+	signature := new(wrapperspb.BytesValue)
+	if err := s.conn.Invoke(s.authorize(ctx), remotesigner.MethodSign, wrapperspb.Bytes(digest), signature); err != nil {
+		return nil, nil, remotesigner.StatusError(err)
+	}
+	sig := signature.GetValue()
+	if len(sig) != crypto.SignatureLenRawWithV {
+		str := fmt.Sprintf("remote signer returned a %d-byte signature", len(sig))
+		return nil, nil, walleterr.New(walleterr.ErrSignatureMalformed, str)
+	}
+	if err := verifySignature(digest, sig, s.pkey); err != nil {
+		logger.Error("remote signer returned a signature of another key", "endpoint", s.endpoint, "err", err)
+		return nil, nil, err
+	}
+	return sig[:32], sig[32:64], nil
+}
+
+func (s *remoteSigner) readPublicKey(ctx context.Context) (*crypto.PublicKey, error) {
+	pub := new(wrapperspb.BytesValue)
+	if err := s.conn.Invoke(s.authorize(ctx), remotesigner.MethodGetPublicKey, new(emptypb.Empty), pub); err != nil {
+		return nil, remotesigner.StatusError(err)
+	}
+	pkey, err := crypto.ParsePublicKey(pub.GetValue())
+	if err != nil {
+		return nil, walleterr.Wrap(walleterr.ErrKeyAlgorithmMismatch, err, "remote signer public key")
+	}
+	return pkey, nil
+}
+
+// DescribeKey reports the key of the daemon, which is in the KEY_MISMATCH
+// state once the daemon serves another key than the pinned one.
+func (s *remoteSigner) DescribeKey(ctx context.Context) (KeyDescription, error) {
+	desc := KeyDescription{
+		KeyID:           s.endpoint,
+		KeySpec:         "secp256k1",
+		KeyUsage:        "sign",
+		KeyState:        "ENABLED",
+		ProtectionLevel: "EXTERNAL",
+		Origin:          "REMOTE",
+	}
+	pkey, err := s.readPublicKey(ctx)
+	if err != nil {
+		return KeyDescription{}, err
+	}
+	if !pkey.Equal(s.pkey) {
+		desc.KeyState = "KEY_MISMATCH"
+		str := fmt.Sprintf("remote signer %s serves the key of %s", s.endpoint, NewAccountAddressFromPublicKey(pkey))
+		return desc, walleterr.New(walleterr.ErrKeyStateInvalid, str)
+	}
+	return desc, nil
+}
+
+func (s *remoteSigner) authorize(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+s.apiKey)
+}
+
+func (s *remoteSigner) close() {
+	s.conn.Close()
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/remote-signing/wallet_plugin/address"
+	crypto "github.com/remote-signing/wallet_plugin/key"
+	"github.com/remote-signing/wallet_plugin/log"
+	"github.com/remote-signing/wallet_plugin/remotesigner"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const testRemoteAPIKey = "0123456789abcdef0123456789abcdef"
+
+// remoteKey is the wallet of a test remote signer, whose key can be swapped
+// to play a daemon that serves the wrong key.
+type remoteKey struct {
+	mu     sync.Mutex
+	priv   *crypto.PrivateKey
+	paused bool
+}
+
+func (k *remoteKey) key() *crypto.PrivateKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.priv
+}
+
+func (k *remoteKey) Address() address.IAddress {
+	return NewAccountAddressFromPublicKey(k.key().PublicKey())
+}
+
+func (k *remoteKey) PublicKey() []byte {
+	return k.key().PublicKey().SerializeCompressed()
+}
+
+func (k *remoteKey) Sign(digest []byte) ([]byte, error) {
+	k.mu.Lock()
+	paused := k.paused
+	k.mu.Unlock()
+	if paused {
+		return nil, walleterr.New(walleterr.ErrSigningPaused, "signing paused by the admin socket")
+	}
+	if err := checkDigest(digest); err != nil {
+		return nil, err
+	}
+	sig, err := k.key().Sign(digest)
+	if err != nil {
+		return nil, err
+	}
+	return sig.SerializeRSV()
+}
+
+// writeTestPKI writes a CA and a server and a client certificate issued by it
+// to dir as ca.pem, server.pem, server-key.pem, client.pem and client-key.pem.
+func writeTestPKI(t *testing.T, dir string) {
+	t.Helper()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca, err = x509.ParseCertificate(caDER); err != nil {
+		t.Fatal(err)
+	}
+	writePEM := func(name, typ string, b []byte) {
+		if err := os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writePEM("ca.pem", "CERTIFICATE", caDER)
+
+	for i, name := range []string{"server", "client"} {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: name},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, _ := x509.MarshalECPrivateKey(key)
+		writePEM(name+".pem", "CERTIFICATE", der)
+		writePEM(name+"-key.pem", "EC PRIVATE KEY", keyDER)
+	}
+}
+
+// startRemoteSigner serves k with the gRPC API of the remote-signer command
+// and returns the params of a remote wallet for it.
+func startRemoteSigner(t *testing.T, k remotesigner.Wallet) map[string]string {
+	t.Helper()
+	dir := t.TempDir()
+	writeTestPKI(t, dir)
+	tlsConfig, err := remotesigner.ServerTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := remotesigner.NewServer(k, remotesigner.Config{
+		APIKeys: map[string]string{testRemoteAPIKey: "node"},
+		Logger:  log.New(io.Discard),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := grpc.NewServer(s.GRPCOptions(credentials.NewTLS(tlsConfig))...)
+	s.RegisterGRPC(g)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go g.Serve(l)
+	t.Cleanup(g.Stop)
+
+	return map[string]string{
+		"kms_type":         "remote",
+		"remote_endpoint":  l.Addr().String(),
+		"expected_address": k.Address().String(),
+		"tls_cert":         filepath.Join(dir, "client.pem"),
+		"tls_key":          filepath.Join(dir, "client-key.pem"),
+		"tls_ca":           filepath.Join(dir, "ca.pem"),
+		"api_key":          testRemoteAPIKey,
+		"sign_deadline":    "2s",
+	}
+}
+
+func TestRemoteSigner(t *testing.T) {
+	priv, pub := crypto.GenerateKeyPair()
+	k := &remoteKey{priv: priv}
+	params := startRemoteSigner(t, k)
+
+	iWallet, err := NewWallet(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := iWallet.(Wallet)
+	defer closeSigner(w.signer)
+	if got := w.Address().String(); got != params["expected_address"] {
+		t.Fatalf("address = %s, want %s", got, params["expected_address"])
+	}
+	if id, _ := keyRef(params); id != params["remote_endpoint"]+"/"+params["expected_address"] {
+		t.Errorf("audit key id %q", id)
+	}
+	digest := crypto.SHA3Sum256([]byte("remote"))
+	signature, err := w.Sign(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyRecoverable(t, digest, signature, pub.SerializeCompressed())
+	if a, err := w.SelfTest(); err != nil || a.Backends[0].Key.Origin != "REMOTE" {
+		t.Fatalf("self-test = %+v, %v", a, err)
+	}
+
+	k.mu.Lock()
+	k.paused = true
+	k.mu.Unlock()
+	if _, err := w.Sign(crypto.SHA3Sum256([]byte("paused"))); !errors.Is(err, walleterr.ErrSigningPaused) {
+		t.Fatalf("Sign on a paused remote signer = %v, want ErrSigningPaused", err)
+	}
+
+	// A daemon that starts serving another key is caught by the pinned key.
+	other, _ := crypto.GenerateKeyPair()
+	k.mu.Lock()
+	k.priv, k.paused = other, false
+	k.mu.Unlock()
+	if _, err := w.Sign(crypto.SHA3Sum256([]byte("other key"))); !errors.Is(err, walleterr.ErrSignatureInvalid) {
+		t.Fatalf("Sign with another remote key = %v, want ErrSignatureInvalid", err)
+	}
+	if _, err := w.SelfTest(); !errors.Is(err, walleterr.ErrKeyStateInvalid) {
+		t.Fatalf("self-test with another remote key = %v, want ErrKeyStateInvalid", err)
+	}
+}
+
+func TestRemoteSignerLoad(t *testing.T) {
+	priv, _ := crypto.GenerateKeyPair()
+	params := startRemoteSigner(t, &remoteKey{priv: priv})
+
+	tests := []struct {
+		name   string
+		change map[string]string
+		kind   walleterr.ErrorKind
+	}{
+		{"missing api key", map[string]string{"api_key": ""}, walleterr.ErrConfigMissingParam},
+		{"wrong api key", map[string]string{"api_key": "fedcba9876543210fedcba9876543210"}, walleterr.ErrPermissionDenied},
+		{"wrong address", map[string]string{"expected_address": "hx0000000000000000000000000000000000000000"}, walleterr.ErrConfigInvalidParam},
+		{"no client certificate", map[string]string{"tls_cert": params["tls_ca"]}, walleterr.ErrConfigInvalidParam},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := make(map[string]string, len(params))
+			for k, v := range params {
+				p[k] = v
+			}
+			for k, v := range tt.change {
+				p[k] = v
+			}
+			if _, err := NewWallet(p); !errors.Is(err, tt.kind) {
+				t.Fatalf("NewWallet = %v, want %s", err, tt.kind)
+			}
+		})
+	}
+}
+
+func TestRemoteSignerDuplicateDigest(t *testing.T) {
+	priv, _ := crypto.GenerateKeyPair()
+	t.Setenv("WALLET_TEST_KEY_PASSWORD", "gochain@123")
+	iWallet, err := NewWallet(map[string]string{
+		"kms_type":         "keystore",
+		"keystore_path":    writeKeyStore(t, priv, "gochain@123", "pbkdf2"),
+		"password_env":     "WALLET_TEST_KEY_PASSWORD",
+		"state_dir":        t.TempDir(),
+		"duplicate_digest": "reject",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon := iWallet.(Wallet)
+	defer daemon.releaseKey()
+	params := startRemoteSigner(t, daemon)
+
+	// Every load self-tests the daemon with the same digest.
+	var w Wallet
+	for i := 0; i < 2; i++ {
+		iWallet, err := NewWallet(params)
+		if err != nil {
+			t.Fatalf("load %d: %v", i+1, err)
+		}
+		w = iWallet.(Wallet)
+		defer closeSigner(w.signer)
+	}
+	if _, err := w.SelfTest(); err != nil {
+		t.Fatalf("self-test: %v", err)
+	}
+
+	digest := crypto.SHA3Sum256([]byte("vote"))
+	if _, err := w.Sign(digest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Sign(digest); !errors.Is(err, walleterr.ErrDuplicateDigest) {
+		t.Fatalf("second Sign = %v, want ErrDuplicateDigest", err)
+	}
+}
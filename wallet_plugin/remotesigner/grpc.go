@@ -0,0 +1,160 @@
+package remotesigner
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// The full names of the methods of the gRPC service. The messages are
+// well-known types, so clients need no generated code.
+const (
+	ServiceName        = "remotesigner.v1.RemoteSigner"
+	MethodGetAddress   = "/" + ServiceName + "/GetAddress"   // Empty -> StringValue
+	MethodGetPublicKey = "/" + ServiceName + "/GetPublicKey" // Empty -> BytesValue
+	MethodSign         = "/" + ServiceName + "/Sign"         // BytesValue -> BytesValue
+)
+
+// rpcServer is the handler type of the service, checked by RegisterService.
+type rpcServer interface {
+	call(ctx context.Context, method string, req interface{}) (interface{}, error)
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*rpcServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "GetAddress", Handler: handler(MethodGetAddress, func() interface{} { return new(emptypb.Empty) })},
+		{MethodName: "GetPublicKey", Handler: handler(MethodGetPublicKey, func() interface{} { return new(emptypb.Empty) })},
+		{MethodName: "Sign", Handler: handler(MethodSign, func() interface{} { return new(wrapperspb.BytesValue) })},
+	},
+	Metadata: "remotesigner.proto",
+}
+
+func handler(method string, newReq func() interface{}) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := newReq()
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		call := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return srv.(rpcServer).call(ctx, method, req)
+		}
+		if interceptor == nil {
+			return call(ctx, req)
+		}
+		return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: method}, call)
+	}
+}
+
+// GRPCOptions returns the options a gRPC server needs for the service, the
+// request size limit of the server besides creds.
+func (s *Server) GRPCOptions(creds credentials.TransportCredentials) []grpc.ServerOption {
+	return []grpc.ServerOption{grpc.Creds(creds), grpc.MaxRecvMsgSize(int(s.maxBytes))}
+}
+
+// RegisterGRPC registers the service with g.
+func (s *Server) RegisterGRPC(g *grpc.Server) {
+	g.RegisterService(&serviceDesc, s)
+}
+
+func (s *Server) call(ctx context.Context, method string, req interface{}) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var auth string
+	if v := md.Get("authorization"); len(v) > 0 {
+		auth = v[0]
+	}
+	cn := peerCommonName(ctx)
+	client, err := s.client(auth, method, cn)
+	if err != nil {
+		return nil, grpcError(codes.Unauthenticated, err)
+	}
+
+	switch method {
+	case MethodGetAddress:
+		return wrapperspb.String(s.wallet.Address().String()), nil
+	case MethodGetPublicKey:
+		return wrapperspb.Bytes(s.wallet.PublicKey()), nil
+	default:
+		signature, err := s.sign(client, cn, req.(*wrapperspb.BytesValue).GetValue())
+		if err != nil {
+			return nil, grpcError(grpcCode(err), err)
+		}
+		return wrapperspb.Bytes(signature), nil
+	}
+}
+
+func peerCommonName(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return ""
+	}
+	return info.State.PeerCertificates[0].Subject.CommonName
+}
+
+// grpcError returns the status of err, its message prefixed with the kind.
+func grpcError(code codes.Code, err error) error {
+	if kind := walleterr.KindOf(err); kind != "" {
+		return status.Error(code, string(kind)+": "+err.Error())
+	}
+	return status.Error(code, err.Error())
+}
+
+// grpcCode returns the gRPC code of an error of the wallet, the equivalent of
+// httpStatus.
+func grpcCode(err error) codes.Code {
+	switch httpStatus(err) {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusConflict:
+		return codes.AlreadyExists
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	default:
+		return codes.Internal
+	}
+}
+
+// StatusError returns the error of a gRPC status returned by the service as a
+// walleterr.Error of the kind the server reported, so a client can tell a
+// paused or busy signer from a broken one.
+//
+// A status without a kind did not come from the wallet but from the
+// transport. It is ErrBackendUnavailable, which a client retries, also for
+// DeadlineExceeded: that is the timeout of a single call, like the call
+// timeout of a KMS backend, and the client enforces its own signing
+// deadline. Only a rejected certificate or API key and a request over the size
+// limit fail for good.
+func StatusError(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return walleterr.Wrap(walleterr.ErrBackendUnavailable, err, "remote signer")
+	}
+	kind, msg, ok := strings.Cut(st.Message(), ": ")
+	if !ok || !strings.HasPrefix(kind, "Err") || strings.ContainsAny(kind, " :") {
+		kind, msg = string(walleterr.ErrBackendUnavailable), st.Message()
+		switch st.Code() {
+		case codes.Unauthenticated, codes.PermissionDenied:
+			kind = string(walleterr.ErrPermissionDenied)
+		case codes.ResourceExhausted: // over the request size limit
+			kind = string(walleterr.ErrConfigInvalidParam)
+		}
+	}
+	return walleterr.New(walleterr.ErrorKind(kind), "remote signer: "+msg)
+}
@@ -0,0 +1,253 @@
+// Package remotesigner serves a wallet of the wallet plugin to processes that
+// can not load the plugin, such as bots, relayers and scripts, over
+// JSON-HTTP and gRPC.
+//
+// Both APIs need mutual TLS and a per-client API key, sent as an
+// Authorization: Bearer KEY header or gRPC metadata. Every Sign call goes
+// through the wallet, so its audit log, double-sign guard and signer lease
+// apply to remote clients as they do to goloop.
+//
+// The JSON-HTTP API is
+//
+//	GET  /v1/address     {"address":"hx..."}
+//	GET  /v1/public-key  {"public_key":"0x..."} (compressed)
+//	POST /v1/sign        {"digest":"0x..."} -> {"signature":"0x..."} ([R|S|V])
+//
+// and the gRPC service is remotesigner.v1.RemoteSigner of remotesigner.proto.
+// Errors carry the walleterr kind, in the kind field of the JSON reply or as
+// the "KIND: " prefix of the gRPC status message.
+package remotesigner
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/remote-signing/wallet_plugin/address"
+	"github.com/remote-signing/wallet_plugin/log"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+)
+
+// DefaultMaxRequestBytes bounds the requests of a server by default. A sign
+// request needs less than 100 bytes.
+const DefaultMaxRequestBytes = 4096
+
+var errTooLarge = walleterr.New(walleterr.ErrConfigInvalidParam, "request too large")
+
+// Wallet is what the server needs of a wallet returned by NewWallet.
+type Wallet interface {
+	Address() address.IAddress
+	PublicKey() []byte
+	Sign(digest []byte) ([]byte, error)
+}
+
+// Config configures a Server.
+type Config struct {
+	// APIKeys maps every API key to the name of its client.
+	APIKeys map[string]string
+
+	// MaxRequestBytes bounds the body of a request, DefaultMaxRequestBytes
+	// if 0.
+	MaxRequestBytes int64
+
+	// Logger records every call, by default to stdout.
+	Logger *log.Logger
+}
+
+// Server serves a Wallet. Use Handler for the JSON-HTTP API and
+// RegisterGRPC for the gRPC service.
+type Server struct {
+	wallet   Wallet
+	clients  map[[sha256.Size]byte]string // by the SHA-256 of the API key
+	maxBytes int64
+	logger   *log.Logger
+}
+
+// NewServer returns a server of w for the clients of c.
+func NewServer(w Wallet, c Config) (*Server, error) {
+	if len(c.APIKeys) == 0 {
+		return nil, errors.New("remotesigner: no API keys")
+	}
+	s := &Server{
+		wallet:   w,
+		clients:  make(map[[sha256.Size]byte]string, len(c.APIKeys)),
+		maxBytes: c.MaxRequestBytes,
+		logger:   c.Logger,
+	}
+	for key, name := range c.APIKeys {
+		if len(key) < 16 {
+			return nil, fmt.Errorf("remotesigner: API key of %s is shorter than 16 characters", name)
+		}
+		s.clients[sha256.Sum256([]byte(key))] = name
+	}
+	if s.maxBytes <= 0 {
+		s.maxBytes = DefaultMaxRequestBytes
+	}
+	if s.logger == nil {
+		s.logger = log.New(os.Stdout)
+	}
+	return s, nil
+}
+
+// LoadAPIKeys reads an API key file. Each line holds the name of a client and
+// its key, separated by white space; empty lines and lines starting with #
+// are skipped. The file must not be accessible by group or others.
+func LoadAPIKeys(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s is accessible by group or others (mode %04o)", path, fi.Mode().Perm())
+	}
+
+	keys := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: not NAME KEY", path, n)
+		}
+		if _, dup := keys[fields[1]]; dup {
+			return nil, fmt.Errorf("%s:%d: key of %s already in use", path, n, fields[0])
+		}
+		keys[fields[1]] = fields[0]
+	}
+	return keys, sc.Err()
+}
+
+// client returns the name of the client of the Authorization header value
+// auth of a call of method by the certificate cn.
+func (s *Server) client(auth, method, cn string) (string, error) {
+	key := strings.TrimPrefix(auth, "Bearer ")
+	if name, ok := s.clients[sha256.Sum256([]byte(key))]; ok && key != auth {
+		return name, nil
+	}
+	s.logger.Warn("remote call denied, unknown API key", "method", method, "cert", cn)
+	return "", walleterr.New(walleterr.ErrPermissionDenied, "unknown API key")
+}
+
+// sign signs digest for client, whose certificate has the common name cn.
+func (s *Server) sign(client, cn string, digest []byte) ([]byte, error) {
+	start := time.Now()
+	signature, err := s.wallet.Sign(digest)
+	latency := time.Since(start).Milliseconds()
+	if err != nil {
+		s.logger.Warn("remote sign failed", "client", client, "cert", cn, "digest", digest, "latency_ms", latency, "err", err)
+		return nil, err
+	}
+	s.logger.Info("remote signed", "client", client, "cert", cn, "digest", digest, "latency_ms", latency)
+	return signature, nil
+}
+
+// Handler returns the handler of the JSON-HTTP API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/address", s.httpCall(http.MethodGet, func(*http.Request, string, string) (interface{}, error) {
+		return map[string]string{"address": s.wallet.Address().String()}, nil
+	}))
+	mux.HandleFunc("/v1/public-key", s.httpCall(http.MethodGet, func(*http.Request, string, string) (interface{}, error) {
+		return map[string]string{"public_key": "0x" + hex.EncodeToString(s.wallet.PublicKey())}, nil
+	}))
+	mux.HandleFunc("/v1/sign", s.httpCall(http.MethodPost, func(r *http.Request, client, cn string) (interface{}, error) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, s.maxBytes+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(body)) > s.maxBytes {
+			return nil, errTooLarge
+		}
+		var req struct {
+			Digest string `json:"digest"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, walleterr.Wrap(walleterr.ErrConfigInvalidParam, err, "sign request")
+		}
+		digest, err := hex.DecodeString(strings.TrimPrefix(req.Digest, "0x"))
+		if err != nil {
+			return nil, walleterr.Wrap(walleterr.ErrDigestLength, err, "digest")
+		}
+		signature, err := s.sign(client, cn, digest)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"signature": "0x" + hex.EncodeToString(signature)}, nil
+	}))
+	return mux
+}
+
+func (s *Server) httpCall(method string, call func(r *http.Request, client, cn string) (interface{}, error)) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		cn := commonName(r)
+		client, err := s.client(r.Header.Get("Authorization"), r.URL.Path, cn)
+		if err != nil {
+			httpReply(rw, http.StatusUnauthorized, errorReply(err))
+			return
+		}
+		if r.Method != method {
+			rw.Header().Set("Allow", method)
+			httpReply(rw, http.StatusMethodNotAllowed, map[string]string{"error": r.URL.Path + " needs " + method})
+			return
+		}
+		v, err := call(r, client, cn)
+		if err != nil {
+			httpReply(rw, httpStatus(err), errorReply(err))
+			return
+		}
+		httpReply(rw, http.StatusOK, v)
+	}
+}
+
+func commonName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+func httpReply(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(v)
+}
+
+func errorReply(err error) map[string]string {
+	return map[string]string{"error": err.Error(), "kind": string(walleterr.KindOf(err))}
+}
+
+// httpStatus returns the HTTP status of an error of the wallet.
+func httpStatus(err error) int {
+	if err == errTooLarge {
+		return http.StatusRequestEntityTooLarge
+	}
+	switch walleterr.KindOf(err) {
+	case walleterr.ErrDigestLength, walleterr.ErrConfigInvalidParam:
+		return http.StatusBadRequest
+	case walleterr.ErrPermissionDenied:
+		return http.StatusForbidden
+	case walleterr.ErrDuplicateDigest:
+		return http.StatusConflict
+	case walleterr.ErrBackendUnavailable, walleterr.ErrBackendThrottled, walleterr.ErrCircuitOpen,
+		walleterr.ErrSignDeadlineExceeded, walleterr.ErrKeyInUse, walleterr.ErrSigningPaused:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
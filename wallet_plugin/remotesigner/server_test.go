@@ -0,0 +1,344 @@
+package remotesigner
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/remote-signing/wallet_plugin/address"
+	crypto "github.com/remote-signing/wallet_plugin/key"
+	"github.com/remote-signing/wallet_plugin/log"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const testAPIKey = "0123456789abcdef0123456789abcdef"
+
+type testWallet struct {
+	priv   *crypto.PrivateKey
+	paused bool
+}
+
+func (w *testWallet) Address() address.IAddress {
+	digest := crypto.SHA3Sum256(w.priv.PublicKey().SerializeUncompressed()[1:])
+	return address.NewAddress(digest[len(digest)-address.AddressIDBytes:])
+}
+
+func (w *testWallet) PublicKey() []byte {
+	return w.priv.PublicKey().SerializeCompressed()
+}
+
+func (w *testWallet) Sign(digest []byte) ([]byte, error) {
+	if w.paused {
+		return nil, walleterr.New(walleterr.ErrSigningPaused, "signing paused")
+	}
+	if len(digest) != 32 {
+		return nil, walleterr.New(walleterr.ErrDigestLength, "digest is not 32 bytes")
+	}
+	sig, err := w.priv.Sign(digest)
+	if err != nil {
+		return nil, err
+	}
+	return sig.SerializeRSV()
+}
+
+// testPKI writes a CA and a server certificate signed by it to dir and
+// returns the CA and a client certificate signed by it.
+func testPKI(t *testing.T, dir string) (*x509.CertPool, tls.Certificate) {
+	t.Helper()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	issue := func(serial int64, cn string, usage x509.ExtKeyUsage) ([]byte, *ecdsa.PrivateKey) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der, key
+	}
+	writePEM := func(name, typ string, b []byte) {
+		if err := os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writePEM("ca.pem", "CERTIFICATE", caDER)
+	serverDER, serverKey := issue(2, "signer", x509.ExtKeyUsageServerAuth)
+	writePEM("server.pem", "CERTIFICATE", serverDER)
+	keyDER, _ := x509.MarshalECPrivateKey(serverKey)
+	writePEM("server-key.pem", "EC PRIVATE KEY", keyDER)
+
+	clientDER, clientKey := issue(3, "relayer-1", x509.ExtKeyUsageClientAuth)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return pool, tls.Certificate{Certificate: [][]byte{clientDER}, PrivateKey: clientKey}
+}
+
+func newTestServer(t *testing.T) (*Server, *testWallet, *bytes.Buffer) {
+	priv, _ := crypto.GenerateKeyPair()
+	w := &testWallet{priv: priv}
+	var logs bytes.Buffer
+	s, err := NewServer(w, Config{
+		APIKeys:         map[string]string{testAPIKey: "relayer"},
+		MaxRequestBytes: 256,
+		Logger:          log.New(&logs),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, w, &logs
+}
+
+func TestHTTP(t *testing.T) {
+	s, w, logs := newTestServer(t)
+	dir := t.TempDir()
+	ca, clientCert := testPKI(t, dir)
+	serverTLS, err := ServerTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(s.Handler())
+	ts.TLS = serverTLS
+	ts.StartTLS()
+	defer ts.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      ca,
+		Certificates: []tls.Certificate{clientCert},
+	}}}
+	call := func(method, path, key, body string, v interface{}) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		return resp.StatusCode
+	}
+
+	var reply map[string]string
+	if status := call(http.MethodGet, "/v1/address", testAPIKey, "", &reply); status != http.StatusOK || reply["address"] != w.Address().String() {
+		t.Fatalf("address = %d %v, want %s", status, reply, w.Address())
+	}
+	if status := call(http.MethodGet, "/v1/public-key", testAPIKey, "", &reply); status != http.StatusOK || reply["public_key"] != "0x"+hex.EncodeToString(w.PublicKey()) {
+		t.Fatalf("public key = %d %v", status, reply)
+	}
+
+	digest := crypto.SHA3Sum256([]byte("remote"))
+	body := `{"digest":"0x` + hex.EncodeToString(digest) + `"}`
+	if status := call(http.MethodPost, "/v1/sign", testAPIKey, body, &reply); status != http.StatusOK {
+		t.Fatalf("sign = %d %v", status, reply)
+	}
+	signature, _ := hex.DecodeString(strings.TrimPrefix(reply["signature"], "0x"))
+	sig, err := crypto.ParseSignature(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub, err := sig.RecoverPublicKey(digest); err != nil || !bytes.Equal(pub.SerializeCompressed(), w.PublicKey()) {
+		t.Fatalf("signature does not recover the wallet key: %v", err)
+	}
+	if !strings.Contains(logs.String(), "relayer") || !strings.Contains(logs.String(), "relayer-1") {
+		t.Fatalf("sign not logged with the client and its certificate: %s", logs)
+	}
+
+	tests := []struct {
+		name, method, path, key, body string
+		status                        int
+		kind                          walleterr.ErrorKind
+	}{
+		{"no key", http.MethodPost, "/v1/sign", "", body, http.StatusUnauthorized, walleterr.ErrPermissionDenied},
+		{"wrong key", http.MethodPost, "/v1/sign", testAPIKey + "x", body, http.StatusUnauthorized, walleterr.ErrPermissionDenied},
+		{"wrong method", http.MethodGet, "/v1/sign", testAPIKey, "", http.StatusMethodNotAllowed, ""},
+		{"short digest", http.MethodPost, "/v1/sign", testAPIKey, `{"digest":"0x0102"}`, http.StatusBadRequest, walleterr.ErrDigestLength},
+		{"bad json", http.MethodPost, "/v1/sign", testAPIKey, `{"digest":`, http.StatusBadRequest, walleterr.ErrConfigInvalidParam},
+		{"too large", http.MethodPost, "/v1/sign", testAPIKey, `{"digest":"` + strings.Repeat("00", 200) + `"}`, http.StatusRequestEntityTooLarge, walleterr.ErrConfigInvalidParam},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := map[string]string{}
+			if status := call(tt.method, tt.path, tt.key, tt.body, &reply); status != tt.status || reply["kind"] != string(tt.kind) {
+				t.Fatalf("got %d %v, want %d %s", status, reply, tt.status, tt.kind)
+			}
+		})
+	}
+
+	w.paused = true
+	if status := call(http.MethodPost, "/v1/sign", testAPIKey, body, &reply); status != http.StatusServiceUnavailable || reply["kind"] != string(walleterr.ErrSigningPaused) {
+		t.Fatalf("paused sign = %d %v", status, reply)
+	}
+
+	// Without a client certificate the handshake fails.
+	noCert := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca}}}
+	if resp, err := noCert.Get(ts.URL + "/v1/address"); err == nil {
+		resp.Body.Close()
+		t.Fatal("request without a client certificate succeeded")
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	s, w, _ := newTestServer(t)
+	dir := t.TempDir()
+	ca, clientCert := testPKI(t, dir)
+	serverTLS, err := ServerTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := grpc.NewServer(s.GRPCOptions(credentials.NewTLS(serverTLS))...)
+	s.RegisterGRPC(g)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go g.Serve(l)
+	defer g.Stop()
+
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+		RootCAs:      ca,
+		Certificates: []tls.Certificate{clientCert},
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	authed := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+testAPIKey)
+
+	addr := new(wrapperspb.StringValue)
+	if err := conn.Invoke(authed, MethodGetAddress, new(emptypb.Empty), addr); err != nil || addr.GetValue() != w.Address().String() {
+		t.Fatalf("GetAddress = %q, %v", addr.GetValue(), err)
+	}
+	pub := new(wrapperspb.BytesValue)
+	if err := conn.Invoke(authed, MethodGetPublicKey, new(emptypb.Empty), pub); err != nil || !bytes.Equal(pub.GetValue(), w.PublicKey()) {
+		t.Fatalf("GetPublicKey = %x, %v", pub.GetValue(), err)
+	}
+	digest := crypto.SHA3Sum256([]byte("remote"))
+	signature := new(wrapperspb.BytesValue)
+	if err := conn.Invoke(authed, MethodSign, wrapperspb.Bytes(digest), signature); err != nil || len(signature.GetValue()) != 65 {
+		t.Fatalf("Sign = %x, %v", signature.GetValue(), err)
+	}
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		req  []byte
+		kind walleterr.ErrorKind
+	}{
+		{"no key", ctx, digest, walleterr.ErrPermissionDenied},
+		{"short digest", authed, digest[:4], walleterr.ErrDigestLength},
+		{"too large", authed, make([]byte, 1024), walleterr.ErrConfigInvalidParam},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := conn.Invoke(tt.ctx, MethodSign, wrapperspb.Bytes(tt.req), new(wrapperspb.BytesValue))
+			if kind := walleterr.KindOf(StatusError(err)); err == nil || kind != tt.kind {
+				t.Fatalf("Sign error = %v (%s), want %s", err, kind, tt.kind)
+			}
+		})
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		kind walleterr.ErrorKind
+	}{
+		{"wallet error", grpcError(codes.Unavailable, walleterr.New(walleterr.ErrSigningPaused, "signing paused")), walleterr.ErrSigningPaused},
+		{"transport", status.Error(codes.Unavailable, "connection refused"), walleterr.ErrBackendUnavailable},
+		{"call timeout", status.Error(codes.DeadlineExceeded, "context deadline exceeded"), walleterr.ErrBackendUnavailable},
+		{"certificate", status.Error(codes.Unauthenticated, "bad certificate"), walleterr.ErrPermissionDenied},
+		{"too large", status.Error(codes.ResourceExhausted, "message larger than max"), walleterr.ErrConfigInvalidParam},
+		{"not a status", errors.New("closed"), walleterr.ErrBackendUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if kind := walleterr.KindOf(StatusError(tt.err)); kind != tt.kind {
+				t.Fatalf("StatusError(%v) is %s, want %s", tt.err, kind, tt.kind)
+			}
+		})
+	}
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api-keys")
+	content := "# clients\nrelayer " + testAPIKey + "\n\nbot fedcba9876543210fedcba9876543210\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadAPIKeys(path)
+	if err != nil || len(keys) != 2 || keys[testAPIKey] != "relayer" {
+		t.Fatalf("LoadAPIKeys = %v, %v", keys, err)
+	}
+
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadAPIKeys(path); err == nil {
+		t.Fatal("LoadAPIKeys accepted a world readable file")
+	}
+	if err := os.WriteFile(path, []byte("relayer\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadAPIKeys(path); err == nil {
+		t.Fatal("LoadAPIKeys accepted a line without a key")
+	}
+
+	if _, err := NewServer(&testWallet{}, Config{APIKeys: map[string]string{"short": "bot"}}); err == nil {
+		t.Fatal("NewServer accepted a short API key")
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// Defaults keep a signature well inside a consensus round: a KMS Sign call
+// normally answers in tens of milliseconds.
+const (
+	defaultCallTimeout    = 1 * time.Second
+	defaultSignDeadline   = 3 * time.Second
+	defaultMaxRetries     = 3
+	defaultRetryBaseDelay = 50 * time.Millisecond
+	defaultRetryMaxDelay  = 1 * time.Second
+)
+
+// retryPolicy bounds how long Wallet.Sign waits for its backend. Every call
+// gets callTimeout, throttled and transient failures are retried up to
+// maxRetries times with jittered exponential backoff, and no signature
+// request outlives signDeadline.
+type retryPolicy struct {
+	callTimeout  time.Duration
+	signDeadline time.Duration
+	maxRetries   int
+	baseDelay    time.Duration
+	maxDelay     time.Duration
+}
+
+var defaultRetryPolicy = retryPolicy{
+	callTimeout:  defaultCallTimeout,
+	signDeadline: defaultSignDeadline,
+	maxRetries:   defaultMaxRetries,
+	baseDelay:    defaultRetryBaseDelay,
+	maxDelay:     defaultRetryMaxDelay,
+}
+
+// newRetryPolicy reads call_timeout, sign_deadline, max_retries,
+// retry_base_delay and retry_max_delay from the plugin parameters. Durations
+// use the time.ParseDuration format, e.g. "500ms".
+func newRetryPolicy(params map[string]string) (retryPolicy, error) {
+	p := defaultRetryPolicy
+	for name, d := range map[string]*time.Duration{
+		"call_timeout":     &p.callTimeout,
+		"sign_deadline":    &p.signDeadline,
+		"retry_base_delay": &p.baseDelay,
+		"retry_max_delay":  &p.maxDelay,
+	} {
+		v := params[name]
+		if v == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return retryPolicy{}, invalidParam(name, err)
+		}
+		if parsed <= 0 {
+			return retryPolicy{}, invalidParam(name, fmt.Errorf("%s is not positive", v))
+		}
+		*d = parsed
+	}
+	if v := params["max_retries"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return retryPolicy{}, invalidParam("max_retries", fmt.Errorf("%q is not a non-negative integer", v))
+		}
+		p.maxRetries = n
+	}
+	if p.callTimeout > p.signDeadline {
+		str := fmt.Sprintf("invalid inputs: call_timeout %s exceeds sign_deadline %s", p.callTimeout, p.signDeadline)
+		return retryPolicy{}, walleterr.New(walleterr.ErrConfigInvalidParam, str)
+	}
+	return p, nil
+}
+
+// retryable reports whether a failed call may succeed when tried again.
+// Permission, key and configuration errors never do.
+func retryable(err error) bool {
+	return errors.Is(err, walleterr.ErrBackendThrottled) || errors.Is(err, walleterr.ErrBackendUnavailable)
+}
+
+// backoff returns the delay before retry n, counting from 0. It uses full
+// jitter so that nodes throttled together do not retry together.
+func (p retryPolicy) backoff(n int) time.Duration {
+	ceiling := p.maxDelay
+	if n < 32 {
+		if d := p.baseDelay << uint(n); d > 0 && d < ceiling {
+			ceiling = d
+		}
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// signDigest asks signer for a signature until it succeeds, fails with an
+// error that is not retryable, runs out of retries or hits the deadline.
+// Calls are recorded in the metrics of backend unless it is empty.
+func (p retryPolicy) signDigest(signer Signer, backend string, digest []byte) ([]byte, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.signDeadline)
+	defer cancel()
+
+	for attempt := 0; ; attempt++ {
+		r, s, err := p.call(ctx, signer, backend, digest)
+		if err == nil {
+			return r, s, nil
+		}
+		if !retryable(err) {
+			return nil, nil, err
+		}
+		if ctx.Err() != nil {
+			return nil, nil, p.deadlineError(attempt+1, err)
+		}
+		if attempt >= p.maxRetries {
+			return nil, nil, err
+		}
+
+		signRetries.Inc()
+		select {
+		case <-ctx.Done():
+			return nil, nil, p.deadlineError(attempt+1, err)
+		case <-time.After(p.backoff(attempt)):
+		}
+	}
+}
+
+// call runs a single SignDigest with callTimeout.
+func (p retryPolicy) call(ctx context.Context, signer Signer, backend string, digest []byte) ([]byte, []byte, error) {
+	start := time.Now()
+	r, s, err := signWithTimeout(ctx, p.callTimeout, signer, digest)
+	if backend != "" {
+		observeBackendCall(backend, start, err)
+	}
+	return r, s, err
+}
+
+// signWithTimeout runs SignDigest with a timeout. It returns once the timeout
+// passes even if the backend ignores its context, which a PKCS#11 module
+// blocked in C can do.
+func signWithTimeout(ctx context.Context, timeout time.Duration, signer Signer, digest []byte) ([]byte, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		r, s []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		r, s, err := signer.SignDigest(ctx, digest)
+		done <- result{r, s, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.r, res.s, res.err
+	case <-ctx.Done():
+		return nil, nil, walleterr.Wrap(walleterr.ErrBackendUnavailable, ctx.Err(), "signer did not answer in time")
+	}
+}
+
+func (p retryPolicy) deadlineError(attempts int, last error) error {
+	return walleterr.Error{
+		Err:         walleterr.ErrSignDeadlineExceeded,
+		Description: fmt.Sprintf("no signature within %s after %d attempts", p.signDeadline, attempts),
+		Cause:       last,
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"github.com/aws/smithy-go"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"sync"
+	"testing"
+	"time"
+)
+
+// kmsFault is what a fake KMS does to one Sign call: answer late, fail with
+// an AWS error code, or both.
+type kmsFault struct {
+	latency time.Duration
+	code    string
+	hang    bool // ignore the context while waiting, like a call stuck in C
+}
+
+func (f kmsFault) inject(ctx context.Context) error {
+	if f.latency == 0 {
+		return nil
+	}
+	if f.hang {
+		time.Sleep(f.latency)
+		return nil
+	}
+	select {
+	case <-time.After(f.latency):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// faultySigner is a fakeSigner behind a misbehaving KMS. Each call consumes
+// one fault, errors are classified like AWS KMS errors.
+type faultySigner struct {
+	*fakeSigner
+
+	mu     sync.Mutex
+	faults []kmsFault
+	calls  int
+}
+
+func (s *faultySigner) SignDigest(ctx context.Context, digest []byte) ([]byte, []byte, error) {
+	s.mu.Lock()
+	s.calls++
+	var fault kmsFault
+	if len(s.faults) > 0 {
+		fault, s.faults = s.faults[0], s.faults[1:]
+	}
+	s.mu.Unlock()
+
+	if err := fault.inject(ctx); err != nil {
+		return nil, nil, awsError(err, "fake KMS Sign")
+	}
+	if fault.code != "" {
+		return nil, nil, awsError(&smithy.GenericAPIError{Code: fault.code}, "fake KMS Sign")
+	}
+	return s.fakeSigner.SignDigest(ctx, digest)
+}
+
+func (s *faultySigner) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+var testRetryPolicy = retryPolicy{
+	callTimeout:  100 * time.Millisecond,
+	signDeadline: time.Second,
+	maxRetries:   3,
+	baseDelay:    time.Millisecond,
+	maxDelay:     5 * time.Millisecond,
+}
+
+func newFaultyWallet(t *testing.T, faults ...kmsFault) (Wallet, *faultySigner) {
+	t.Helper()
+	signer := &faultySigner{fakeSigner: newFakeSigner(t), faults: faults}
+	w, err := newWallet(signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.policy = testRetryPolicy
+	return w, signer
+}
+
+func TestSignRetries(t *testing.T) {
+	signData, _ := hex.DecodeString("356355dae4212533ce182cbb31492a6c2665fcf8f17e089d929e7a3efd1d1ba1")
+
+	tests := []struct {
+		name   string
+		faults []kmsFault
+		calls  int
+		kind   walleterr.ErrorKind // empty for success
+	}{{
+		name:   "throttled then transient",
+		faults: []kmsFault{{code: "ThrottlingException"}, {code: "KMSInternalException"}},
+		calls:  3,
+	}, {
+		name:   "slow call times out",
+		faults: []kmsFault{{latency: time.Second}},
+		calls:  2,
+	}, {
+		name:   "permission denied",
+		faults: []kmsFault{{code: "AccessDeniedException"}},
+		calls:  1,
+		kind:   walleterr.ErrPermissionDenied,
+	}, {
+		name:   "disabled key",
+		faults: []kmsFault{{code: "DisabledException"}},
+		calls:  1,
+		kind:   walleterr.ErrKeyStateInvalid,
+	}, {
+		name: "retries exhausted",
+		faults: []kmsFault{{code: "ThrottlingException"}, {code: "ThrottlingException"},
+			{code: "ThrottlingException"}, {code: "ThrottlingException"}, {}},
+		calls: 4,
+		kind:  walleterr.ErrBackendThrottled,
+	}}
+
+	for _, test := range tests {
+		w, signer := newFaultyWallet(t, test.faults...)
+		signature, err := w.Sign(signData)
+		if test.kind == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+				continue
+			}
+			verifyRecoverable(t, signData, signature, w.PublicKey())
+		} else if !errors.Is(err, test.kind) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.kind)
+		}
+		if got := signer.count(); got != test.calls {
+			t.Errorf("%s: %d calls, want %d", test.name, got, test.calls)
+		}
+	}
+}
+
+func TestSignDeadline(t *testing.T) {
+	signData, _ := hex.DecodeString("356355dae4212533ce182cbb31492a6c2665fcf8f17e089d929e7a3efd1d1ba1")
+
+	// A backend that ignores its context must not hold up the answer.
+	hung := make([]kmsFault, 10)
+	for i := range hung {
+		hung[i] = kmsFault{latency: time.Second, hang: true}
+	}
+	w, _ := newFaultyWallet(t, hung...)
+	w.policy.callTimeout = 50 * time.Millisecond
+	w.policy.signDeadline = 200 * time.Millisecond
+	w.policy.maxRetries = 10
+	start := time.Now()
+	if _, err := w.Sign(signData); !errors.Is(err, walleterr.ErrSignDeadlineExceeded) {
+		t.Fatalf("got error %v, want %v", err, walleterr.ErrSignDeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond+100*time.Millisecond {
+		t.Errorf("Sign returned after %s", elapsed)
+	}
+
+	// Retries stop at the deadline even if some are left.
+	faults := make([]kmsFault, 10)
+	for i := range faults {
+		faults[i] = kmsFault{latency: 80 * time.Millisecond, code: "KMSInternalException"}
+	}
+	w, signer := newFaultyWallet(t, faults...)
+	w.policy.maxRetries = 10
+	w.policy.signDeadline = 200 * time.Millisecond
+	_, err := w.Sign(signData)
+	if !errors.Is(err, walleterr.ErrSignDeadlineExceeded) || !errors.Is(err, walleterr.ErrBackendUnavailable) {
+		t.Errorf("got error %v, want %v caused by %v", err, walleterr.ErrSignDeadlineExceeded, walleterr.ErrBackendUnavailable)
+	}
+	if got := signer.count(); got > 3 {
+		t.Errorf("%d calls within a 200ms deadline", got)
+	}
+}
+
+func TestNewRetryPolicy(t *testing.T) {
+	p, err := newRetryPolicy(map[string]string{
+		"call_timeout":     "250ms",
+		"sign_deadline":    "2s",
+		"max_retries":      "0",
+		"retry_base_delay": "10ms",
+		"retry_max_delay":  "100ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := retryPolicy{250 * time.Millisecond, 2 * time.Second, 0, 10 * time.Millisecond, 100 * time.Millisecond}
+	if p != want {
+		t.Errorf("got %+v, want %+v", p, want)
+	}
+	for i := 0; i < 10; i++ {
+		if d := p.backoff(i); d < 0 || d > p.maxDelay {
+			t.Errorf("backoff(%d) = %s", i, d)
+		}
+	}
+
+	for _, params := range []map[string]string{
+		{"call_timeout": "1"},
+		{"sign_deadline": "-1s"},
+		{"max_retries": "many"},
+		{"call_timeout": "5s", "sign_deadline": "1s"},
+	} {
+		if _, err := newRetryPolicy(params); !errors.Is(err, walleterr.ErrConfigInvalidParam) {
+			t.Errorf("%v: got error %v", params, err)
+		}
+	}
+}
+
+func TestAwsKmsRetries(t *testing.T) {
+	isolateAwsEnv(t)
+	signer := newFakeSigner(t)
+	fake, srv := newFakeAwsKms(t, signer)
+
+	iWallet, err := NewWallet(map[string]string{
+		"kms_type":          AWS,
+		"region":            "ap-southeast-1",
+		"access_key_id":     "AKIASTATIC",
+		"secret_access_key": "secret",
+		"key_id":            "key",
+		"endpoint_url":      srv.URL,
+		"call_timeout":      "100ms",
+		"retry_base_delay":  "1ms",
+		"retry_max_delay":   "5ms",
+		"self_test":         "false", // the Sign calls below are counted
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	walletInst := iWallet.(walletImpl)
+
+	fake.faults = []kmsFault{{code: "ThrottlingException"}, {latency: time.Second}}
+	signData, _ := hex.DecodeString("356355dae4212533ce182cbb31492a6c2665fcf8f17e089d929e7a3efd1d1ba1")
+	signature, err := walletInst.Sign(signData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyRecoverable(t, signData, signature, walletInst.PublicKey())
+	// The SDK must not retry on its own, or the wallet loses its bound.
+	if got := fake.count("Sign"); got != 3 {
+		t.Errorf("%d Sign calls, want 3", got)
+	}
+}
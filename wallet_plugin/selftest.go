@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	crypto "github.com/remote-signing/wallet_plugin/key"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"time"
+)
+
+// selfTestDigest is signed by the self-test. It is the SHA3-256 of a fixed
+// text, so its signature is of no use for a transaction or a vote, and the
+// double-sign guard lets it be signed again.
+var selfTestDigest = crypto.SHA3Sum256([]byte("remote-signing wallet self-test"))
+
+// KeyDescription is what a backend reports about its signing key, in the
+// terms of the backend, e.g. ECC_SECG_P256K1 or EC_SIGN_SECP256K1_SHA256 for
+// the key spec.
+type KeyDescription struct {
+	KeyID           string `json:"key_id,omitempty"`
+	KeySpec         string `json:"key_spec,omitempty"`
+	KeyUsage        string `json:"key_usage,omitempty"`
+	KeyState        string `json:"key_state,omitempty"`
+	ProtectionLevel string `json:"protection_level,omitempty"` // HSM, SOFTWARE or EXTERNAL
+	Origin          string `json:"origin,omitempty"`           // GENERATED, IMPORTED or the backend's own term
+}
+
+// KeyDescriber is implemented by the signers that can describe their key.
+// DescribeKey returns an ErrKeyAlgorithmMismatch or ErrKeyStateInvalid error
+// along with the description when the key can not sign for goloop.
+type KeyDescriber interface {
+	DescribeKey(ctx context.Context) (KeyDescription, error)
+}
+
+// BackendAttestation is the self-test result of one backend.
+type BackendAttestation struct {
+	Name          string          `json:"name"`
+	Key           *KeyDescription `json:"key,omitempty"`
+	DescribeError string          `json:"describe_error,omitempty"`
+	Signature     string          `json:"signature,omitempty"`
+	LatencyMs     int64           `json:"sign_latency_ms"`
+	Error         string          `json:"error,omitempty"`
+	Skipped       bool            `json:"skipped,omitempty"`
+}
+
+// Attestation is the report of a self-test. It passes when every backend
+// that could be reached signed the test digest with the key of the wallet.
+type Attestation struct {
+	Time      time.Time            `json:"time"`
+	Address   string               `json:"address"`
+	PublicKey string               `json:"public_key"`
+	Digest    string               `json:"digest"`
+	Backends  []BackendAttestation `json:"backends"`
+	Passed    bool                 `json:"passed"`
+}
+
+// fields returns the report as a log value.
+func (a Attestation) fields() map[string]interface{} {
+	var m map[string]interface{}
+	b, _ := json.Marshal(a)
+	_ = json.Unmarshal(b, &m)
+	return m
+}
+
+// SelfTest describes the key of every backend of the wallet, signs a fixed
+// test digest with each of them and verifies the signatures against the
+// public key of the wallet. It returns the report and, if the self-test
+// failed, the first error. A failoverSigner endpoint that could not be
+// reached at startup is skipped.
+func (w Wallet) SelfTest() (Attestation, error) {
+	a := Attestation{
+		Time:      time.Now().UTC(),
+		Address:   w.addr.String(),
+		PublicKey: "0x" + hex.EncodeToString(w.pkey.SerializeCompressed()),
+		Digest:    "0x" + hex.EncodeToString(selfTestDigest),
+	}
+
+	var firstErr error
+	test := func(name string, signer Signer) {
+		b := BackendAttestation{Name: name}
+		if signer == nil {
+			b.Skipped = true
+			b.Error = "backend unavailable"
+		} else if err := w.attest(&b, signer); err != nil {
+			b.Error = err.Error()
+			if firstErr == nil {
+				firstErr = walleterr.Error{Err: walleterr.KindOf(err), Description: "self-test of backend " + name, Cause: err}
+			}
+		}
+		a.Backends = append(a.Backends, b)
+	}
+	if f, ok := w.signer.(*failoverSigner); ok {
+		for _, e := range f.endpoints {
+			e.mu.Lock()
+			signer := e.signer
+			e.mu.Unlock()
+			test(e.name, signer)
+		}
+	} else {
+		test(w.backendName(), w.signer)
+	}
+
+	a.Passed = firstErr == nil
+	return a, firstErr
+}
+
+// attest fills in b for signer. A key that can not be described for lack of
+// permission is still tested, since a signing role need not include it.
+func (w Wallet) attest(b *BackendAttestation, signer Signer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.policy.signDeadline)
+	defer cancel()
+
+	if d, ok := signer.(KeyDescriber); ok {
+		desc, err := d.DescribeKey(ctx)
+		if desc != (KeyDescription{}) {
+			b.Key = &desc
+		}
+		if err != nil {
+			if !errors.Is(err, walleterr.ErrPermissionDenied) {
+				return err
+			}
+			b.DescribeError = err.Error()
+		}
+	}
+
+	start := time.Now()
+	r, s, err := w.policy.signDigest(signer, "", selfTestDigest)
+	b.LatencyMs = time.Since(start).Milliseconds()
+	if err != nil {
+		return err
+	}
+	signature, err := getEthereumSignature(selfTestDigest, r, normalizeS(s), w.pkey)
+	if err != nil {
+		return err
+	}
+	if err := verifySignature(selfTestDigest, signature, w.pkey); err != nil {
+		return err
+	}
+	b.Signature = "0x" + hex.EncodeToString(signature)
+	return nil
+}
+
+// runSelfTest runs the self-test unless the self_test param is false and logs
+// the report.
+func runSelfTest(w Wallet, params map[string]string) error {
+	switch params["self_test"] {
+	case "", "true":
+	case "false":
+		logger.Warn("self-test disabled")
+		return nil
+	default:
+		return invalidParam("self_test", errors.New(`not "true" or "false"`))
+	}
+
+	a, err := w.SelfTest()
+	if err != nil {
+		logger.Error("self-test failed", "report", a.fields(), "err", err)
+		return err
+	}
+	logger.Info("self-test passed", "report", a.fields())
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"testing"
+
+	"cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+func TestSelfTest(t *testing.T) {
+	isolateAwsEnv(t)
+	signer := newFakeSigner(t)
+	fake, srv := newFakeAwsKms(t, signer)
+	params := map[string]string{
+		"kms_type":          "aws",
+		"region":            "ap-southeast-1",
+		"access_key_id":     "AKIASTATIC",
+		"secret_access_key": "secret",
+		"key_id":            "key",
+		"endpoint_url":      srv.URL,
+		"max_retries":       "0",
+	}
+
+	iWallet, err := NewWallet(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.count("DescribeKey") != 1 || fake.count("Sign") != 1 {
+		t.Errorf("self-test made %d DescribeKey and %d Sign calls", fake.count("DescribeKey"), fake.count("Sign"))
+	}
+
+	a, err := iWallet.(Wallet).SelfTest()
+	if err != nil || !a.Passed || len(a.Backends) != 1 {
+		t.Fatalf("SelfTest = %+v, %v", a, err)
+	}
+	b := a.Backends[0]
+	want := KeyDescription{
+		KeyID:           "arn:aws:kms:ap-southeast-1:111122223333:key/key",
+		KeySpec:         "ECC_SECG_P256K1",
+		KeyUsage:        "SIGN_VERIFY",
+		KeyState:        "Enabled",
+		ProtectionLevel: "HSM",
+		Origin:          "AWS_KMS",
+	}
+	if b.Name != "aws" || b.Key == nil || *b.Key != want {
+		t.Errorf("backend report %+v", b)
+	}
+	signature, _ := hex.DecodeString(b.Signature[2:])
+	verifyRecoverable(t, selfTestDigest, signature, signer.PublicKey().SerializeCompressed())
+
+	// A key that can not be described is still signed with.
+	fake.failures = map[string]string{"DescribeKey": "AccessDeniedException"}
+	if a, err := iWallet.(Wallet).SelfTest(); err != nil || a.Backends[0].DescribeError == "" {
+		t.Errorf("SelfTest without DescribeKey permission = %+v, %v", a, err)
+	}
+
+	for name, tc := range map[string]struct {
+		keyState string
+		failures map[string]string
+		kind     walleterr.ErrorKind
+	}{
+		"disabled":       {keyState: "Disabled", kind: walleterr.ErrKeyStateInvalid},
+		"pending delete": {keyState: "PendingDeletion", kind: walleterr.ErrKeyStateInvalid},
+		"no permission":  {failures: map[string]string{"Sign": "AccessDeniedException"}, kind: walleterr.ErrPermissionDenied},
+	} {
+		fake.keyState, fake.failures = tc.keyState, tc.failures
+		if _, err := NewWallet(params); !errors.Is(err, tc.kind) {
+			t.Errorf("%s: NewWallet returned %v, want %s", name, err, tc.kind)
+		}
+	}
+
+	fake.keyState, fake.failures = "Disabled", nil
+	params["self_test"] = "false"
+	if _, err := NewWallet(params); err != nil {
+		t.Errorf("NewWallet without self-test returned %v", err)
+	}
+	params["self_test"] = "no"
+	if _, err := NewWallet(params); !errors.Is(err, walleterr.ErrConfigInvalidParam) {
+		t.Errorf("self_test=no returned %v", err)
+	}
+}
+
+func TestSelfTestWrongKey(t *testing.T) {
+	// The backend signs with another key than the one it reports.
+	signer := newFakeSigner(t)
+	signer.pkey = newFakeSigner(t).pkey
+	w, err := newWallet(signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := w.SelfTest()
+	if !errors.Is(err, walleterr.ErrSignatureRecoveryFailed) || a.Passed || a.Backends[0].Error == "" {
+		t.Errorf("SelfTest = %+v, %v", a, err)
+	}
+}
+
+func TestGcpDescribeKey(t *testing.T) {
+	fake, opts := newFakeGcpKms(t, newFakeSigner(t))
+	gcpKMS := &KMS{
+		parentName: "projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1",
+		opts:       opts,
+	}
+	if err := NewKMSCrypto(gcpKMS); err != nil {
+		t.Fatal(err)
+	}
+	w, err := newWallet(gcpKMS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := w.SelfTest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := KeyDescription{
+		KeyID:           gcpKMS.parentName,
+		KeySpec:         "EC_SIGN_SECP256K1_SHA256",
+		KeyUsage:        "ASYMMETRIC_SIGN",
+		KeyState:        "ENABLED",
+		ProtectionLevel: "HSM",
+		Origin:          "IMPORTED",
+	}
+	if k := a.Backends[0].Key; k == nil || *k != want {
+		t.Errorf("key description %+v", k)
+	}
+
+	fake.state = kmspb.CryptoKeyVersion_DISABLED
+	if _, err := w.SelfTest(); !errors.Is(err, walleterr.ErrKeyStateInvalid) {
+		t.Errorf("SelfTest of a disabled key version returned %v", err)
+	}
+}
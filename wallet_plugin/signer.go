@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	crypto "github.com/remote-signing/wallet_plugin/key"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"sort"
+	"sync"
+)
+
+// Signer is implemented by every signing backend. A backend only has to
+// produce the raw (r, s) pair for a 32-byte digest and expose its public key,
+// the Wallet wrapper takes care of S normalization, recovery id selection and
+// address derivation.
+type Signer interface {
+	// PublicKey returns the public key of the signing key.
+	PublicKey() *crypto.PublicKey
+
+	// SignDigest signs the digest and returns the big-endian r and s values.
+	SignDigest(ctx context.Context, digest []byte) (r []byte, s []byte, err error)
+}
+
+// SignerFactory builds a Signer from the plugin parameters.
+type SignerFactory func(params map[string]string) (Signer, error)
+
+var (
+	signersMu sync.RWMutex
+	signers   = make(map[string]SignerFactory)
+	aliases   = make(map[string]string)
+)
+
+// RegisterSigner makes a signing backend available under the given name and
+// optional aliases. It panics if the name or an alias is already registered.
+func RegisterSigner(name string, factory SignerFactory, alias ...string) {
+	signersMu.Lock()
+	defer signersMu.Unlock()
+
+	if factory == nil {
+		panic("wallet: RegisterSigner factory is nil")
+	}
+	if _, dup := signers[name]; dup {
+		panic("wallet: RegisterSigner called twice for " + name)
+	}
+	signers[name] = factory
+	for _, a := range alias {
+		if _, dup := aliases[a]; dup {
+			panic("wallet: RegisterSigner alias " + a + " already in use")
+		}
+		aliases[a] = name
+	}
+}
+
+// RegisteredSigners returns the sorted names of all registered backends.
+func RegisteredSigners() []string {
+	signersMu.RLock()
+	defer signersMu.RUnlock()
+
+	names := make([]string, 0, len(signers))
+	for name := range signers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// signerName returns the registered name of a backend given its name or one
+// of its aliases, e.g. "aws" for "1".
+func signerName(name string) string {
+	signersMu.RLock()
+	defer signersMu.RUnlock()
+	if canonical, ok := aliases[name]; ok {
+		return canonical
+	}
+	return name
+}
+
+// NewSigner builds the backend registered under name, which may also be one of
+// its aliases.
+func NewSigner(name string, params map[string]string) (Signer, error) {
+	name = signerName(name)
+	signersMu.RLock()
+	factory, ok := signers[name]
+	signersMu.RUnlock()
+
+	if !ok {
+		return nil, walleterr.New(walleterr.ErrBackendNotSupported, "type not supported: "+name)
+	}
+	return factory(params)
+}
+
+// closeSigner releases the connections, sessions and keys held by s, for the
+// backends that hold any. A reload closes the signer it replaced.
+func closeSigner(s Signer) {
+	if c, ok := s.(interface{ close() }); ok {
+		c.close()
+	}
+}
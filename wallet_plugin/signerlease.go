@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/remote-signing/wallet_plugin/lease"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+	"os"
+	"time"
+)
+
+const defaultLeaseTTL = 15 * time.Second
+
+// newSignerLease builds the signer lease selected by the lease_type param:
+//
+//   - file: records in lease_dir, a directory shared by the nodes, e.g. on NFS
+//   - dynamodb: an item of lease_table, with the AWS credentials of the
+//     wallet in lease_region (default region)
+//   - gcs: the object lease_object (default wallet-lease/KEY) of
+//     lease_bucket, with the GCP credentials of the wallet
+//
+// The lease of each key is named by lease_key, by default the address of the
+// wallet, and written for lease_ttl (default 15s) under lease_holder (default
+// the host name). lease_endpoint_url points the dynamodb and gcs leases to
+// another endpoint. It returns nil if lease_type is not set.
+func newSignerLease(params map[string]string, addr string) (*lease.Lease, error) {
+	leaseType := params["lease_type"]
+	if leaseType == "" {
+		return nil, nil
+	}
+
+	ttl := defaultLeaseTTL
+	if v := params["lease_ttl"]; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, invalidParam("lease_ttl", err)
+		}
+		if d < time.Second {
+			return nil, invalidParam("lease_ttl", fmt.Errorf("%s is shorter than 1s", v))
+		}
+		ttl = d
+	}
+	holder := params["lease_holder"]
+	if holder == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, walleterr.Wrap(walleterr.ErrConfigMissingParam, err, "invalid inputs: missing lease_holder")
+		}
+		holder = host
+	}
+	key := params["lease_key"]
+	if key == "" {
+		key = addr
+	}
+
+	ctx := context.Background()
+	var store lease.Store
+	switch leaseType {
+	case "file":
+		if err := requireParams(params, "lease_dir"); err != nil {
+			return nil, err
+		}
+		s, err := lease.NewFileStore(params["lease_dir"], key)
+		if err != nil {
+			return nil, invalidParam("lease_dir", err)
+		}
+		store = s
+	case "dynamodb":
+		if err := requireParams(params, "lease_table"); err != nil {
+			return nil, err
+		}
+		awsParams := params
+		if region := params["lease_region"]; region != "" {
+			awsParams = make(map[string]string, len(params))
+			for k, v := range params {
+				awsParams[k] = v
+			}
+			awsParams["region"] = region
+		}
+		awsCfg, err := awsConfig(ctx, awsParams)
+		if err != nil {
+			return nil, err
+		}
+		store = lease.NewDynamoStore(awsCfg.Credentials, awsCfg.Region, params["lease_endpoint_url"], params["lease_table"], key)
+	case "gcs":
+		if err := requireParams(params, "lease_bucket"); err != nil {
+			return nil, err
+		}
+		opts, _, err := gcpClientOptions(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithScopes("https://www.googleapis.com/auth/devstorage.read_write"))
+		client, _, err := htransport.NewClient(ctx, opts...)
+		if err != nil {
+			return nil, walleterr.Wrap(walleterr.ErrPermissionDenied, err, "gcs lease credentials")
+		}
+		object := params["lease_object"]
+		if object == "" {
+			object = "wallet-lease/" + key
+		}
+		store = lease.NewGCSStore(client, params["lease_endpoint_url"], params["lease_bucket"], object)
+	default:
+		return nil, invalidParam("lease_type", fmt.Errorf("%q is not file, dynamodb or gcs", leaseType))
+	}
+	return lease.New(store, holder, ttl), nil
+}
+
+// startLease tries to take l once and then keeps it, or keeps trying to take
+// it, in the background until stop is called. A node that finds the lease
+// held loads as a standby.
+func startLease(l *lease.Lease) (stop func()) {
+	ctx, cancel := context.WithTimeout(context.Background(), l.TTL()/3)
+	err := l.Acquire(ctx)
+	cancel()
+
+	var held *lease.HeldError
+	switch {
+	case err == nil:
+		logger.Info("signer lease acquired", "lease", l, "holder", l.Holder())
+	case errors.As(err, &held):
+		logger.Info("standing by, signer lease held elsewhere", "lease", l, "holder", held.Holder, "expires", held.Expires)
+	default:
+		logger.Warn("signer lease not acquired", "lease", l, "err", err)
+	}
+
+	ctx, stop = context.WithCancel(context.Background())
+	go l.Keep(ctx, func(err error) {
+		logger.Warn("signer lease renewal failed", "lease", l, "err", err)
+	})
+	return stop
+}
+
+// checkLease returns an ErrKeyInUse error unless this node holds l.
+func checkLease(l *lease.Lease) error {
+	if err := l.Check(); err != nil {
+		return walleterr.Wrap(walleterr.ErrKeyInUse, err, "signer lease "+l.String())
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"testing"
+)
+
+func TestSignerLease(t *testing.T) {
+	dir := t.TempDir()
+	key := newFakeSigner(t)
+	newLeasedWallet := func(holder string) Wallet {
+		w, err := newWallet(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.policy = testRetryPolicy
+		w.lease, err = newSignerLease(map[string]string{"lease_type": "file", "lease_dir": dir, "lease_holder": holder}, w.addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+	active, standby := newLeasedWallet("node-a"), newLeasedWallet("node-b")
+	t.Cleanup(startLease(active.lease))
+	t.Cleanup(startLease(standby.lease))
+
+	digest := sha256.Sum256([]byte("lease"))
+	if _, err := active.Sign(digest[:]); err != nil {
+		t.Fatalf("lease holder could not sign: %v", err)
+	}
+	if _, err := standby.Sign(digest[:]); !errors.Is(err, walleterr.ErrKeyInUse) {
+		t.Errorf("standby Sign returned %v", err)
+	}
+
+	for _, params := range []map[string]string{
+		{"lease_type": "etcd"},
+		{"lease_type": "file", "lease_dir": dir, "lease_ttl": "100ms"},
+		{"lease_type": "file", "lease_dir": dir, "lease_ttl": "soon"},
+	} {
+		if _, err := newSignerLease(params, active.addr.String()); !errors.Is(err, walleterr.ErrConfigInvalidParam) {
+			t.Errorf("newSignerLease(%v) returned %v", params, err)
+		}
+	}
+	if _, err := newSignerLease(map[string]string{"lease_type": "file"}, active.addr.String()); !errors.Is(err, walleterr.ErrConfigMissingParam) {
+		t.Errorf("missing lease_dir returned %v", err)
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	crypto "github.com/remote-signing/wallet_plugin/key"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	vaultDefaultTransitMount = "transit"
+	vaultDefaultK8sJwtPath   = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+func init() {
+	RegisterSigner("vault", newVaultSigner)
+}
+
+// vaultSigner signs through the transit secrets engine of HashiCorp Vault.
+type vaultSigner struct {
+	addr       string
+	mount      string
+	keyName    string
+	keyVersion int
+	namespace  string
+	pkey       *crypto.PublicKey
+	client     *http.Client
+	auth       *vaultAuth
+}
+
+// vaultAuth holds the credentials for one of the supported auth methods and
+// caches the client token obtained from it.
+type vaultAuth struct {
+	method string // "token", "approle" or "kubernetes"
+	mount  string
+
+	roleId   string
+	secretId string
+	role     string
+	jwtPath  string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time // zero for tokens that are not renewed by login
+}
+
+type vaultResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Auth   *vaultAuthInfo  `json:"auth"`
+	Errors []string        `json:"errors"`
+}
+
+type vaultAuthInfo struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int64  `json:"lease_duration"`
+}
+
+type vaultKeyData struct {
+	Type            string                    `json:"type"`
+	LatestVersion   int                       `json:"latest_version"`
+	Keys            map[string]vaultKeyDetail `json:"keys"`
+	SupportsSigning *bool                     `json:"supports_signing"`
+	Exportable      bool                      `json:"exportable"`
+	ImportedKey     bool                      `json:"imported_key"`
+}
+
+type vaultKeyDetail struct {
+	PublicKey string `json:"public_key"`
+}
+
+type vaultSignData struct {
+	Signature  string `json:"signature"`
+	KeyVersion int    `json:"key_version"`
+}
+
+func newVaultSigner(params map[string]string) (Signer, error) {
+	if err := requireParams(params, "vault_addr", "key_name"); err != nil {
+		return nil, err
+	}
+	addr := strings.TrimRight(params["vault_addr"], "/")
+	keyName := params["key_name"]
+
+	s := &vaultSigner{
+		addr:      addr,
+		mount:     strings.Trim(params["transit_mount"], "/"),
+		keyName:   keyName,
+		namespace: params["vault_namespace"],
+		client:    http.DefaultClient,
+	}
+	if s.mount == "" {
+		s.mount = vaultDefaultTransitMount
+	}
+	if v := params["key_version"]; v != "" {
+		version, err := strconv.Atoi(v)
+		if err != nil || version <= 0 {
+			return nil, invalidParam("key_version", fmt.Errorf("%q is not a positive integer", v))
+		}
+		s.keyVersion = version
+	}
+
+	auth, err := newVaultAuth(params)
+	if err != nil {
+		return nil, err
+	}
+	s.auth = auth
+
+	s.pkey, err = s.readPublicKey(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func newVaultAuth(params map[string]string) (*vaultAuth, error) {
+	switch {
+	case params["vault_token"] != "":
+		return &vaultAuth{method: "token", token: params["vault_token"]}, nil
+	case params["approle_role_id"] != "":
+		a := &vaultAuth{
+			method:   "approle",
+			mount:    params["approle_mount"],
+			roleId:   params["approle_role_id"],
+			secretId: params["approle_secret_id"],
+		}
+		if a.mount == "" {
+			a.mount = "approle"
+		}
+		return a, nil
+	case params["k8s_role"] != "":
+		a := &vaultAuth{
+			method:  "kubernetes",
+			mount:   params["k8s_mount"],
+			role:    params["k8s_role"],
+			jwtPath: params["k8s_jwt_path"],
+		}
+		if a.mount == "" {
+			a.mount = "kubernetes"
+		}
+		if a.jwtPath == "" {
+			a.jwtPath = vaultDefaultK8sJwtPath
+		}
+		return a, nil
+	}
+	str := "invalid inputs: missing vault_token, approle_role_id or k8s_role"
+	return nil, walleterr.New(walleterr.ErrConfigMissingParam, str)
+}
+
+func (s *vaultSigner) PublicKey() *crypto.PublicKey {
+	return s.pkey
+}
+
+func (s *vaultSigner) SignDigest(ctx context.Context, digest []byte) ([]byte, []byte, error) {
+	req := map[string]interface{}{
+		"input":                base64.StdEncoding.EncodeToString(digest),
+		"prehashed":            true,
+		"hash_algorithm":       "sha2-256",
+		"marshaling_algorithm": "asn1",
+	}
+	if s.keyVersion > 0 {
+		req["key_version"] = s.keyVersion
+	}
+
+	var data vaultSignData
+	if err := s.do(ctx, http.MethodPost, s.mount+"/sign/"+s.keyName, req, &data); err != nil {
+		return nil, nil, err
+	}
+
+	// vault:v<version>:<base64 DER>
+	parts := strings.SplitN(data.Signature, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" {
+		str := fmt.Sprintf("unexpected vault signature format %q", data.Signature)
+		return nil, nil, walleterr.New(walleterr.ErrSignatureMalformed, str)
+	}
+	der, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, walleterr.Wrap(walleterr.ErrSignatureMalformed, err, "vault signature")
+	}
+
+	return parseDerSignature(der)
+}
+
+func (s *vaultSigner) readPublicKey(ctx context.Context) (*crypto.PublicKey, error) {
+	var data vaultKeyData
+	if err := s.do(ctx, http.MethodGet, s.mount+"/keys/"+s.keyName, nil, &data); err != nil {
+		return nil, err
+	}
+	if data.Type != "ecdsa-secp256k1" {
+		str := fmt.Sprintf("vault transit key %s has type %q instead of ecdsa-secp256k1", s.keyName, data.Type)
+		return nil, walleterr.New(walleterr.ErrKeyAlgorithmMismatch, str)
+	}
+
+	// Without key_version the latest version is pinned, so a rotation of
+	// the transit key does not change the key the wallet signs with.
+	if s.keyVersion == 0 {
+		s.keyVersion = data.LatestVersion
+	}
+	detail, ok := data.Keys[strconv.Itoa(s.keyVersion)]
+	if !ok {
+		str := fmt.Sprintf("vault transit key %s has no version %d", s.keyName, s.keyVersion)
+		return nil, walleterr.New(walleterr.ErrKeyNotFound, str)
+	}
+
+	return parsePemPublicKey([]byte(detail.PublicKey))
+}
+
+// DescribeKey reports the transit key. Transit keys are held by Vault in
+// software, an exportable key is reported with the EXPORTABLE origin.
+func (s *vaultSigner) DescribeKey(ctx context.Context) (KeyDescription, error) {
+	var data vaultKeyData
+	if err := s.do(ctx, http.MethodGet, s.mount+"/keys/"+s.keyName, nil, &data); err != nil {
+		return KeyDescription{}, err
+	}
+	version := s.keyVersion
+	if version == 0 {
+		version = data.LatestVersion
+	}
+	desc := KeyDescription{
+		KeyID:           fmt.Sprintf("%s/keys/%s/%d", s.mount, s.keyName, version),
+		KeySpec:         data.Type,
+		KeyUsage:        "sign",
+		KeyState:        "ENABLED",
+		ProtectionLevel: "SOFTWARE",
+		Origin:          "GENERATED",
+	}
+	switch {
+	case data.ImportedKey:
+		desc.Origin = "IMPORTED"
+	case data.Exportable:
+		desc.Origin = "EXPORTABLE"
+	}
+
+	if data.Type != "ecdsa-secp256k1" || (data.SupportsSigning != nil && !*data.SupportsSigning) {
+		str := fmt.Sprintf("vault transit key %s has type %q instead of ecdsa-secp256k1", s.keyName, data.Type)
+		return desc, walleterr.New(walleterr.ErrKeyAlgorithmMismatch, str)
+	}
+	if _, ok := data.Keys[strconv.Itoa(version)]; !ok {
+		desc.KeyState = "MISSING"
+		str := fmt.Sprintf("vault transit key %s has no version %d", s.keyName, version)
+		return desc, walleterr.New(walleterr.ErrKeyNotFound, str)
+	}
+	return desc, nil
+}
+
+// parsePemPublicKey parses a PEM encoded SubjectPublicKeyInfo holding an EC
+// public key.
+func parsePemPublicKey(pemBytes []byte) (*crypto.PublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, walleterr.New(walleterr.ErrKeyAlgorithmMismatch, "public key is not PEM encoded")
+	}
+
+	var info struct {
+		AlgID pkix.AlgorithmIdentifier
+		Key   asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(block.Bytes, &info); err != nil {
+		return nil, walleterr.Wrap(walleterr.ErrKeyAlgorithmMismatch, err, "public key ASN.1")
+	}
+
+	wantAlg := asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	if gotAlg := info.AlgID.Algorithm; !gotAlg.Equal(wantAlg) {
+		str := fmt.Sprintf("public key ASN.1 algorithm %s instead of %s", gotAlg, wantAlg)
+		return nil, walleterr.New(walleterr.ErrKeyAlgorithmMismatch, str)
+	}
+
+	pkey, err := crypto.ParsePublicKey(info.Key.Bytes)
+	if err != nil {
+		return nil, walleterr.Wrap(walleterr.ErrKeyAlgorithmMismatch, err, "public key")
+	}
+	return pkey, nil
+}
+
+func (s *vaultSigner) do(ctx context.Context, method, path string, in, out interface{}) error {
+	token, err := s.auth.getToken(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	var vr vaultResponse
+	status, err := s.request(ctx, method, path, token, in, &vr)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusForbidden && s.auth.method != "token" {
+		// The login token may have been revoked before its lease ran out.
+		s.auth.invalidate()
+		if token, err = s.auth.getToken(ctx, s); err != nil {
+			return err
+		}
+		if status, err = s.request(ctx, method, path, token, in, &vr); err != nil {
+			return err
+		}
+	}
+	if status != http.StatusOK {
+		return vaultError(status, vr.Errors)
+	}
+
+	if err := json.Unmarshal(vr.Data, out); err != nil {
+		return walleterr.Wrap(walleterr.ErrBackendUnavailable, err, "vault response")
+	}
+	return nil
+}
+
+func (s *vaultSigner) request(ctx context.Context, method, path, token string, in interface{}, vr *vaultResponse) (int, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = strings.NewReader(string(b))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, s.addr+"/v1/"+path, body)
+	if err != nil {
+		return 0, invalidParam("vault_addr", err)
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if s.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", s.namespace)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, walleterr.Wrap(walleterr.ErrBackendUnavailable, err, "vault")
+	}
+	defer resp.Body.Close()
+
+	*vr = vaultResponse{}
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, walleterr.Wrap(walleterr.ErrBackendUnavailable, err, "vault")
+	}
+	if len(respBody) > 0 {
+		if err := json.Unmarshal(respBody, vr); err != nil && resp.StatusCode == http.StatusOK {
+			return 0, walleterr.Wrap(walleterr.ErrBackendUnavailable, err, "vault response")
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func vaultError(status int, errs []string) error {
+	if len(errs) > 0 {
+		return httpStatusError(status, "vault: "+strings.Join(errs, "; "))
+	}
+	return httpStatusError(status, "vault")
+}
+
+func (a *vaultAuth) invalidate() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.token = ""
+}
+
+func (a *vaultAuth) getToken(ctx context.Context, s *vaultSigner) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.method == "token" {
+		return a.token, nil
+	}
+	if a.token != "" && time.Now().Add(time.Minute).Before(a.expires) {
+		return a.token, nil
+	}
+
+	var login map[string]string
+	switch a.method {
+	case "approle":
+		login = map[string]string{"role_id": a.roleId, "secret_id": a.secretId}
+	case "kubernetes":
+		jwt, err := os.ReadFile(a.jwtPath)
+		if err != nil {
+			return "", invalidParam("k8s_jwt_path", err)
+		}
+		login = map[string]string{"role": a.role, "jwt": strings.TrimSpace(string(jwt))}
+	}
+
+	var vr vaultResponse
+	status, err := s.request(ctx, http.MethodPost, "auth/"+strings.Trim(a.mount, "/")+"/login", "", login, &vr)
+	if err != nil {
+		return "", err
+	}
+	if status == http.StatusBadRequest {
+		// Vault answers a rejected role or secret id with 400.
+		return "", walleterr.New(walleterr.ErrPermissionDenied, "vault login: "+strings.Join(vr.Errors, "; "))
+	}
+	if status != http.StatusOK {
+		return "", vaultError(status, vr.Errors)
+	}
+	if vr.Auth == nil || vr.Auth.ClientToken == "" {
+		return "", walleterr.New(walleterr.ErrPermissionDenied, "vault login returned no client token")
+	}
+
+	a.token = vr.Auth.ClientToken
+	a.expires = time.Now().Add(time.Duration(vr.Auth.LeaseDuration) * time.Second)
+	return a.token, nil
+}
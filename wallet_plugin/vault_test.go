@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func fakePemPublicKey(t *testing.T, signer *fakeSigner) string {
+	t.Helper()
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: fakeDerPublicKey(t, signer)}))
+}
+
+// fakeVaultTransit is a Vault transit key whose versions are held by
+// fakeSigners, the last one being the latest version.
+type fakeVaultTransit struct {
+	mu       sync.Mutex
+	versions []*fakeSigner
+}
+
+// rotate adds a new latest version of the key.
+func (f *fakeVaultTransit) rotate(signer *fakeSigner) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.versions = append(f.versions, signer)
+}
+
+// newFakeVaultTransit serves the login, key read and sign endpoints of the
+// Vault transit API backed by a fakeSigner.
+func newFakeVaultTransit(t *testing.T, signer *fakeSigner) (*fakeVaultTransit, *httptest.Server) {
+	t.Helper()
+	const token = "s.fake"
+	fake := &fakeVaultTransit{versions: []*fakeSigner{signer}}
+
+	writeData := func(w http.ResponseWriter, data interface{}) {
+		raw, _ := json.Marshal(data)
+		_ = json.NewEncoder(w).Encode(vaultResponse{Data: raw})
+	}
+	authorized := func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("X-Vault-Token") != token {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+			return false
+		}
+		return true
+	}
+
+	mux := http.NewServeMux()
+	login := func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if req["secret_id"] != "secret" && req["jwt"] != "k8s-jwt" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"errors":["invalid credentials"]}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(vaultResponse{Auth: &vaultAuthInfo{ClientToken: token, LeaseDuration: 3600}})
+	}
+	mux.HandleFunc("/v1/auth/approle/login", login)
+	mux.HandleFunc("/v1/auth/kubernetes/login", login)
+	mux.HandleFunc("/v1/transit/keys/validator", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		keys := make(map[string]vaultKeyDetail, len(fake.versions))
+		for i, signer := range fake.versions {
+			keys[strconv.Itoa(i+1)] = vaultKeyDetail{PublicKey: fakePemPublicKey(t, signer)}
+		}
+		writeData(w, vaultKeyData{Type: "ecdsa-secp256k1", LatestVersion: len(fake.versions), Keys: keys})
+	})
+	mux.HandleFunc("/v1/transit/sign/validator", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		var req struct {
+			Input      string `json:"input"`
+			Prehashed  bool   `json:"prehashed"`
+			KeyVersion int    `json:"key_version"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		digest, _ := base64.StdEncoding.DecodeString(req.Input)
+		if !req.Prehashed || len(digest) != 32 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"errors":["input must be prehashed"]}`))
+			return
+		}
+		fake.mu.Lock()
+		version := req.KeyVersion
+		if version == 0 {
+			version = len(fake.versions)
+		}
+		var signer *fakeSigner
+		if version <= len(fake.versions) {
+			signer = fake.versions[version-1]
+		}
+		fake.mu.Unlock()
+		if signer == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"errors":["requested version for signing does not exist"]}`))
+			return
+		}
+		rb, sb, _ := signer.SignDigest(r.Context(), digest)
+		der, _ := asn1.Marshal(struct{ R, S *big.Int }{new(big.Int).SetBytes(rb), new(big.Int).SetBytes(sb)})
+		sig := fmt.Sprintf("vault:v%d:%s", version, base64.StdEncoding.EncodeToString(der))
+		writeData(w, vaultSignData{Signature: sig, KeyVersion: version})
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return fake, srv
+}
+
+func TestVaultTransit(t *testing.T) {
+	signer := newFakeSigner(t)
+	signer.highS = true
+	_, srv := newFakeVaultTransit(t, signer)
+
+	jwtPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(jwtPath, []byte("k8s-jwt\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, params := range map[string]map[string]string{
+		"token":      {"vault_token": "s.fake"},
+		"approle":    {"approle_role_id": "role", "approle_secret_id": "secret"},
+		"kubernetes": {"k8s_role": "validator", "k8s_jwt_path": jwtPath},
+	} {
+		t.Run(name, func(t *testing.T) {
+			params["kms_type"] = "vault"
+			params["vault_addr"] = srv.URL
+			params["key_name"] = "validator"
+			params["key_version"] = "1"
+
+			iWallet, err := NewWallet(params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			walletInst := iWallet.(walletImpl)
+
+			signData, _ := hex.DecodeString("356355dae4212533ce182cbb31492a6c2665fcf8f17e089d929e7a3efd1d1ba1")
+			signature, err := walletInst.Sign(signData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifyRecoverable(t, signData, signature, signer.PublicKey().SerializeCompressed())
+		})
+	}
+}
+
+func TestVaultTransitErrors(t *testing.T) {
+	signer := newFakeSigner(t)
+	_, srv := newFakeVaultTransit(t, signer)
+
+	for name, tc := range map[string]struct {
+		params map[string]string
+		kind   walleterr.ErrorKind
+	}{
+		"bad token":       {map[string]string{"vault_token": "s.other"}, walleterr.ErrPermissionDenied},
+		"bad secret":      {map[string]string{"approle_role_id": "role", "approle_secret_id": "other"}, walleterr.ErrPermissionDenied},
+		"missing version": {map[string]string{"vault_token": "s.fake", "key_version": "2"}, walleterr.ErrKeyNotFound},
+		"bad version":     {map[string]string{"vault_token": "s.fake", "key_version": "latest"}, walleterr.ErrConfigInvalidParam},
+		"no auth":         {map[string]string{}, walleterr.ErrConfigMissingParam},
+	} {
+		tc.params["kms_type"] = "vault"
+		tc.params["vault_addr"] = srv.URL
+		tc.params["key_name"] = "validator"
+		if _, err := NewWallet(tc.params); !errors.Is(err, tc.kind) {
+			t.Errorf("%s: NewWallet returned %v, want %v", name, err, tc.kind)
+		}
+	}
+}
+
+func TestVaultTransitRotation(t *testing.T) {
+	signer := newFakeSigner(t)
+	fake, srv := newFakeVaultTransit(t, signer)
+	iWallet, err := NewWallet(map[string]string{
+		"kms_type":    "vault",
+		"vault_addr":  srv.URL,
+		"key_name":    "validator",
+		"vault_token": "s.fake",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	walletInst := iWallet.(walletImpl)
+
+	// The wallet keeps signing with the version it loaded.
+	fake.rotate(newFakeSigner(t))
+	signData, _ := hex.DecodeString("356355dae4212533ce182cbb31492a6c2665fcf8f17e089d929e7a3efd1d1ba1")
+	signature, err := walletInst.Sign(signData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyRecoverable(t, signData, signature, signer.PublicKey().SerializeCompressed())
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	crypto "github.com/remote-signing/wallet_plugin/key"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+	"math/big"
+)
+
+// checkDigest makes sure only a 32-byte digest is passed to a backend.
+func checkDigest(digest []byte) error {
+	if len(digest) != crypto.HashLen {
+		str := fmt.Sprintf("digest must be %d bytes, got %d", crypto.HashLen, len(digest))
+		return walleterr.New(walleterr.ErrDigestLength, str)
+	}
+	return nil
+}
+
+// verifySignature checks a 65-byte [R|S|V] signature the way goloop will: S
+// must be low, the signature must verify against the cached public key and V
+// must recover that same key.
+func verifySignature(digest, signature []byte, pkey *crypto.PublicKey) error {
+	if err := checkDigest(digest); err != nil {
+		return err
+	}
+
+	sig, err := crypto.ParseSignature(signature)
+	if err != nil || !sig.HasV() {
+		return walleterr.New(walleterr.ErrSignatureMalformed, "signature is not in [R|S|V] format")
+	}
+
+	s := new(big.Int).SetBytes(signature[32:64])
+	if s.Cmp(secp256k1halfN) > 0 {
+		return walleterr.New(walleterr.ErrSignatureHighS, "signature S is not in the lower half of the curve order")
+	}
+
+	if !sig.Verify(digest, pkey) {
+		str := fmt.Sprintf("signature %s does not verify for public key %s", sig, pkey)
+		return walleterr.New(walleterr.ErrSignatureInvalid, str)
+	}
+
+	recovered, err := sig.RecoverPublicKey(digest)
+	if err != nil || !recovered.Equal(pkey) {
+		str := fmt.Sprintf("signature %s does not recover public key %s", sig, pkey)
+		return walleterr.New(walleterr.ErrSignatureRecoveryFailed, str)
+	}
+
+	return nil
+}
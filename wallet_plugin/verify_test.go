@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	crypto "github.com/remote-signing/wallet_plugin/key"
+	"github.com/remote-signing/wallet_plugin/walleterr"
+)
+
+// misbehavingSigner claims the public key of one signer but signs with
+// another one, like a misconfigured KMS key or a tampering proxy.
+type misbehavingSigner struct {
+	claimed *fakeSigner
+	actual  *fakeSigner
+	mangle  func(r, s []byte) ([]byte, []byte)
+}
+
+func (m *misbehavingSigner) PublicKey() *crypto.PublicKey {
+	return m.claimed.PublicKey()
+}
+
+func (m *misbehavingSigner) SignDigest(ctx context.Context, digest []byte) ([]byte, []byte, error) {
+	r, s, err := m.actual.SignDigest(ctx, digest)
+	if err != nil || m.mangle == nil {
+		return r, s, err
+	}
+	r, s = m.mangle(r, s)
+	return r, s, nil
+}
+
+func TestWalletSignRejectsBadSignatures(t *testing.T) {
+	good := newFakeSigner(t)
+	other := newFakeSigner(t)
+	digest := make([]byte, 32)
+	digest[31] = 1
+
+	for name, tc := range map[string]struct {
+		signer Signer
+		digest []byte
+		kind   walleterr.ErrorKind
+	}{
+		"short digest": {good, digest[:31], walleterr.ErrDigestLength},
+		"long digest":  {good, append(digest, 0), walleterr.ErrDigestLength},
+		"wrong key":    {&misbehavingSigner{claimed: good, actual: other}, digest, walleterr.ErrSignatureRecoveryFailed},
+		"oversized r": {&misbehavingSigner{claimed: good, actual: good, mangle: func(r, s []byte) ([]byte, []byte) {
+			return append([]byte{1}, adjustSignatureLength(r)...), s
+		}}, digest, walleterr.ErrSignatureMalformed},
+		"flipped s": {&misbehavingSigner{claimed: good, actual: good, mangle: func(r, s []byte) ([]byte, []byte) {
+			s = append([]byte{}, adjustSignatureLength(s)...)
+			s[31] ^= 1
+			return r, s
+		}}, digest, walleterr.ErrSignatureRecoveryFailed},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w, err := newWallet(tc.signer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = w.Sign(tc.digest)
+			if !errors.Is(err, tc.kind) {
+				t.Fatalf("Sign returned %v, want %v", err, tc.kind)
+			}
+			var werr walleterr.Error
+			if !errors.As(err, &werr) {
+				t.Fatalf("Sign returned %T, want walleterr.Error", err)
+			}
+		})
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	signer := newFakeSigner(t)
+	w, err := newWallet(signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := make([]byte, 32)
+	digest[0] = 0xab
+	signature, err := w.Sign(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifySignature(digest, signature, signer.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same signature with S negated is valid ECDSA but must be refused.
+	highS := append([]byte{}, signature...)
+	s := new(big.Int).SetBytes(signature[32:64])
+	new(big.Int).Sub(secp256k1N, s).FillBytes(highS[32:64])
+	highS[64] ^= 1
+	if err := verifySignature(digest, highS, signer.PublicKey()); !errors.Is(err, walleterr.ErrSignatureHighS) {
+		t.Fatalf("high S signature returned %v", err)
+	}
+
+	other := newFakeSigner(t)
+	if err := verifySignature(digest, signature, other.PublicKey()); !errors.Is(err, walleterr.ErrSignatureInvalid) {
+		t.Fatalf("signature for another key returned %v", err)
+	}
+
+	wrongV := append([]byte{}, signature...)
+	wrongV[64] ^= 1
+	if err := verifySignature(digest, wrongV, signer.PublicKey()); !errors.Is(err, walleterr.ErrSignatureRecoveryFailed) {
+		t.Fatalf("signature with wrong V returned %v", err)
+	}
+
+	if err := verifySignature(digest, signature[:64], signer.PublicKey()); !errors.Is(err, walleterr.ErrSignatureMalformed) {
+		t.Fatalf("signature without V returned %v", err)
+	}
+}
@@ -2,25 +2,16 @@ package main
 
 import (
 	"bytes"
-	cloudkms "cloud.google.com/go/kms/apiv1"
-	"cloud.google.com/go/kms/apiv1/kmspb"
 	"context"
-	"crypto/x509/pkix"
-	"encoding/asn1"
-	"encoding/pem"
-	"errors"
 	"fmt"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/remote-signing/wallet_plugin/address"
 	crypto "github.com/remote-signing/wallet_plugin/key"
-	"google.golang.org/api/option"
+	"github.com/remote-signing/wallet_plugin/lease"
+	"github.com/remote-signing/wallet_plugin/walleterr"
 	"math/big"
+	"time"
 )
 
-const awsKmsSignOperationMessageType = "DIGEST"
-const awsKmsSignOperationSigningAlgorithm = "ECDSA_SHA_256"
 const (
 	AWS = "1"
 	GCP = "2"
@@ -31,278 +22,401 @@ var (
 	secp256k1halfN = new(big.Int).Div(secp256k1N, big.NewInt(2))
 )
 
-type asn1EcPublicKeyInfo struct {
-	Algorithm  asn1.ObjectIdentifier
-	Parameters asn1.ObjectIdentifier
-}
+// Wallet wraps a Signer and turns its raw (r, s) output into the 65-byte
+// [R|S|V] signature goloop expects.
+type Wallet struct {
+	signer Signer
+	pkey   *crypto.PublicKey
+	addr   *address.Address
+	policy retryPolicy
 
-type asn1EcPublicKey struct {
-	EcPublicKeyInfo asn1EcPublicKeyInfo
-	PublicKey       asn1.BitString
-}
+	// backend names the signer in metrics. It is empty for a failoverSigner,
+	// which reports each of its endpoints.
+	backend string
 
-type Wallet struct {
-	//pk    *crypto.PrivateKey
-	pkey  *crypto.PublicKey
-	svc   *kms.Client
-	keyId string
-	addr  *address.Address
+	// audit records every Sign call if an audit log is configured.
+	audit *auditor
+
+	// guard holds the key lock and the signing history if state_dir is set.
+	guard *signGuard
+
+	// lease must be held to sign if lease_type is set. stopLease stops
+	// renewing it.
+	lease     *lease.Lease
+	stopLease func()
+
+	// breaker guards a single backend, a failoverSigner has one for each
+	// of its endpoints instead.
+	breaker *circuitBreaker
+
+	// control pauses signing and tracks the last Sign call for the admin
+	// socket.
+	control *walletControl
 }
 
-type asn1EcSig struct {
-	R asn1.RawValue
-	S asn1.RawValue
+func newWallet(signer Signer) (Wallet, error) {
+	pkey := signer.PublicKey()
+	if pkey == nil {
+		return Wallet{}, walleterr.New(walleterr.ErrKeyNotFound, "signer has no public key")
+	}
+	w := Wallet{
+		signer:  signer,
+		pkey:    pkey,
+		addr:    NewAccountAddressFromPublicKey(pkey),
+		policy:  defaultRetryPolicy,
+		control: &walletControl{},
+	}
+	if _, ok := signer.(*failoverSigner); !ok {
+		w.backend = "signer"
+		w.breaker = newCircuitBreaker(w.backend, defaultBreakerConfig)
+	}
+	return w, nil
 }
 
 func (w Wallet) Address() address.IAddress {
 	return w.addr
 }
 
+func (w Wallet) PublicKey() []byte {
+	return w.pkey.SerializeCompressed()
+}
+
 func (w Wallet) Sign(data []byte) ([]byte, error) {
-	rBytes, sBytes, err := getSignatureFromKms(context.Background(), w.svc, w.keyId, data)
+	start := time.Now()
+	signature, reserved, err := w.guardedSign(data)
+	if w.audit != nil {
+		if aerr := w.audit.record(w.backendName(), data, signature, start, err); aerr != nil && err == nil {
+			// A signature that was not recorded is never handed out.
+			signature, err = nil, aerr
+		}
+	}
+	if reserved {
+		// Only a digest whose signature was handed out stays in the history.
+		w.guard.done(data, err == nil)
+	}
+	signTotal.Inc(resultLabel(err))
+	w.control.signed(start, err)
+	if err != nil {
+		logger.Warn("sign failed", "backend", w.backendName(), "digest", data, "kind", resultLabel(err), "err", err)
+	} else {
+		logger.Trace("signed", "backend", w.backendName(), "digest", data, "signature", signature)
+	}
+	return signature, err
+}
+
+// backendName names the backend of the wallet in logs.
+func (w Wallet) backendName() string {
+	if w.backend == "" {
+		return "failover"
+	}
+	return w.backend
+}
+
+// guardedSign signs data unless signing is paused, another node holds the
+// signer lease, it is a duplicate the policy rejects or the circuit breaker
+// of the backend is open. It reports whether it reserved data with the
+// double-sign guard, which the caller must then pass to done.
+func (w Wallet) guardedSign(data []byte) ([]byte, bool, error) {
+	if err := checkDigest(data); err != nil {
+		return nil, false, err
+	}
+	if err := w.control.check(); err != nil {
+		return nil, false, err
+	}
+	if w.lease != nil {
+		if err := checkLease(w.lease); err != nil {
+			return nil, false, err
+		}
+	}
+	// The self-test of a remote wallet signs the self-test digest through
+	// the Sign of the daemon every time it loads.
+	if w.guard == nil || bytes.Equal(data, selfTestDigest) {
+		signature, err := w.breakerSign(data)
+		return signature, false, err
+	}
+
+	if err := w.guard.reserve(data); err != nil {
+		return nil, false, err
+	}
+	signature, err := w.breakerSign(data)
+	return signature, true, err
+}
+
+// breakerSign signs data unless the circuit breaker of the backend is open.
+func (w Wallet) breakerSign(data []byte) ([]byte, error) {
+	if w.breaker == nil {
+		return w.sign(data)
+	}
+
+	if err := w.breaker.allow(time.Now()); err != nil {
+		return nil, err
+	}
+	signature, err := w.sign(data)
+	w.breaker.record(err, time.Now())
+	return signature, err
+}
+
+// Health reports the circuit breaker state of every backend of the wallet.
+func (w Wallet) Health() Health {
+	now := time.Now()
+	h := Health{Address: w.addr.String()}
+	if w.breaker != nil {
+		h.Backends = []BackendHealth{w.breaker.health(now)}
+	} else if f, ok := w.signer.(*failoverSigner); ok {
+		h.Backends = f.health(now)
+	}
+	for _, b := range h.Backends {
+		if b.State != BreakerOpen {
+			h.Healthy = true
+		}
+	}
+	return h
+}
+
+func (w Wallet) sign(data []byte) ([]byte, error) {
+	rBytes, sBytes, err := w.policy.signDigest(w.signer, w.backend, data)
 	if err != nil {
 		return nil, err
 	}
 
 	// Adjust S value from signature according to Ethereum standard
-	sBigInt := new(big.Int).SetBytes(sBytes)
-	if sBigInt.Cmp(secp256k1halfN) > 0 {
-		sBytes = new(big.Int).Sub(secp256k1N, sBigInt).Bytes()
-	}
+	sBytes = normalizeS(sBytes)
 
 	signature, err := getEthereumSignature(data, rBytes, sBytes, w.pkey)
 	if err != nil {
 		return nil, err
 	}
 
+	// Never hand goloop a signature it would reject.
+	if err := verifySignature(data, signature, w.pkey); err != nil {
+		return nil, err
+	}
+
 	return signature, nil
 }
 
+// normalizeS returns N - s when s is in the upper half of the curve order.
+func normalizeS(s []byte) []byte {
+	sBigInt := new(big.Int).SetBytes(s)
+	if sBigInt.Cmp(secp256k1halfN) > 0 {
+		return new(big.Int).Sub(secp256k1N, sBigInt).Bytes()
+	}
+	return s
+}
+
 func getEthereumSignature(data []byte, r []byte, s []byte, pkey *crypto.PublicKey) ([]byte, error) {
 	rsSignature := append(adjustSignatureLength(r), adjustSignatureLength(s)...)
+	if len(rsSignature) != crypto.SignatureLenRaw {
+		str := fmt.Sprintf("signature with %d-byte r and %d-byte s", len(r), len(s))
+		return nil, walleterr.New(walleterr.ErrSignatureMalformed, str)
+	}
 	signature := append(rsSignature, []byte{0}...)
 	// ParseSignatureVRS
 	signatureInst, err := crypto.ParseSignature(signature)
 	if err != nil {
-		return nil, err
+		return nil, walleterr.Wrap(walleterr.ErrSignatureMalformed, err, "parse signature")
 	}
 
 	pubKeyFromSig, err := signatureInst.RecoverPublicKey(data)
-	if err != nil || pubKeyFromSig.String() != pkey.String() {
+	if err != nil || !pubKeyFromSig.Equal(pkey) {
 		signature = append(rsSignature, []byte{1}...)
 		signatureInst, err = crypto.ParseSignature(signature)
 		if err != nil {
-			return nil, err
+			return nil, walleterr.Wrap(walleterr.ErrSignatureMalformed, err, "parse signature")
 		}
 
 		pubKeyFromSig, err = signatureInst.RecoverPublicKey(data)
-		if err != nil || pubKeyFromSig.String() != pkey.String() {
-			return nil, errors.New("can not reconstruct public key from sig")
+		if err != nil || !pubKeyFromSig.Equal(pkey) {
+			return nil, walleterr.New(walleterr.ErrSignatureRecoveryFailed, "can not reconstruct public key from sig")
 		}
+		recoveryFallbacks.Inc()
 	}
 
 	return signature, nil
 }
 
-func (w Wallet) PublicKey() []byte {
-	return w.pkey.SerializeCompressed()
-}
-
 // goloop entry here
 func NewWallet(params map[string]string) (interface{}, error) {
-	//var key *crypto.PrivateKey
-	//// load key from input params
-	//if _, ok := params["private_key"]; ok {
-	//	keyBytes, err := hex.DecodeString(params["private_key"])
-	//	if err != nil {
-	//		return nil, err
-	//	}
-	//
-	//	key, err = crypto.ParsePrivateKey(keyBytes)
-	//	if err != nil {
-	//		return nil, err
-	//	}
-	//} else {
-	//	key, _ = crypto.GenerateKeyPair()
-	//}
-
-	var kmsType string
-	if _, ok := params["kms_type"]; ok {
-		kmsType = params["kms_type"]
-	}
-
-	if kmsType == AWS {
-		return AwsKms(params)
-	} else if kmsType == GCP {
-		return GcpKms(params)
-	}
-	return nil, errors.New("type not supported")
-}
-
-func AwsKms(params map[string]string) (interface{}, error) {
-	var region, accessKeyId, secretAccessKey, keyId string
-	if _, ok := params["region"]; ok {
-		region = params["region"]
-	}
-
-	if _, ok := params["access_key_id"]; ok {
-		accessKeyId = params["access_key_id"]
-	}
-
-	if _, ok := params["secret_access_key"]; ok {
-		secretAccessKey = params["secret_access_key"]
-	}
-
-	if _, ok := params["key_id"]; ok {
-		keyId = params["key_id"]
+	flat, err := loadConfigFile(params)
+	if err != nil {
+		return nil, err
 	}
-
-	if len(region)*len(accessKeyId)*len(secretAccessKey)*len(keyId) == 0 {
-		return nil, errors.New("invalid inputs")
+	if flat["admin_socket"] == "" {
+		return loadNodeWallet(params, flat)
 	}
 
-	awsCfg, err := config.LoadDefaultConfig(context.Background())
+	// The socket is taken first, so a second node configured with it
+	// fails before it loads the key.
+	admin, fresh, err := listenAdmin(flat)
 	if err != nil {
 		return nil, err
 	}
-	awsCfg.Region = region
-	provider := aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
-		return aws.Credentials{
-			AccessKeyID:     accessKeyId,
-			SecretAccessKey: secretAccessKey,
-		}, nil
-	})
-	awsCfg.Credentials = provider
-	kmsSvc := kms.NewFromConfig(awsCfg)
-	pubkeyFromAws, err := GetPubKeyCtx(context.Background(), kmsSvc, keyId)
+	w, err := loadNodeWallet(params, flat)
 	if err != nil {
+		if fresh {
+			admin.close()
+		}
 		return nil, err
 	}
+	admin.setWallet(w.(adminWallet))
+	return w, nil
+}
 
-	wallet := Wallet{
-		svc:   kmsSvc,
-		pkey:  pubkeyFromAws,
-		keyId: keyId,
-		addr:  NewAccountAddressFromPublicKey(pubkeyFromAws),
+// loadNodeWallet loads a MigrationWallet during a key migration, a
+// ReloadableWallet with a config file or an admin socket, which refreshes
+// its credentials through a reload, and a Wallet otherwise.
+func loadNodeWallet(params, flat map[string]string) (interface{}, error) {
+	if flat["migration_incoming"] != "" {
+		// A reload could change either key under a switch, so a
+		// migration wallet is only loaded once.
+		m, err := newMigrationWallet(flat)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	if params["config_file"] != "" || flat["admin_socket"] != "" {
+		r, err := newReloadableWallet(params)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
 	}
 
-	fmt.Printf("wallet address: %+v \n", wallet.addr.String())
-	fmt.Printf("pubkey: %+v \n", wallet.pkey.SerializeCompressed())
-
+	wallet, err := loadWallet(params)
+	if err != nil {
+		return nil, err
+	}
 	return wallet, nil
 }
 
-func GcpKms(params map[string]string) (interface{}, error) {
-
-	var projectId, locationId, keyRing, key, keyVersion, credentialPath string
-	if _, ok := params["project_id"]; ok {
-		projectId = params["project_id"]
+// loadWallet builds a wallet from flat params, claims its key and opens its
+// audit log.
+func loadWallet(params map[string]string) (Wallet, error) {
+	if err := configureLogger(params); err != nil {
+		return Wallet{}, err
 	}
+	logger.Debug("loading wallet", "params", loggableParams(params))
 
-	if _, ok := params["location_id"]; ok {
-		locationId = params["location_id"]
+	wallet, err := newSignerWallet(params)
+	if err != nil {
+		return Wallet{}, err
 	}
-
-	if _, ok := params["key_ring"]; ok {
-		keyRing = params["key_ring"]
+	if err := wallet.claimKey(params); err != nil {
+		closeSigner(wallet.signer)
+		return Wallet{}, err
 	}
-
-	if _, ok := params["key"]; ok {
-		key = params["key"]
+	if wallet.audit, err = newAuditor(params); err != nil {
+		wallet.releaseKey()
+		closeSigner(wallet.signer)
+		return Wallet{}, err
 	}
 
-	if _, ok := params["key_version"]; ok {
-		keyVersion = params["key_version"]
+	if addr := params["metrics_listen"]; addr != "" {
+		if _, err := serveMetrics(addr); err != nil {
+			wallet.releaseKey()
+			closeSigner(wallet.signer)
+			return Wallet{}, err
+		}
 	}
 
-	if _, ok := params["credential_path"]; ok {
-		credentialPath = params["credential_path"]
-	}
+	logger.Info("wallet loaded", "backend", wallet.backendName(), "address", wallet.addr, "pubkey", wallet.pkey.SerializeCompressed())
 
-	if len(projectId)*len(locationId)*len(keyRing)*len(key)*len(keyVersion)*len(credentialPath) == 0 {
-		return nil, errors.New("invalid inputs")
-	}
+	return wallet, nil
+}
 
-	var err error
-	gcpKMS := KMS{
-		parentName:     fmt.Sprintf("projects/%s/locations/%s/keyRings/%s/cryptoKeys/%s/cryptoKeyVersions/%s", projectId, locationId, keyRing, key, keyVersion),
-		credentialPath: credentialPath,
+// newSignerWallet builds the signer of a wallet with its retry policy and
+// circuit breakers, and self-tests it. This is what a reload rebuilds.
+func newSignerWallet(params map[string]string) (Wallet, error) {
+	var kmsType string
+	if _, ok := params["kms_type"]; ok {
+		kmsType = params["kms_type"]
 	}
 
-	err = NewKMSCrypto(&gcpKMS)
+	policy, err := newRetryPolicy(params)
 	if err != nil {
-		return nil, err
+		return Wallet{}, err
 	}
-
-	fmt.Printf("wallet address: %+v \n", gcpKMS.addr.String())
-	fmt.Printf("pubkey: %+v \n", gcpKMS.pkey.SerializeCompressed())
-
-	return gcpKMS, nil
-}
-
-func getSignatureFromKms(
-	ctx context.Context, svc *kms.Client, keyId string, txHashBytes []byte,
-) ([]byte, []byte, error) {
-	signInput := &kms.SignInput{
-		KeyId:            aws.String(keyId),
-		SigningAlgorithm: awsKmsSignOperationSigningAlgorithm,
-		MessageType:      awsKmsSignOperationMessageType,
-		Message:          txHashBytes,
+	breakerCfg, err := newBreakerConfig(params)
+	if err != nil {
+		return Wallet{}, err
 	}
 
-	signOutput, err := svc.Sign(ctx, signInput)
-	if err != nil {
-		return nil, nil, err
+	var signer Signer
+	if params["backends"] != "" {
+		f, err := newFailoverSigner(params, breakerCfg)
+		if err != nil {
+			return Wallet{}, err
+		}
+		// call_timeout then bounds each endpoint and the failover signer
+		// as a whole only has to finish within the signing deadline.
+		f.timeout = policy.callTimeout
+		policy.callTimeout = policy.signDeadline
+		signer = f
+	} else {
+		signer, err = NewSigner(kmsType, params)
+		if err != nil {
+			return Wallet{}, err
+		}
 	}
 
-	var sigAsn1 asn1EcSig
-	_, err = asn1.Unmarshal(signOutput.Signature, &sigAsn1)
+	wallet, err := newWallet(signer)
 	if err != nil {
-		return nil, nil, err
+		closeSigner(signer)
+		return Wallet{}, err
 	}
-
-	return sigAsn1.R.Bytes, sigAsn1.S.Bytes, nil
+	wallet.policy = policy
+	if wallet.breaker != nil {
+		wallet.backend = signerName(kmsType)
+		wallet.breaker = newCircuitBreaker(wallet.backend, breakerCfg)
+	}
+	if err := runSelfTest(wallet, params); err != nil {
+		closeSigner(signer)
+		return Wallet{}, err
+	}
+	return wallet, nil
 }
 
-func GetPubKeyCtx(ctx context.Context, svc *kms.Client, keyId string) (*crypto.PublicKey, error) {
-	pubKeyBytes, err := getPublicKeyDerBytesFromKMS(ctx, svc, keyId)
-	if err != nil {
-		return nil, err
+// claimKey takes the key lock and the signer lease of the wallet address.
+// The lock is local and taken first, so nothing is left to release when it
+// is held by another process.
+func (w *Wallet) claimKey(params map[string]string) error {
+	var err error
+	if w.guard, err = newSignGuard(params, w.addr.String()); err != nil {
+		return err
+	}
+	if w.lease, err = newSignerLease(params, w.addr.String()); err != nil {
+		w.guard.close()
+		return err
+	}
+	if w.lease != nil {
+		w.stopLease = startLease(w.lease)
 	}
+	return nil
+}
 
-	pubkey, err := crypto.ParsePublicKey(pubKeyBytes)
-	if err != nil {
-		return nil, err
+// releaseKey gives up the signer lease and the key lock taken by claimKey.
+func (w Wallet) releaseKey() {
+	if w.lease != nil && w.stopLease != nil {
+		w.stopLease()
+		ctx, cancel := context.WithTimeout(context.Background(), w.lease.TTL()/3)
+		if err := w.lease.Release(ctx); err != nil {
+			logger.Warn("signer lease not released", "lease", w.lease, "err", err)
+		}
+		cancel()
 	}
-	return pubkey, nil
+	w.guard.close()
 }
 
 func NewAccountAddressFromPublicKey(pubKey *crypto.PublicKey) *address.Address {
 	pk := pubKey.SerializeUncompressed()
 	if pk == nil {
-		fmt.Printf("FAIL invalid public key: %v \n", pubKey)
+		logger.Error("invalid public key", "pubkey", pubKey)
 	}
 	digest := crypto.SHA3Sum256(pk[1:])
 	return address.NewAddress(digest[len(digest)-address.AddressIDBytes:])
 }
 
-func getPublicKeyDerBytesFromKMS(ctx context.Context, svc *kms.Client, keyId string) ([]byte, error) {
-	getPubKeyOutput, err := svc.GetPublicKey(ctx, &kms.GetPublicKeyInput{
-		KeyId: aws.String(keyId),
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	var asn1pubk asn1EcPublicKey
-	_, err = asn1.Unmarshal(getPubKeyOutput.PublicKey, &asn1pubk)
-	if err != nil {
-		return nil, err
-	}
-
-	return asn1pubk.PublicKey.Bytes, nil
-}
-
 func adjustSignatureLength(buffer []byte) []byte {
 	buffer = bytes.TrimLeft(buffer, "\x00")
 	for len(buffer) < 32 {
@@ -311,108 +425,3 @@ func adjustSignatureLength(buffer []byte) []byte {
 	}
 	return buffer
 }
-
-// ///////////////////
-// GG CLOUD - KMS
-type KMS struct {
-	parentName     string
-	credentialPath string
-	addr           *address.Address
-	pkey           *crypto.PublicKey
-	kmsClient      *cloudkms.KeyManagementClient
-}
-
-func NewKMSCrypto(conf *KMS) error {
-	opt := option.WithCredentialsFile(conf.credentialPath)
-
-	kmsClient, err := cloudkms.NewKeyManagementClient(context.Background(), opt)
-	if err != nil {
-		fmt.Printf("Error getting kms client %v", err)
-		return err
-	}
-	conf.kmsClient = kmsClient
-
-	dresp, err := kmsClient.GetPublicKey(context.Background(), &kmspb.GetPublicKeyRequest{Name: conf.parentName})
-	if err != nil {
-		fmt.Printf("Error getting GetPublicKey %v", err)
-		return err
-	}
-
-	pubKeyBlock, _ := pem.Decode([]byte(dresp.Pem))
-	if pubKeyBlock == nil {
-		fmt.Println("pubKeyBlock is nil")
-		return errors.New("pubKeyBlock is nil")
-	}
-
-	var info struct {
-		AlgID pkix.AlgorithmIdentifier
-		Key   asn1.BitString
-	}
-	_, err = asn1.Unmarshal(pubKeyBlock.Bytes, &info)
-	if err != nil {
-		fmt.Println(err.Error())
-		return err
-	}
-
-	wantAlg := asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
-	if gotAlg := info.AlgID.Algorithm; !gotAlg.Equal(wantAlg) {
-		fmt.Printf("Google KMS public key %q ASN.1 algorithm %s intead of %s \n", conf.parentName, gotAlg, wantAlg)
-		return nil
-	}
-
-	conf.pkey, err = crypto.ParsePublicKey(info.Key.Bytes)
-	if err != nil {
-		fmt.Println(err.Error())
-		return nil
-	}
-
-	conf.addr = NewAccountAddressFromPublicKey(conf.pkey)
-	if conf.addr == nil {
-		fmt.Println("Addr must not nil")
-	}
-
-	return nil
-}
-
-func (t KMS) PublicKey() []byte {
-	return t.pkey.SerializeCompressed()
-}
-
-func (t KMS) Address() address.IAddress {
-	return t.addr
-}
-
-func (t KMS) Sign(data []byte) ([]byte, error) {
-	signData, err := t.kmsClient.AsymmetricSign(context.Background(), &kmspb.AsymmetricSignRequest{Name: t.parentName, Digest: &kmspb.Digest{
-		Digest: &kmspb.Digest_Sha256{
-			Sha256: data[:],
-		},
-	}})
-
-	if err != nil {
-		return nil, err
-	}
-
-	var params struct{ R, S *big.Int }
-	_, err = asn1.Unmarshal(signData.Signature, &params)
-	if err != nil {
-		return nil, fmt.Errorf("Google KMS asymmetric signature encoding: %w", err)
-	}
-	var rLen, sLen int // byte size
-	if params.R != nil {
-		rLen = (params.R.BitLen() + 7) / 8
-	}
-	if params.S != nil {
-		sLen = (params.S.BitLen() + 7) / 8
-	}
-	if rLen == 0 || rLen > 32 || sLen == 0 || sLen > 32 {
-		return nil, fmt.Errorf("Google KMS asymmetric signature with %d-byte r and %d-byte s denied on size", rLen, sLen)
-	}
-
-	signature, err := getEthereumSignature(data, params.R.Bytes(), params.S.Bytes(), t.pkey)
-	if err != nil {
-		return nil, err
-	}
-
-	return signature, nil
-}
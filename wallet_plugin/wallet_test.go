@@ -1,63 +1,232 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/hex"
-	"fmt"
+	"math/big"
 	"os"
 	"testing"
+
+	crypto "github.com/remote-signing/wallet_plugin/key"
+	"github.com/remote-signing/wallet_plugin/secp256k1"
 )
 
-func TestWalletImport(t *testing.T) {
-	params := make(map[string]string)
-	params["kms_type"] = AWS
-	params["region"] = os.Getenv("REGION")
-	params["access_key_id"] = os.Getenv("ACCESS_KEY_ID")
-	params["secret_access_key"] = os.Getenv("SECRET_ACCESS_KEY")
-	params["key_id"] = os.Getenv("KEY_ID")
+type walletImpl interface {
+	Sign(data []byte) ([]byte, error)
+	PublicKey() []byte
+}
+
+// backendParams returns the plugin parameters for running a registered
+// backend against its real service, or nil when the environment doesn't
+// provide them.
+var backendParams = map[string]func() map[string]string{
+	"aws": func() map[string]string {
+		if os.Getenv("KEY_ID") == "" {
+			return nil
+		}
+		params := make(map[string]string)
+		params["kms_type"] = AWS
+		params["region"] = os.Getenv("REGION")
+		params["access_key_id"] = os.Getenv("ACCESS_KEY_ID")
+		params["secret_access_key"] = os.Getenv("SECRET_ACCESS_KEY")
+		params["key_id"] = os.Getenv("KEY_ID")
+		return params
+	},
+	"gcp": func() map[string]string {
+		credentialPath := "remote-sign-407206-8b50af709ec3.json"
+		if _, err := os.Stat(credentialPath); err != nil {
+			return nil
+		}
+		params := make(map[string]string)
+		params["kms_type"] = GCP
+		params["project_id"] = "remote-sign-407206"
+		params["location_id"] = "asia-southeast1"
+		params["key_ring"] = "remote-sign"
+		params["key"] = "remote-sign"
+		params["key_version"] = "1"
+		params["credential_path"] = credentialPath
+		return params
+	},
+	"azure": func() map[string]string {
+		if os.Getenv("AZURE_VAULT_URL") == "" {
+			return nil
+		}
+		params := make(map[string]string)
+		params["kms_type"] = "azure"
+		params["vault_url"] = os.Getenv("AZURE_VAULT_URL")
+		params["key_name"] = os.Getenv("AZURE_KEY_NAME")
+		params["key_version"] = os.Getenv("AZURE_KEY_VERSION")
+		params["tenant_id"] = os.Getenv("AZURE_TENANT_ID")
+		params["client_id"] = os.Getenv("AZURE_CLIENT_ID")
+		params["client_secret"] = os.Getenv("AZURE_CLIENT_SECRET")
+		return params
+	},
+	"vault": func() map[string]string {
+		if os.Getenv("VAULT_ADDR") == "" {
+			return nil
+		}
+		params := make(map[string]string)
+		params["kms_type"] = "vault"
+		params["vault_addr"] = os.Getenv("VAULT_ADDR")
+		params["vault_token"] = os.Getenv("VAULT_TOKEN")
+		params["key_name"] = os.Getenv("VAULT_KEY_NAME")
+		return params
+	},
+}
 
-	iWallet, err := NewWallet(params)
-	if err != nil {
-		panic(err)
-	}
-	walletInst := iWallet.(Wallet)
+func TestRegisteredBackends(t *testing.T) {
 	signData, _ := hex.DecodeString("356355dae4212533ce182cbb31492a6c2665fcf8f17e089d929e7a3efd1d1ba1")
-	signature, err := walletInst.Sign(signData)
+
+	for _, name := range RegisteredSigners() {
+		t.Run(name, func(t *testing.T) {
+			paramsFn, ok := backendParams[name]
+			if !ok {
+				t.Skipf("no test parameters for backend %s", name)
+			}
+			params := paramsFn()
+			if params == nil {
+				t.Skipf("environment not configured for backend %s", name)
+			}
+
+			iWallet, err := NewWallet(params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			walletInst := iWallet.(walletImpl)
+
+			signature, err := walletInst.Sign(signData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifyRecoverable(t, signData, signature, walletInst.PublicKey())
+		})
+	}
+}
+
+func TestBackendAliases(t *testing.T) {
+	for alias, name := range map[string]string{AWS: "aws", GCP: "gcp"} {
+		signersMu.RLock()
+		got := aliases[alias]
+		signersMu.RUnlock()
+		if got != name {
+			t.Errorf("alias %q resolves to %q, want %q", alias, got, name)
+		}
+	}
+	signersMu.RLock()
+	n := len(aliases)
+	signersMu.RUnlock()
+	if n != 2 {
+		t.Errorf("%d aliases registered, want only those of aws and gcp", n)
+	}
+
+	if _, err := NewWallet(map[string]string{"kms_type": "unknown"}); err == nil {
+		t.Error("NewWallet accepted an unknown kms_type")
+	}
+}
+
+func TestWalletSignNormalizesS(t *testing.T) {
+	signer := newFakeSigner(t)
+	w, err := newWallet(signer)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
 
-	fmt.Printf("signature: %+v", signature)
+	for i := 0; i < 16; i++ {
+		digest := make([]byte, 32)
+		_, _ = rand.Read(digest)
+
+		signer.highS = i%2 == 0
+		signature, err := w.Sign(digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(signature) != crypto.SignatureLenRawWithV {
+			t.Fatalf("signature length %d, want %d", len(signature), crypto.SignatureLenRawWithV)
+		}
+		s := new(big.Int).SetBytes(signature[32:64])
+		if s.Cmp(secp256k1halfN) > 0 {
+			t.Fatalf("signature has high S: %x", signature)
+		}
+		verifyRecoverable(t, digest, signature, w.PublicKey())
+	}
 }
 
-type walletImpl interface {
-	Sign(data []byte) ([]byte, error)
-	PublicKey() []byte
+func verifyRecoverable(t *testing.T, digest, signature, pubKey []byte) {
+	t.Helper()
+	sig, err := crypto.ParseSignature(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovered, err := sig.RecoverPublicKey(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(recovered.SerializeCompressed()) != hex.EncodeToString(pubKey) {
+		t.Fatalf("recovered pubkey %s, want 0x%x", recovered, pubKey)
+	}
 }
 
-func TestGCPKms(t *testing.T) {
-	params := make(map[string]string)
-	params["kms_type"] = GCP
-	params["project_id"] = "remote-sign-407206"
-	params["location_id"] = "asia-southeast1"
-	params["key_ring"] = "remote-sign"
-	params["key"] = "remote-sign"
-	params["key_version"] = "1"
-	params["credential_path"] = "remote-sign-407206-8b50af709ec3.json"
+// fakeSigner is an in-memory backend which signs with plain big.Int
+// arithmetic, so the wallet can be tested without any KMS.
+type fakeSigner struct {
+	d     *big.Int
+	pkey  *crypto.PublicKey
+	highS bool
+}
 
-	iWallet, err := NewWallet(params)
+func newFakeSigner(t *testing.T) *fakeSigner {
+	t.Helper()
+	curve := secp256k1.S256()
+	d, err := rand.Int(rand.Reader, new(big.Int).Sub(curve.N, big.NewInt(1)))
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
-	walletInst := iWallet.(walletImpl)
-	fmt.Printf("pubkey: %+v \n", walletInst.PublicKey())
+	d.Add(d, big.NewInt(1))
 
-	// test sign
-	signData, _ := hex.DecodeString("356355dae4212533ce182cbb31492a6c2665fcf8f17e089d929e7a3efd1d1ba1")
-	signature, err := walletInst.Sign(signData)
+	x, y := curve.ScalarBaseMult(d.Bytes())
+	uncompressed := make([]byte, 65)
+	uncompressed[0] = 4
+	x.FillBytes(uncompressed[1:33])
+	y.FillBytes(uncompressed[33:])
+	pkey, err := crypto.ParsePublicKey(uncompressed)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
+	return &fakeSigner{d: d, pkey: pkey}
+}
+
+func (f *fakeSigner) PublicKey() *crypto.PublicKey {
+	return f.pkey
+}
 
-	fmt.Printf("signature: %+v \n", signature)
-	// get pubkey
+func (f *fakeSigner) SignDigest(_ context.Context, digest []byte) ([]byte, []byte, error) {
+	curve := secp256k1.S256()
+	e := new(big.Int).SetBytes(digest)
+	for {
+		k, err := rand.Int(rand.Reader, curve.N)
+		if err != nil {
+			return nil, nil, err
+		}
+		if k.Sign() == 0 {
+			continue
+		}
+		x, _ := curve.ScalarBaseMult(k.Bytes())
+		r := new(big.Int).Mod(x, curve.N)
+		if r.Sign() == 0 {
+			continue
+		}
+		s := new(big.Int).Mul(f.d, r)
+		s.Add(s, e)
+		s.Mul(s, new(big.Int).ModInverse(k, curve.N))
+		s.Mod(s, curve.N)
+		if s.Sign() == 0 {
+			continue
+		}
+		// Return whichever S the test asked for, KMS backends may give either.
+		if (s.Cmp(secp256k1halfN) > 0) != f.highS {
+			s.Sub(curve.N, s)
+		}
+		return r.Bytes(), s.Bytes(), nil
+	}
 }
@@ -0,0 +1,156 @@
+// Package walleterr defines the errors returned by the wallet plugin.
+//
+// Every error returned by the plugin is of type walleterr.Error and fully
+// supports the standard library errors.Is and errors.As functions. The caller
+// can check against an ErrorKind to decide how to react, and errors from the
+// underlying KMS SDKs remain reachable through errors.As.
+package walleterr
+
+import "errors"
+
+// ErrorKind identifies a kind of error.  It has full support for errors.Is
+// and errors.As, so the caller can directly check against an error kind when
+// determining the reason for an error.
+type ErrorKind string
+
+// These constants are used to identify a specific Error.
+const (
+	// ErrConfigMissingParam is returned when a required plugin parameter is
+	// not set.
+	ErrConfigMissingParam = ErrorKind("ErrConfigMissingParam")
+
+	// ErrConfigInvalidParam is returned when a plugin parameter has a value
+	// that can not be used.
+	ErrConfigInvalidParam = ErrorKind("ErrConfigInvalidParam")
+
+	// ErrBackendNotSupported is returned when kms_type names no registered
+	// backend.
+	ErrBackendNotSupported = ErrorKind("ErrBackendNotSupported")
+
+	// ErrBackendUnavailable is returned when the signing backend can not be
+	// reached or fails with a transient error.
+	ErrBackendUnavailable = ErrorKind("ErrBackendUnavailable")
+
+	// ErrBackendThrottled is returned when the signing backend rejects a
+	// request because of rate limits or quota.
+	ErrBackendThrottled = ErrorKind("ErrBackendThrottled")
+
+	// ErrSignDeadlineExceeded is returned when no signature could be
+	// obtained from the backend within the signing deadline.
+	ErrSignDeadlineExceeded = ErrorKind("ErrSignDeadlineExceeded")
+
+	// ErrCircuitOpen is returned without calling the backend while its
+	// circuit breaker is open after repeated failures.
+	ErrCircuitOpen = ErrorKind("ErrCircuitOpen")
+
+	// ErrPermissionDenied is returned when the credentials are rejected or
+	// are not allowed to use the key.
+	ErrPermissionDenied = ErrorKind("ErrPermissionDenied")
+
+	// ErrKeyNotFound is returned when the configured key does not exist.
+	ErrKeyNotFound = ErrorKind("ErrKeyNotFound")
+
+	// ErrKeyAlgorithmMismatch is returned when the key is not a secp256k1
+	// signing key.
+	ErrKeyAlgorithmMismatch = ErrorKind("ErrKeyAlgorithmMismatch")
+
+	// ErrKeyStateInvalid is returned when the key exists but is disabled or
+	// otherwise not usable for signing.
+	ErrKeyStateInvalid = ErrorKind("ErrKeyStateInvalid")
+
+	// ErrDigestLength is returned when the data to sign is not a 32-byte
+	// digest.
+	ErrDigestLength = ErrorKind("ErrDigestLength")
+
+	// ErrSignatureMalformed is returned when a backend returned a signature
+	// that can not form a 64-byte [R|S] signature.
+	ErrSignatureMalformed = ErrorKind("ErrSignatureMalformed")
+
+	// ErrSignatureHighS is returned when S is in the upper half of the curve
+	// order after normalization.
+	ErrSignatureHighS = ErrorKind("ErrSignatureHighS")
+
+	// ErrSignatureRecoveryFailed is returned when neither recovery id yields
+	// the public key of the wallet.
+	ErrSignatureRecoveryFailed = ErrorKind("ErrSignatureRecoveryFailed")
+
+	// ErrSignatureInvalid is returned when the signature does not verify
+	// against the digest and the public key of the wallet.
+	ErrSignatureInvalid = ErrorKind("ErrSignatureInvalid")
+
+	// ErrKeyInUse is returned when another signer holds the lock or lease
+	// of the key.
+	ErrKeyInUse = ErrorKind("ErrKeyInUse")
+
+	// ErrDuplicateDigest is returned when the digest was signed before and
+	// the double-sign policy rejects signing it again.
+	ErrDuplicateDigest = ErrorKind("ErrDuplicateDigest")
+
+	// ErrAuditLog is returned when the audit log can not be opened or a
+	// signing request can not be recorded in it. No signature is returned
+	// that was not recorded.
+	ErrAuditLog = ErrorKind("ErrAuditLog")
+
+	// ErrSigningPaused is returned while signing is paused through the
+	// admin socket.
+	ErrSigningPaused = ErrorKind("ErrSigningPaused")
+)
+
+// Error satisfies the error interface and prints human-readable errors.
+func (e ErrorKind) Error() string {
+	return string(e)
+}
+
+// Error identifies an error of the wallet plugin. It has full support for
+// errors.Is and errors.As, so the caller can ascertain the specific reason for
+// the error by checking the kind, and reach the underlying cause.
+type Error struct {
+	Err         error
+	Description string
+	Cause       error
+}
+
+// Error satisfies the error interface and prints human-readable errors.
+func (e Error) Error() string {
+	if e.Cause != nil {
+		return e.Description + ": " + e.Cause.Error()
+	}
+	return e.Description
+}
+
+// Is reports whether the kind of the error is target.
+func (e Error) Is(target error) bool {
+	return e.Err == target
+}
+
+// Unwrap returns the underlying cause, if any.
+func (e Error) Unwrap() error {
+	return e.Cause
+}
+
+// New creates an Error given a set of arguments.
+func New(kind ErrorKind, desc string) Error {
+	return Error{Err: kind, Description: desc}
+}
+
+// Wrap creates an Error of the given kind for an underlying cause. An Error
+// passed as the cause is returned unchanged so its kind is kept.
+func Wrap(kind ErrorKind, cause error, desc string) error {
+	var e Error
+	if errors.As(cause, &e) {
+		return cause
+	}
+	return Error{Err: kind, Description: desc, Cause: cause}
+}
+
+// KindOf returns the kind of err, or an empty ErrorKind if err was not
+// created by this package.
+func KindOf(err error) ErrorKind {
+	var e Error
+	if errors.As(err, &e) {
+		if kind, ok := e.Err.(ErrorKind); ok {
+			return kind
+		}
+	}
+	return ""
+}
@@ -0,0 +1,113 @@
+package walleterr
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+// TestErrorKindStringer tests the stringized output for the ErrorKind type.
+func TestErrorKindStringer(t *testing.T) {
+	tests := []struct {
+		in   ErrorKind
+		want string
+	}{
+		{ErrConfigMissingParam, "ErrConfigMissingParam"},
+		{ErrBackendUnavailable, "ErrBackendUnavailable"},
+		{ErrBackendThrottled, "ErrBackendThrottled"},
+		{ErrKeyAlgorithmMismatch, "ErrKeyAlgorithmMismatch"},
+		{ErrSignatureRecoveryFailed, "ErrSignatureRecoveryFailed"},
+		{ErrPermissionDenied, "ErrPermissionDenied"},
+		{ErrAuditLog, "ErrAuditLog"},
+		{ErrSigningPaused, "ErrSigningPaused"},
+	}
+
+	for i, test := range tests {
+		result := test.in.Error()
+		if result != test.want {
+			t.Errorf("#%d: got: %s want: %s", i, result, test.want)
+		}
+	}
+}
+
+// TestError tests the error output for the Error type.
+func TestError(t *testing.T) {
+	tests := []struct {
+		in   error
+		want string
+	}{
+		{New(ErrKeyNotFound, "some error"), "some error"},
+		{Wrap(ErrBackendUnavailable, io.EOF, "AWS KMS Sign"), "AWS KMS Sign: EOF"},
+	}
+
+	for i, test := range tests {
+		result := test.in.Error()
+		if result != test.want {
+			t.Errorf("#%d: got: %s want: %s", i, result, test.want)
+		}
+	}
+}
+
+// TestErrorKindIsAs ensures both ErrorKind and Error can be identified as
+// being a specific error kind via errors.Is and unwrapped via errors.As, and
+// that the cause stays reachable.
+func TestErrorKindIsAs(t *testing.T) {
+	wrapped := Wrap(ErrBackendThrottled, io.ErrUnexpectedEOF, "throttled")
+	rewrapped := Wrap(ErrBackendUnavailable, wrapped, "outer")
+
+	tests := []struct {
+		name      string
+		err       error
+		target    error
+		wantMatch bool
+		wantKind  ErrorKind
+	}{{
+		name:      ErrPermissionDenied.Error() + " == " + ErrPermissionDenied.Error(),
+		err:       ErrPermissionDenied,
+		target:    ErrPermissionDenied,
+		wantMatch: true,
+	}, {
+		name:      "Error.ErrPermissionDenied == ErrPermissionDenied",
+		err:       New(ErrPermissionDenied, ""),
+		target:    ErrPermissionDenied,
+		wantMatch: true,
+		wantKind:  ErrPermissionDenied,
+	}, {
+		name:      "Error.ErrPermissionDenied != ErrKeyNotFound",
+		err:       New(ErrPermissionDenied, ""),
+		target:    ErrKeyNotFound,
+		wantMatch: false,
+		wantKind:  ErrPermissionDenied,
+	}, {
+		name:      "wrapped cause is reachable",
+		err:       wrapped,
+		target:    io.ErrUnexpectedEOF,
+		wantMatch: true,
+		wantKind:  ErrBackendThrottled,
+	}, {
+		name:      "rewrapping keeps the kind",
+		err:       rewrapped,
+		target:    ErrBackendThrottled,
+		wantMatch: true,
+		wantKind:  ErrBackendThrottled,
+	}, {
+		name:      "plain error has no kind",
+		err:       io.EOF,
+		target:    ErrBackendUnavailable,
+		wantMatch: false,
+	}}
+
+	for _, test := range tests {
+		// Ensure the error matches or not depending on the expected result.
+		result := errors.Is(test.err, test.target)
+		if result != test.wantMatch {
+			t.Errorf("%s: incorrect error identification -- got %v, want %v",
+				test.name, result, test.wantMatch)
+			continue
+		}
+
+		if kind := KindOf(test.err); kind != test.wantKind {
+			t.Errorf("%s: unexpected kind -- got %v, want %v", test.name, kind, test.wantKind)
+		}
+	}
+}